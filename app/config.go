@@ -0,0 +1,352 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	cwtchserver "git.openprivacy.ca/cwtch.im/server"
+	"git.openprivacy.ca/cwtch.im/server/bundle"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/openprivacy/log"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Settings are layered: defaults < serverConfig.json < environment < flags
+// Secret settings (keys and passwords) have no flags, they are read from the environment or from the file named by
+// their environment variable with a _FILE suffix: defaults < serverConfig.json < environment < file
+
+// envPrefix is prepended to the upper snake case name of a setting to get its environment variable
+// e.g. maxStorageMBs is read from CWTCH_MAX_STORAGE_MBS
+const envPrefix = "CWTCH_"
+
+// fileSuffix is appended to the environment variable of a secret setting to get the variable naming a file to read it
+// from, e.g. CWTCH_PRIVATE_KEY_FILE
+const fileSuffix = "_FILE"
+
+// lookupFn returns the value of a named setting from a source, and if it was set in that source
+type lookupFn func(name string) (string, bool)
+
+// optionFlag is a flag.Value that records if it was set so that unset flags don't override other sources
+type optionFlag struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *optionFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// envName converts a setting name to its environment variable name
+func envName(name string) string {
+	var sb strings.Builder
+	sb.WriteString(envPrefix)
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(runes[i-1]) {
+			sb.WriteRune('_')
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// registerOptionFlags adds a flag for every server ConfigOption to fs, except secret options
+func registerOptionFlags(fs *flag.FlagSet) map[string]*optionFlag {
+	flags := make(map[string]*optionFlag)
+	for _, opt := range cwtchserver.ConfigOptions {
+		if opt.Secret {
+			continue
+		}
+		f := &optionFlag{isBool: opt.Bool}
+		fs.Var(f, opt.Name, fmt.Sprintf("%s (env %s)", opt.Usage, envName(opt.Name)))
+		flags[opt.Name] = f
+	}
+	return flags
+}
+
+// envLookup reads settings from the environment, including the legacy DISABLE_METRICS variable
+func envLookup(name string) (string, bool) {
+	if name == "logMetricsToFile" && os.Getenv("DISABLE_METRICS") != "" {
+		return "false", true
+	}
+	return os.LookupEnv(envName(name))
+}
+
+// readSecretFile returns the contents, without surrounding whitespace, of the file named by the environment variable
+// env with fileSuffix. Returns false if the variable isn't set
+func readSecretFile(env string) (string, bool, error) {
+	file := os.Getenv(env + fileSuffix)
+	if file == "" {
+		return "", false, nil
+	}
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", true, fmt.Errorf("could not read %v: %v", env+fileSuffix, err)
+	}
+	return strings.TrimSpace(string(contents)), true, nil
+}
+
+// backupPasswordEnv is the environment variable holding the password of backup archives. Like the keys in the config
+// it can't be given as a flag, where other users could read it
+const backupPasswordEnv = "CWTCH_BACKUP_PASSWORD"
+
+// readBackupPassword returns the password of backup archives from the file named by backupPasswordEnv with fileSuffix
+// or, if that isn't set, from backupPasswordEnv itself
+func readBackupPassword() (string, error) {
+	password, exists, err := readSecretFile(backupPasswordEnv)
+	if err != nil || exists {
+		return password, err
+	}
+	return os.Getenv(backupPasswordEnv), nil
+}
+
+// secretFileLookup reads the secret settings from the files named in the environment, so they are read once even
+// when the config is reloaded
+func secretFileLookup() (lookupFn, error) {
+	secrets := make(map[string]string)
+	for _, opt := range cwtchserver.ConfigOptions {
+		if !opt.Secret {
+			continue
+		}
+		value, exists, err := readSecretFile(envName(opt.Name))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			secrets[opt.Name] = value
+		}
+	}
+	return func(name string) (string, bool) {
+		value, exists := secrets[name]
+		return value, exists
+	}, nil
+}
+
+// flagLookup reads settings from flags that were explicitly set on the command line
+func flagLookup(flags map[string]*optionFlag, disableMetrics bool) lookupFn {
+	return func(name string) (string, bool) {
+		if name == "logMetricsToFile" && disableMetrics {
+			return "false", true
+		}
+		if f, exists := flags[name]; exists && f.set {
+			return f.value, true
+		}
+		return "", false
+	}
+}
+
+// applyConfigOverrides overrides each ConfigOption found in sources (in increasing order of precedence) in config
+// and then validates the result. Overrides are not saved to the config file.
+func applyConfigOverrides(config *cwtchserver.Config, sources ...lookupFn) error {
+	for _, opt := range cwtchserver.ConfigOptions {
+		for _, source := range sources {
+			if value, exists := source(opt.Name); exists {
+				if err := opt.Override(config, value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid server config: %v", err)
+	}
+	return nil
+}
+
+// parseLogLevel converts a log level name to a log.Level
+func parseLogLevel(level string) (log.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return log.LevelDebug, nil
+	case "info":
+		return log.LevelInfo, nil
+	case "warn":
+		return log.LevelWarn, nil
+	case "error":
+		return log.LevelError, nil
+	}
+	return log.LevelInfo, fmt.Errorf("invalid log level %q: expected one of debug, info, warn or error", level)
+}
+
+// resolveString returns the highest precedence value of a setting: def < env < flag
+func resolveString(def string, env string, flagValue string, flagSet bool) string {
+	value := def
+	if envValue, exists := os.LookupEnv(env); exists && envValue != "" {
+		value = envValue
+	}
+	if flagSet {
+		value = flagValue
+	}
+	return value
+}
+
+// resolveBool returns the highest precedence value of a boolean setting: def < env < flag
+func resolveBool(def bool, env string, flagValue bool, flagSet bool) (bool, error) {
+	value := def
+	if envValue, exists := os.LookupEnv(env); exists && envValue != "" {
+		b, err := strconv.ParseBool(envValue)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for %s: %v", env, err)
+		}
+		value = b
+	}
+	if flagSet {
+		value = flagValue
+	}
+	return value, nil
+}
+
+// readImportedKeys reads the keys in the given files (each optional) to import into the server config. Returns false
+// if no files were given
+func readImportedKeys(keyFile string, tokenServerKeyFile string, tokenServiceKFile string) (cwtchserver.ImportedKeys, bool, error) {
+	var keys cwtchserver.ImportedKeys
+	if keyFile == "" && tokenServerKeyFile == "" && tokenServiceKFile == "" {
+		return keys, false, nil
+	}
+	if keyFile != "" {
+		raw, err := os.ReadFile(keyFile)
+		if err == nil {
+			keys.PrivateKey, err = cwtchserver.ParsePrivateKey(raw)
+		}
+		if err != nil {
+			return keys, true, fmt.Errorf("could not import server key from %v: %v", keyFile, err)
+		}
+	}
+	if tokenServerKeyFile != "" {
+		raw, err := os.ReadFile(tokenServerKeyFile)
+		if err == nil {
+			keys.TokenServerPrivateKey, err = cwtchserver.ParsePrivateKey(raw)
+		}
+		if err != nil {
+			return keys, true, fmt.Errorf("could not import token server key from %v: %v", tokenServerKeyFile, err)
+		}
+	}
+	if tokenServiceKFile != "" {
+		raw, err := os.ReadFile(tokenServiceKFile)
+		if err == nil {
+			keys.TokenServiceK, err = cwtchserver.ParseTokenServiceK(raw)
+		}
+		if err != nil {
+			return keys, true, fmt.Errorf("could not import token service scalar from %v: %v", tokenServiceKFile, err)
+		}
+	}
+	return keys, true, nil
+}
+
+// loadCreateConfigWithKeys imports keys into the config in configDir, creating it if it doesn't exist. The keys are
+// validated before anything is saved
+func loadCreateConfigWithKeys(configDir string, keys cwtchserver.ImportedKeys, defaultLogToFile bool) (*cwtchserver.Config, error) {
+	if _, err := os.Stat(path.Join(configDir, cwtchserver.ServerConfigFile)); os.IsNotExist(err) {
+		return cwtchserver.CreateConfigWithKeys(configDir, cwtchserver.ServerConfigFile, false, "", defaultLogToFile, keys)
+	}
+	config, err := cwtchserver.LoadConfig(configDir, cwtchserver.ServerConfigFile, false, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ImportKeys(keys); err != nil {
+		return nil, fmt.Errorf("could not import keys: %v", err)
+	}
+	log.Infof("Imported keys, the server is now %v\n", config.Onion())
+	return config, config.Save()
+}
+
+// withStoppedServer calls fn with a server using config, which must not be running elsewhere
+func withStoppedServer(config *cwtchserver.Config, fn func(server cwtchserver.Server) error) error {
+	// a running server holds its spent token databases open, and opening them here would wait for it to stop
+	if err := cwtchserver.CheckServerStopped(config.ConfigDir); err != nil {
+		return err
+	}
+	server := cwtchserver.NewServer(config)
+	defer server.Destroy()
+	return fn(server)
+}
+
+// createFile calls fn to write a new file, which is removed again if fn fails
+func createFile(file string, fn func(w io.Writer) error) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err = fn(f); err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	return f.Close()
+}
+
+// serverBundleFile is the bundle file written by -exportServerBundle, alongside the bare server bundle written to
+// serverbundle
+const serverBundleFile = "serverbundle.txt"
+
+// exportServerBundle writes the server's bundle to file as a bundle file, replacing any bundle exported before
+func exportServerBundle(server cwtchserver.Server, file string) error {
+	serverBundle, err := bundle.Decode(server.ServerBundle())
+	if err != nil {
+		return err
+	}
+	os.Remove(file)
+	return createFile(file, serverBundle.Export)
+}
+
+// writeBackup writes a backup archive of the stopped server using config to file
+func writeBackup(config *cwtchserver.Config, file string, password string) error {
+	return withStoppedServer(config, func(server cwtchserver.Server) error {
+		return createFile(file, func(w io.Writer) error {
+			return server.Backup(w, password)
+		})
+	})
+}
+
+// exportMessages writes the messages of the stopped server using config to file
+func exportMessages(config *cwtchserver.Config, file string) (count int, err error) {
+	err = withStoppedServer(config, func(server cwtchserver.Server) error {
+		return createFile(file, func(w io.Writer) (err error) {
+			count, err = server.ExportMessages(w)
+			return err
+		})
+	})
+	return count, err
+}
+
+// importMessages adds the messages exported to file to the stopped server using config
+func importMessages(config *cwtchserver.Config, file string) (result storage.MessageImport, err error) {
+	err = withStoppedServer(config, func(server cwtchserver.Server) error {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		result, err = server.ImportMessages(f)
+		return err
+	})
+	return result, err
+}
+
+// rotateIdentity moves the stopped server using config to new onions, returning the new onion
+func rotateIdentity(config *cwtchserver.Config, transition time.Duration) (onion string, err error) {
+	err = withStoppedServer(config, func(server cwtchserver.Server) error {
+		onion, err = server.RotateIdentity(transition)
+		return err
+	})
+	return onion, err
+}
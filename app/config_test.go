@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	cwtchserver "git.openprivacy.ca/cwtch.im/server"
+	"golang.org/x/crypto/ed25519"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for name, env := range map[string]string{
+		"maxStorageMBs":    "CWTCH_MAX_STORAGE_MBS",
+		"logMetricsToFile": "CWTCH_LOG_METRICS_TO_FILE",
+		"privateKey":       "CWTCH_PRIVATE_KEY",
+		"tokenServiceK":    "CWTCH_TOKEN_SERVICE_K",
+		"description":      "CWTCH_DESCRIPTION",
+	} {
+		if got := envName(name); got != env {
+			t.Errorf("expected the environment variable of %v to be %v, got %v", name, env, got)
+		}
+	}
+}
+
+// newTestConfig creates a config file in a temporary directory with maxStorageMBs and postsPerMinute set
+func newTestConfig(t *testing.T) *cwtchserver.Config {
+	t.Helper()
+	config, err := cwtchserver.LoadCreateDefaultConfigFile(t.TempDir(), cwtchserver.ServerConfigFile, false, "", true)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	config.MaxStorageMBs = 100
+	config.RateLimits.PostsPerMinute = 7
+	if err := config.Save(); err != nil {
+		t.Fatalf("could not save config: %v", err)
+	}
+	return config
+}
+
+// parseOptionFlags returns the option flags set by args
+func parseOptionFlags(t *testing.T, args ...string) map[string]*optionFlag {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerOptionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("could not parse flags: %v", err)
+	}
+	return flags
+}
+
+func TestApplyConfigOverrides(t *testing.T) {
+	config := newTestConfig(t)
+	t.Setenv("CWTCH_MAX_STORAGE_MBS", "200")
+	t.Setenv("CWTCH_SHUTDOWN_TIMEOUT_SECONDS", "20")
+	flags := parseOptionFlags(t, "-shutdownTimeoutSeconds", "30", "-replaysPerMinute", "5")
+	if err := applyConfigOverrides(config, envLookup, flagLookup(flags, false)); err != nil {
+		t.Fatalf("could not apply overrides: %v", err)
+	}
+
+	// defaults < file < env < flags
+	if config.MaxStorageMBs != 200 {
+		t.Errorf("expected the environment to override the file, got maxStorageMBs %d", config.MaxStorageMBs)
+	}
+	if config.ShutdownTimeoutSeconds != 30 {
+		t.Errorf("expected a flag to override the environment, got shutdownTimeoutSeconds %d", config.ShutdownTimeoutSeconds)
+	}
+	if config.RateLimits.ReplaysPerMinute != 5 {
+		t.Errorf("expected a flag to override the default, got replaysPerMinute %d", config.RateLimits.ReplaysPerMinute)
+	}
+	if config.RateLimits.PostsPerMinute != 7 {
+		t.Errorf("expected settings with no overrides to keep the file's value, got postsPerMinute %d", config.RateLimits.PostsPerMinute)
+	}
+
+	// overrides are not saved
+	if err := config.Save(); err != nil {
+		t.Fatalf("could not save config: %v", err)
+	}
+	saved, err := config.ReloadFromFile()
+	if err != nil {
+		t.Fatalf("could not reload config: %v", err)
+	}
+	if saved.MaxStorageMBs != 100 || saved.RateLimits.ReplaysPerMinute == 5 {
+		t.Errorf("expected overrides to be kept out of the config file, got maxStorageMBs %d replaysPerMinute %d", saved.MaxStorageMBs, saved.RateLimits.ReplaysPerMinute)
+	}
+}
+
+func TestApplyConfigOverridesInvalid(t *testing.T) {
+	config := newTestConfig(t)
+	t.Setenv("CWTCH_MAX_STORAGE_MBS", "lots")
+	if err := applyConfigOverrides(config, envLookup); err == nil {
+		t.Errorf("expected an invalid value in the environment to be rejected")
+	}
+}
+
+func TestDisableMetrics(t *testing.T) {
+	config := newTestConfig(t)
+	t.Setenv("DISABLE_METRICS", "1")
+	t.Setenv("CWTCH_LOG_METRICS_TO_FILE", "true")
+	if err := applyConfigOverrides(config, envLookup); err != nil {
+		t.Fatalf("could not apply overrides: %v", err)
+	}
+	if config.ServerReporting.LogMetricsToFile {
+		t.Errorf("expected DISABLE_METRICS to turn off metrics logging")
+	}
+
+	config = newTestConfig(t)
+	flags := parseOptionFlags(t, "-logMetricsToFile")
+	if err := applyConfigOverrides(config, flagLookup(flags, true)); err != nil {
+		t.Fatalf("could not apply overrides: %v", err)
+	}
+	if config.ServerReporting.LogMetricsToFile {
+		t.Errorf("expected -disableMetrics to turn off metrics logging")
+	}
+}
+
+func TestSecretFileOverrides(t *testing.T) {
+	encodedKey := func() (string, ed25519.PublicKey) {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("could not generate key: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(privateKey), publicKey
+	}
+	envKey, _ := encodedKey()
+	fileKey, filePublicKey := encodedKey()
+	keyFile := path.Join(t.TempDir(), "privateKey")
+	if err := os.WriteFile(keyFile, []byte(fileKey+"\n"), 0600); err != nil {
+		t.Fatalf("could not write key file: %v", err)
+	}
+	t.Setenv("CWTCH_PRIVATE_KEY", envKey)
+	t.Setenv("CWTCH_PRIVATE_KEY_FILE", keyFile)
+
+	config := newTestConfig(t)
+	secretFiles, err := secretFileLookup()
+	if err != nil {
+		t.Fatalf("could not read secret files: %v", err)
+	}
+	if err := applyConfigOverrides(config, envLookup, secretFiles); err != nil {
+		t.Fatalf("could not apply overrides: %v", err)
+	}
+	if !filePublicKey.Equal(config.PublicKey) {
+		t.Errorf("expected the key file to override the environment variable")
+	}
+
+	// secrets can't be given as flags
+	if _, exists := parseOptionFlags(t)["privateKey"]; exists {
+		t.Errorf("expected no flag for the private key")
+	}
+
+	t.Setenv("CWTCH_PRIVATE_KEY_FILE", path.Join(t.TempDir(), "missing"))
+	if _, err := secretFileLookup(); err == nil {
+		t.Errorf("expected a missing key file to be an error")
+	}
+}
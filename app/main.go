@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"flag"
 	cwtchserver "git.openprivacy.ca/cwtch.im/server"
+	"git.openprivacy.ca/cwtch.im/server/bundle"
 	"git.openprivacy.ca/cwtch.im/tapir/primitives"
 	"git.openprivacy.ca/openprivacy/connectivity/tor"
 	"git.openprivacy.ca/openprivacy/log"
@@ -18,23 +19,48 @@ import (
 )
 
 func main() {
-	flagDebug := flag.Bool("debug", false, "Enable debug logging")
-	flagExportServer := flag.Bool("exportServerBundle", false, "Export the server bundle to a file called serverbundle")
-	flagDir := flag.String("dir", ".", "Directory to store server files in (config, encrypted messages, metrics)")
-	flagDisableMetrics := flag.Bool("disableMetrics", false, "Disable metrics reporting")
+	flagDebug := flag.Bool("debug", false, "Enable debug logging (same as -logLevel debug)")
+	flagLogLevel := flag.String("logLevel", "info", "Log level: debug, info, warn or error (env CWTCH_LOG_LEVEL)")
+	flagExportServer := flag.Bool("exportServerBundle", false, "Export the server bundle to files called serverbundle and "+serverBundleFile+" (env CWTCH_EXPORT_SERVER_BUNDLE)")
+	flagDir := flag.String("dir", ".", "Directory to store server files in (config, encrypted messages, metrics) (env CWTCH_HOME)")
+	flagDisableMetrics := flag.Bool("disableMetrics", false, "Disable metrics reporting (same as -logMetricsToFile=false)")
+	flagCompactSpentTokens := flag.Bool("compactSpentTokens", false, "Delete spent tokens that are no longer needed, compact the spent token databases and exit (the server must not be running)")
+	flagRotateIdentity := flag.Bool("rotateIdentity", false, "Move the server to new onions and exit (the server must not be running). The previous onions run alongside them for -identityTransitionHours")
+	flagIdentityTransitionHours := flag.Int("identityTransitionHours", 168, "How long the previous onions keep running after -rotateIdentity")
+	flagImportKeyFile := flag.String("importKeyFile", "", "Import the server onion's ed25519 private key from a file (raw or base64), creating the server if it doesn't exist")
+	flagImportTokenServerKeyFile := flag.String("importTokenServerKeyFile", "", "Import the token server onion's ed25519 private key from a file (raw or base64)")
+	flagImportTokenServiceKFile := flag.String("importTokenServiceKFile", "", "Import the base64 encoded privacy pass token service scalar from a file")
+	flagBackup := flag.String("backup", "", "Write an encrypted backup archive of the server to a file and exit (the server must not be running)")
+	flagRestore := flag.String("restore", "", "Replace the server's state with a backup archive from a file and exit (the server must not be running)")
+	flagExportMessages := flag.String("exportMessages", "", "Export the stored messages to a file and exit (the server must not be running)")
+	flagImportMessages := flag.String("importMessages", "", "Add the messages exported to a file to the message store, skipping those already stored, and exit (the server must not be running)")
+	optionFlags := registerOptionFlags(flag.CommandLine)
 	flag.Parse()
 
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
 	log.AddEverythingFromPattern("server/app/main")
 	log.AddEverythingFromPattern("server/server")
 	log.ExcludeFromPattern("service.go")
-	log.SetLevel(log.LevelInfo)
+	logLevelName := resolveString("info", envName("logLevel"), *flagLogLevel, setFlags["logLevel"])
 	if *flagDebug {
+		logLevelName = "debug"
+	}
+	logLevel, err := parseLogLevel(logLevelName)
+	if err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	log.SetLevel(logLevel)
+	if logLevel == log.LevelDebug {
 		log.Infoln("enableing Debug logging")
-		log.SetLevel(log.LevelDebug)
 	}
-	configDir := os.Getenv("CWTCH_HOME")
-	if configDir == "" {
-		configDir = *flagDir
+	configDir := resolveString(".", "CWTCH_HOME", *flagDir, setFlags["dir"])
+	exportServer, err := resolveBool(false, envName("exportServerBundle"), *flagExportServer, setFlags["exportServerBundle"])
+	if err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
 	}
 	if len(os.Args) == 2 && os.Args[1] == "gen1" {
 		config := new(cwtchserver.Config)
@@ -54,16 +80,102 @@ func main() {
 		return
 	}
 
-	disableMetrics := *flagDisableMetrics
-	if os.Getenv("DISABLE_METRICS") != "" {
-		disableMetrics = true
+	backupPassword, err := readBackupPassword()
+	if err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if *flagRestore != "" {
+		archive, err := os.Open(*flagRestore)
+		if err != nil {
+			log.Errorf("Could not open backup: %v\n", err)
+			os.Exit(1)
+		}
+		defer archive.Close()
+		manifest, err := cwtchserver.RestoreBackup(archive, backupPassword, configDir)
+		if err != nil {
+			log.Errorf("Could not restore backup: %v\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Restored %v from a backup of %v\n", manifest.Onion, manifest.Created)
+		return
+	}
+
+	disableMetrics := *flagDisableMetrics || os.Getenv("DISABLE_METRICS") != ""
+	importedKeys, importing, err := readImportedKeys(*flagImportKeyFile, *flagImportTokenServerKeyFile, *flagImportTokenServiceKFile)
+	if err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	var serverConfig *cwtchserver.Config
+	if importing {
+		serverConfig, err = loadCreateConfigWithKeys(configDir, importedKeys, !disableMetrics)
+	} else {
+		serverConfig, err = cwtchserver.LoadCreateDefaultConfigFile(configDir, cwtchserver.ServerConfigFile, false, "", !disableMetrics)
 	}
-	serverConfig, err := cwtchserver.LoadCreateDefaultConfigFile(configDir, cwtchserver.ServerConfigFile, false, "", !disableMetrics)
 	if err != nil {
 		log.Errorf("Could not load/create config file: %s\n", err)
 		return
 	}
-	serverConfig.ServerReporting.LogMetricsToFile = !disableMetrics
+	secretFiles, err := secretFileLookup()
+	if err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	overrides := []lookupFn{envLookup, secretFiles, flagLookup(optionFlags, *flagDisableMetrics)}
+	if err = applyConfigOverrides(serverConfig, overrides...); err != nil {
+		log.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if *flagCompactSpentTokens {
+		compaction, err := cwtchserver.CompactSpentTokens(serverConfig)
+		if err != nil {
+			log.Errorf("Could not compact spent tokens: %v\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Compacted spent tokens from %d to %d bytes, removed epochs %v\n", compaction.BytesBefore, compaction.BytesAfter, compaction.RemovedEpochs)
+		return
+	}
+
+	if *flagBackup != "" {
+		if err := writeBackup(serverConfig, *flagBackup, backupPassword); err != nil {
+			log.Errorf("Could not back up server: %v\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Backed up server to %v\n", *flagBackup)
+		return
+	}
+
+	if *flagExportMessages != "" {
+		count, err := exportMessages(serverConfig, *flagExportMessages)
+		if err != nil {
+			log.Errorf("Could not export messages: %v\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Exported %d messages to %v\n", count, *flagExportMessages)
+		return
+	}
+	if *flagImportMessages != "" {
+		result, err := importMessages(serverConfig, *flagImportMessages)
+		if err != nil {
+			log.Errorf("Could not import messages (%d imported before the error): %v\n", result.Imported, err)
+			os.Exit(1)
+		}
+		log.Infof("Imported %d messages, %d were already stored and %d had been pruned\n", result.Imported, result.Duplicates, result.Pruned)
+		return
+	}
+
+	if *flagRotateIdentity {
+		newOnion, err := rotateIdentity(serverConfig, time.Duration(*flagIdentityTransitionHours)*time.Hour)
+		if err != nil {
+			log.Errorf("Could not rotate server identity: %v\n", err)
+			os.Exit(1)
+		}
+		log.Infof("Moved server to %v, the previous onion runs alongside it for the next %d hours while the server is running\n", newOnion, *flagIdentityTransitionHours)
+		return
+	}
+
 	// we don't need real randomness for the port, just to avoid a possible conflict...
 	r := mrand.New(mrand.NewSource(int64(time.Now().Nanosecond())))
 	controlPort := r.Intn(1000) + 9052
@@ -89,20 +201,51 @@ func main() {
 	log.Infof("Server %s\n", server.Onion())
 
 	log.Infof("Server bundle (import into client to use server): %s\n", log.Magenta(server.ServerBundle()))
+	if endorsement := server.EndorsementBundle(); endorsement != nil {
+		log.Infof("Endorsement of the new onion by the previous onion (share with existing users): %s\n", (&bundle.Bundle{KeyBundle: endorsement}).Encode())
+	}
 
-	if *flagExportServer {
-		// Todo: change all to server export
+	if exportServer {
 		os.WriteFile(path.Join(serverConfig.ConfigDir, "serverbundle"), []byte(server.ServerBundle()), 0600)
+		if err := exportServerBundle(server, path.Join(serverConfig.ConfigDir, serverBundleFile)); err != nil {
+			log.Errorf("Could not export server bundle: %v\n", err)
+		}
 	}
 
-	// Graceful Stop
+	// Graceful Stop: drain in-flight requests, close the databases and exit cleanly
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		log.Infoln("Received shutdown signal, stopping server (signal again to force quit)...")
+		go func() {
+			<-c
+			log.Errorln("Forced shutdown")
+			os.Exit(1)
+		}()
 		server.Destroy()
 		acn.Close()
-		os.Exit(1)
+		log.Infoln("Server shutdown complete")
+		os.Exit(0)
+	}()
+
+	// Reload config: reread serverConfig.json (and the environment and flags on top of it) and apply it live
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infoln("Received SIGHUP, reloading config...")
+			newConfig, err := serverConfig.ReloadFromFile()
+			if err == nil {
+				err = applyConfigOverrides(newConfig, overrides...)
+			}
+			if err == nil {
+				err = server.ApplyConfig(newConfig)
+			}
+			if err != nil {
+				log.Errorf("Could not reload config: %v\n", err)
+			}
+		}
 	}()
 
 	running := false
@@ -0,0 +1,504 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/openprivacy/log"
+	"go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// BackupVersion is the version of the archives written by Server.Backup. Archives of a later version can't be restored
+const BackupVersion = 1
+
+const (
+	// backupMagic starts every backup archive, followed by its version, the salt of its key and its contents (a tar
+	// archive) encrypted by a backupWriter
+	backupMagic        = "CWTCHBACKUP"
+	backupSaltSize     = 128
+	backupManifestFile = "manifest.json"
+	// maxBackupManifestSize is the largest manifest read from a backup archive
+	maxBackupManifestSize = 1 << 20
+)
+
+// ErrServerRunning is returned when a server's files can't be changed because the server is running
+var ErrServerRunning = errors.New("server is running")
+
+// BackupManifest describes the contents of a backup archive
+type BackupManifest struct {
+	Version int       `json:"version"`
+	Onion   string    `json:"onion"`
+	Created time.Time `json:"created"`
+	// Files are the hex encoded sha256 sums of the archived files by name
+	Files map[string]string `json:"files"`
+}
+
+// isBackupFile returns true for the names of files that are part of a server's state
+func isBackupFile(name string) bool {
+	switch name {
+	case ServerConfigFile, storage.SaltFile, storage.VersionFile, messageStoreFile:
+		return true
+	}
+	_, isTokenDB := tokenDBEpoch(name)
+	return isTokenDB
+}
+
+// copyFile copies src to dst, returning false if src doesn't exist
+func copyFile(src string, dst string) (bool, error) {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// hashFile returns the hex encoded sha256 sum of file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// backupFiles copies the stored config and, if it is encrypted, its SALT and VERSION files to dir
+func (config *Config) backupFiles(dir string) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	for name, file := range map[string]string{ServerConfigFile: config.FilePath, storage.SaltFile: storage.SaltFile, storage.VersionFile: storage.VersionFile} {
+		if _, err := copyFile(path.Join(config.ConfigDir, file), path.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup copies the spent token databases of the current and previous epochs to dir. Tokens can't be spent while
+// they are copied, and every spend is committed to its database before it returns, so the copies are consistent
+func (te *tokenEpochs) backup(dir string) error {
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	epochs := []int{te.current.epoch}
+	if te.previous != nil {
+		epochs = append(epochs, te.previous.epoch)
+	}
+	for _, epoch := range epochs {
+		if _, err := copyFile(path.Join(te.configDir, tokenDBFile(epoch)), path.Join(dir, tokenDBFile(epoch))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup writes an archive of the server's config, messages and spent tokens to w, encrypted with a key derived from
+// password. It can be taken while the server is running: messages are snapshotted before spent tokens, so a restored
+// server never accepts a token again for a message it has stored. A server with an encrypted config must be backed up
+// with the config's password, which decrypts the backed up config when it is restored.
+func (s *server) Backup(w io.Writer, password string) error {
+	if password == "" {
+		return errors.New("a backup needs a password")
+	}
+	dir, err := os.MkdirTemp("", "cwtch-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := s.snapshot(dir); err != nil {
+		return err
+	}
+	if salt, err := os.ReadFile(path.Join(dir, storage.SaltFile)); err == nil {
+		if _, err := storage.ReadEncryptedFile(dir, ServerConfigFile, storage.CreateKey(password, salt)); err != nil {
+			return errors.New("the server's config is encrypted, so it must be backed up with the config's password")
+		}
+	}
+	if err := writeBackupArchive(w, password, s.Onion(), dir); err != nil {
+		return err
+	}
+	log.Infof("Backed up server %v", s.Onion())
+	return nil
+}
+
+// snapshot copies the server's messages, spent tokens and config to dir
+func (s *server) snapshot(dir string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var err error
+	messages := path.Join(dir, messageStoreFile)
+	if s.running {
+		err = s.messageStore.Backup(s.ctx, messages)
+	} else if _, statErr := os.Stat(path.Join(s.config.ConfigDir, messageStoreFile)); statErr == nil {
+		err = storage.BackupSqliteMessageStore(context.Background(), path.Join(s.config.ConfigDir, messageStoreFile), messages)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.tokenEpochs.backup(dir); err != nil {
+		return fmt.Errorf("could not back up spent tokens: %v", err)
+	}
+	if err := s.config.backupFiles(dir); err != nil {
+		return fmt.Errorf("could not back up config: %v", err)
+	}
+	return nil
+}
+
+// writeBackupArchive writes the files in dir to w as an archive of onion encrypted with a key derived from password.
+// The files are streamed into the archive, which is encrypted as it is written
+func writeBackupArchive(w io.Writer, password string, onion string, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	manifest := BackupManifest{Version: BackupVersion, Onion: onion, Created: time.Now(), Files: make(map[string]string)}
+	for _, entry := range entries {
+		if manifest.Files[entry.Name()], err = hashFile(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	key, salt, err := storage.CreateKeySalt(password)
+	if err != nil {
+		return err
+	}
+	header := append([]byte(backupMagic), byte(BackupVersion))
+	for _, data := range [][]byte{header, salt[:]} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	bw, err := newBackupWriter(w, key)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(bw)
+	if err := tw.WriteHeader(&tar.Header{Name: backupManifestFile, Mode: 0600, Size: int64(len(manifestData)), ModTime: manifest.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writeBackupEntry(tw, path.Join(dir, entry.Name()), manifest.Created); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// writeBackupEntry streams file into the archive written by tw
+func writeBackupEntry(tw *tar.Writer, file string, modTime time.Time) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: path.Base(file), Mode: 0600, Size: info.Size(), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// readBackupArchive decrypts the archive in r with password and extracts its files to dir, checking they are
+// complete, unmodified and intact. Returns the archive's manifest and whether its config is encrypted
+func readBackupArchive(r io.Reader, password string, dir string) (BackupManifest, bool, error) {
+	var manifest BackupManifest
+	header := make([]byte, len(backupMagic)+1+backupSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(backupMagic)) {
+		return manifest, false, errors.New("not a server backup archive")
+	}
+	if version := int(header[len(backupMagic)]); version < 1 || version > BackupVersion {
+		return manifest, false, fmt.Errorf("unsupported backup version %d, expected at most %d", version, BackupVersion)
+	}
+	br, err := newBackupReader(r, storage.CreateKey(password, header[len(backupMagic)+1:]))
+	if err != nil {
+		return manifest, false, err
+	}
+
+	tr := tar.NewReader(br)
+	entry, err := tr.Next()
+	if err != nil {
+		return manifest, false, fmt.Errorf("could not read backup: %v", err)
+	} else if entry.Name != backupManifestFile {
+		return manifest, false, errors.New("backup has no manifest")
+	}
+	if err := json.NewDecoder(io.LimitReader(tr, maxBackupManifestSize)).Decode(&manifest); err != nil {
+		return manifest, false, fmt.Errorf("could not read backup manifest: %v", err)
+	}
+	extracted := make(map[string]bool)
+	for {
+		entry, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, false, fmt.Errorf("could not read backup: %v", err)
+		}
+		if !isBackupFile(entry.Name) || extracted[entry.Name] {
+			return manifest, false, fmt.Errorf("backup has an unexpected file %q", entry.Name)
+		}
+		if err := extractBackupEntry(tr, path.Join(dir, entry.Name), manifest.Files[entry.Name]); err != nil {
+			return manifest, false, err
+		}
+		extracted[entry.Name] = true
+	}
+	// the archive is only complete once its last chunk has been read
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return manifest, false, fmt.Errorf("could not read backup: %v", err)
+	}
+	for name := range manifest.Files {
+		if !extracted[name] {
+			return manifest, false, fmt.Errorf("backup is missing %v", name)
+		}
+	}
+
+	if extracted[messageStoreFile] {
+		if err := storage.CheckSqliteMessageStore(path.Join(dir, messageStoreFile)); err != nil {
+			return manifest, false, err
+		}
+	}
+	for name := range extracted {
+		if epoch, isTokenDB := tokenDBEpoch(name); isTokenDB {
+			if err := checkBoltFile(path.Join(dir, name)); err != nil {
+				return manifest, false, fmt.Errorf("spent tokens of token key epoch %d are corrupt: %v", epoch, err)
+			}
+		}
+	}
+	if !extracted[ServerConfigFile] {
+		return manifest, false, errors.New("backup has no config")
+	}
+	encrypted := extracted[storage.SaltFile]
+	config, err := LoadConfig(dir, ServerConfigFile, encrypted, password)
+	if err != nil {
+		return manifest, false, fmt.Errorf("could not read backed up config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		return manifest, false, fmt.Errorf("backed up config is invalid: %v", err)
+	}
+	if config.Onion() != manifest.Onion {
+		return manifest, false, fmt.Errorf("backed up config is of %v, not %v", config.Onion(), manifest.Onion)
+	}
+	return manifest, encrypted, nil
+}
+
+// extractBackupEntry streams the current file of tr to file, checking its sha256 sum is the hex encoded sum
+func extractBackupEntry(tr *tar.Reader, file string, sum string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), tr)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not read %v from backup: %v", path.Base(file), err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		return fmt.Errorf("%v does not match the backup manifest", path.Base(file))
+	}
+	return nil
+}
+
+// checkBoltFile checks the consistency of the bolt database in file
+func checkBoltFile(file string) error {
+	db, err := bbolt.Open(file, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bbolt.Tx) error {
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// CheckServerStopped returns ErrServerRunning if a server (in this or another process) has the spent token databases
+// in configDir open
+func CheckServerStopped(configDir string) error {
+	files, err := spentTokenFiles(configDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		db, err := bbolt.Open(file, 0600, &bbolt.Options{ReadOnly: true, Timeout: 100 * time.Millisecond})
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return ErrServerRunning
+		} else if err != nil {
+			return err
+		}
+		db.Close()
+	}
+	return nil
+}
+
+// isServerStateFile returns true for the names of files in a config dir that a restored backup replaces
+func isServerStateFile(name string) bool {
+	// a write-ahead log would be replayed into the restored message store
+	return isBackupFile(name) || name == messageStoreFile+"-wal" || name == messageStoreFile+"-shm"
+}
+
+// installBackup replaces the server state in configDir with the files extracted to dir. The state it replaces
+// (including any that isn't in the backup) is moved aside first, and put back if the backup can't be installed
+func installBackup(dir string, configDir string) (err error) {
+	if err := CheckServerStopped(configDir); err != nil {
+		return err
+	}
+	aside, err := os.MkdirTemp(configDir, ".replaced-")
+	if err != nil {
+		return err
+	}
+	var replaced, installed []string
+	defer func() {
+		if err != nil {
+			for _, name := range installed {
+				os.Remove(path.Join(configDir, name))
+			}
+			for _, name := range replaced {
+				if restoreErr := os.Rename(path.Join(aside, name), path.Join(configDir, name)); restoreErr != nil {
+					log.Errorf("could not put back %v after failing to install a backup, it has been left in %v: %v", name, aside, restoreErr)
+					return
+				}
+			}
+		}
+		os.RemoveAll(aside)
+	}()
+
+	existing, err := os.ReadDir(configDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range existing {
+		if !isServerStateFile(entry.Name()) {
+			continue
+		}
+		if err := os.Rename(path.Join(configDir, entry.Name()), path.Join(aside, entry.Name())); err != nil {
+			return err
+		}
+		replaced = append(replaced, entry.Name())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(path.Join(dir, entry.Name()), path.Join(configDir, entry.Name())); err != nil {
+			return err
+		}
+		installed = append(installed, entry.Name())
+	}
+	return nil
+}
+
+// RestoreBackup replaces the server state in configDir (which is created if needed) with a backup archive written by
+// Server.Backup, after checking the archive is intact. password decrypts the archive and, if the backed up server's
+// config is encrypted, its config. It fails with ErrServerRunning if a server is running on configDir.
+func RestoreBackup(r io.Reader, password string, configDir string) (BackupManifest, error) {
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return BackupManifest{}, err
+	}
+	if err := CheckServerStopped(configDir); err != nil {
+		return BackupManifest{}, err
+	}
+	dir, err := os.MkdirTemp(configDir, ".restore-")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	defer os.RemoveAll(dir)
+	manifest, _, err := readBackupArchive(r, password, dir)
+	if err != nil {
+		return manifest, err
+	}
+	if err := installBackup(dir, configDir); err != nil {
+		return manifest, err
+	}
+	log.Infof("Restored server %v from a backup of %v", manifest.Onion, manifest.Created)
+	return manifest, nil
+}
+
+// Restore replaces the state of the stopped server with a backup archive of it written by Backup, after checking
+// the archive is intact. password decrypts the archive and, if the server's config is encrypted, the backed up config.
+// Fails with ErrServerRunning if the server is running
+func (s *server) Restore(r io.Reader, password string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running {
+		return fmt.Errorf("cannot restore %v: %w", s.Onion(), ErrServerRunning)
+	}
+	configDir := s.config.ConfigDir
+	dir, err := os.MkdirTemp(configDir, ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	manifest, encrypted, err := readBackupArchive(r, password, dir)
+	if err != nil {
+		return err
+	}
+	if manifest.Onion != s.Onion() {
+		return fmt.Errorf("backup is of %v, not %v", manifest.Onion, s.Onion())
+	}
+	if encrypted != s.config.Encrypted {
+		return fmt.Errorf("backup has an encrypted config: %v, expected %v", encrypted, s.config.Encrypted)
+	}
+
+	s.tokenEpochs.close()
+	if err := installBackup(dir, configDir); err != nil {
+		s.tokenEpochs.reopen(s.config)
+		return err
+	}
+	config, err := LoadConfig(configDir, ServerConfigFile, encrypted, password)
+	if err != nil {
+		// the backed up config was read before it was installed, so this is a problem with configDir
+		return fmt.Errorf("could not load restored config: %v", err)
+	}
+	s.config = config
+	s.tokenService = config.TokenServiceIdentity()
+	s.tokenServicePrivKey = config.TokenServerPrivateKey
+	s.tokenEpochs = newTokenEpochs(config)
+	s.tokenIssuance.update(config.GetTokenIssuance())
+	log.Infof("Restored server %v from a backup of %v", manifest.Onion, manifest.Created)
+	s.emit(EventBackupRestored, nil)
+	return nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+)
+
+const (
+	// backupChunkSize is the most archive contents encrypted in each chunk of a backup archive
+	backupChunkSize = 64 * 1024
+	// backupFinalChunk is set in the length of the last chunk of a backup archive
+	backupFinalChunk = 1 << 31
+	// backupNoncePrefixSize is the size of the random prefix of the nonce of every chunk of a backup archive
+	backupNoncePrefixSize = 15
+)
+
+// errBackupCorrupt is returned when a chunk of a backup archive can't be decrypted
+var errBackupCorrupt = errors.New("could not decrypt backup, the password is wrong or the archive is corrupt")
+
+// backupNonce returns the nonce of a chunk of a backup archive: the archive's nonce prefix followed by the chunk's
+// index (an 8 byte big endian integer) and 1 if it is the last chunk, otherwise 0. Chunks can't be reordered, dropped
+// or moved between archives without failing to decrypt, and an archive can't be truncated without its last chunk.
+func backupNonce(prefix [backupNoncePrefixSize]byte, index uint64, final bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[backupNoncePrefixSize:], index)
+	if final {
+		nonce[23] = 1
+	}
+	return &nonce
+}
+
+// backupWriter encrypts the contents of a backup archive in chunks of backupChunkSize as they are written. Each
+// chunk is written as its sealed length (a 4 byte big endian integer, with backupFinalChunk set for the last chunk)
+// followed by the chunk sealed with secretbox. The last chunk is written by Close.
+type backupWriter struct {
+	w      io.Writer
+	key    [32]byte
+	prefix [backupNoncePrefixSize]byte
+	index  uint64
+	buf    []byte
+}
+
+// newBackupWriter writes the nonce prefix of a new archive to w and returns a writer encrypting its contents with key
+func newBackupWriter(w io.Writer, key [32]byte) (*backupWriter, error) {
+	bw := &backupWriter{w: w, key: key, buf: make([]byte, 0, backupChunkSize)}
+	if _, err := io.ReadFull(rand.Reader, bw.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bw.prefix[:]); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (bw *backupWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(bw.buf) == backupChunkSize {
+			// only written once there is more, so the last chunk is never empty unless the archive is
+			if err := bw.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(bw.buf[len(bw.buf):backupChunkSize], data)
+		bw.buf = bw.buf[:len(bw.buf)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk. It doesn't close the underlying writer
+func (bw *backupWriter) Close() error {
+	return bw.writeChunk(true)
+}
+
+func (bw *backupWriter) writeChunk(final bool) error {
+	sealed := secretbox.Seal(make([]byte, 4, 4+len(bw.buf)+secretbox.Overhead), bw.buf, backupNonce(bw.prefix, bw.index, final), &bw.key)
+	length := uint32(len(sealed) - 4)
+	if final {
+		length |= backupFinalChunk
+	}
+	binary.BigEndian.PutUint32(sealed, length)
+	if _, err := bw.w.Write(sealed); err != nil {
+		return err
+	}
+	bw.index++
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// backupReader decrypts the contents of a backup archive written by a backupWriter as they are read. It returns
+// io.EOF only after the last chunk, and an error if the archive is truncated, corrupt or has data after its last chunk
+type backupReader struct {
+	r         io.Reader
+	key       [32]byte
+	prefix    [backupNoncePrefixSize]byte
+	index     uint64
+	final     bool
+	plaintext []byte
+}
+
+// newBackupReader reads the nonce prefix of an archive from r and returns a reader decrypting its contents with key
+func newBackupReader(r io.Reader, key [32]byte) (*backupReader, error) {
+	br := &backupReader{r: r, key: key}
+	if _, err := io.ReadFull(r, br.prefix[:]); err != nil {
+		return nil, errors.New("not a server backup archive")
+	}
+	return br, nil
+}
+
+func (br *backupReader) Read(p []byte) (int, error) {
+	for len(br.plaintext) == 0 {
+		if br.final {
+			return 0, io.EOF
+		}
+		if err := br.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, br.plaintext)
+	br.plaintext = br.plaintext[n:]
+	return n, nil
+}
+
+func (br *backupReader) readChunk() error {
+	var header [4]byte
+	if _, err := io.ReadFull(br.r, header[:]); err != nil {
+		return errors.New("backup archive is truncated")
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	final := length&backupFinalChunk != 0
+	length &^= backupFinalChunk
+	if length < secretbox.Overhead || length > backupChunkSize+secretbox.Overhead {
+		return errBackupCorrupt
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(br.r, sealed); err != nil {
+		return errors.New("backup archive is truncated")
+	}
+	plaintext, ok := secretbox.Open(nil, sealed, backupNonce(br.prefix, br.index, final), &br.key)
+	if !ok {
+		return errBackupCorrupt
+	}
+	if final {
+		if _, err := io.ReadFull(br.r, make([]byte, 1)); err == nil {
+			return errors.New("backup archive has data after its end")
+		}
+	}
+	br.index++
+	br.final = final
+	br.plaintext = plaintext
+	return nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+// addStoredMessages adds count messages to the message store in configDir
+func addStoredMessages(t *testing.T, configDir string, from int, count int) {
+	store, err := storage.InitializeSqliteMessageStore(path.Join(configDir, messageStoreFile), -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open message store: %v", err)
+	}
+	defer store.Close()
+	for i := from; i < from+count; i++ {
+		store.AddMessage(context.Background(), groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")})
+	}
+}
+
+// storedMessages returns the number of messages in the message store in configDir
+func storedMessages(t *testing.T, configDir string) int {
+	store, err := storage.InitializeSqliteMessageStore(path.Join(configDir, messageStoreFile), -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open message store: %v", err)
+	}
+	defer store.Close()
+	count, _ := store.MessagesCount(context.Background())
+	return count
+}
+
+func TestBackupRestore(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	addStoredMessages(t, TestDir, 0, 5)
+	writeSpentTokens(t, path.Join(TestDir, tokenDBFile(0)), 20, 20)
+	s := newServer(config, nil)
+	defer s.Destroy()
+
+	var archive bytes.Buffer
+	if err := s.Backup(&archive, ""); err == nil {
+		t.Errorf("expected a backup without a password to fail")
+	}
+	if err := s.Backup(&archive, DefaultPassword); err != nil {
+		t.Fatalf("could not back up server: %v", err)
+	}
+	addStoredMessages(t, TestDir, 5, 5)
+	s.SetAttribute(AttrDescription, "changed after the backup")
+
+	if err := s.Restore(bytes.NewReader(archive.Bytes()), "wrong password"); err == nil {
+		t.Errorf("expected restoring with the wrong password to fail")
+	}
+	corrupt := append([]byte{}, archive.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := s.Restore(bytes.NewReader(corrupt), DefaultPassword); err == nil {
+		t.Errorf("expected restoring a corrupt archive to fail")
+	}
+	s.running = true
+	if err := s.Restore(bytes.NewReader(archive.Bytes()), DefaultPassword); !errors.Is(err, ErrServerRunning) {
+		t.Errorf("expected restoring a running server to fail, got %v", err)
+	}
+	s.running = false
+	if count := storedMessages(t, TestDir); count != 10 {
+		t.Fatalf("expected refused restores to leave 10 messages, got %d", count)
+	}
+
+	if err := s.Restore(bytes.NewReader(archive.Bytes()), DefaultPassword); err != nil {
+		t.Fatalf("could not restore server: %v", err)
+	}
+	if count := storedMessages(t, TestDir); count != 5 {
+		t.Errorf("expected the 5 backed up messages to be restored, got %d", count)
+	}
+	if description := s.GetAttribute(AttrDescription); description != "" {
+		t.Errorf("expected the backed up config to be restored, got description %q", description)
+	}
+	db, err := bbolt.Open(path.Join(TestDir, tokenDBFile(0)), 0600, nil)
+	if err != nil {
+		t.Fatalf("could not open restored spent tokens: %v", err)
+	}
+	db.View(func(tx *bbolt.Tx) error {
+		if count := tx.Bucket([]byte("tokens")).Stats().KeyN; count != 20 {
+			t.Errorf("expected 20 spent tokens to be restored, got %d", count)
+		}
+		return nil
+	})
+
+	// a server in use elsewhere can't be restored over
+	otherDir := path.Join(TestDir, "other")
+	if _, err := RestoreBackup(bytes.NewReader(archive.Bytes()), DefaultPassword, otherDir); err != nil {
+		t.Fatalf("could not restore into a new directory: %v", err)
+	}
+	db.Close()
+	if restored, err := LoadConfig(otherDir, ServerConfigFile, false, ""); err != nil || restored.Onion() != s.Onion() {
+		t.Errorf("expected the restored config to be of %v: %v", s.Onion(), err)
+	}
+	inUse, _ := bbolt.Open(path.Join(otherDir, tokenDBFile(0)), 0600, nil)
+	defer inUse.Close()
+	if _, err := RestoreBackup(bytes.NewReader(archive.Bytes()), DefaultPassword, otherDir); !errors.Is(err, ErrServerRunning) {
+		t.Errorf("expected restoring over a server in use to fail, got %v", err)
+	}
+}
+
+func TestBackupStream(t *testing.T) {
+	var key [32]byte
+	contents := make([]byte, 3*backupChunkSize+100)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	var archive bytes.Buffer
+	bw, err := newBackupWriter(&archive, key)
+	if err != nil {
+		t.Fatalf("could not start archive: %v", err)
+	}
+	// written in pieces that don't line up with chunks
+	for remaining := contents; len(remaining) > 0; {
+		n := 1000
+		if n > len(remaining) {
+			n = len(remaining)
+		}
+		bw.Write(remaining[:n])
+		remaining = remaining[n:]
+	}
+	bw.Close()
+	read := func(archive []byte) ([]byte, error) {
+		br, err := newBackupReader(bytes.NewReader(archive), key)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(br)
+	}
+	if decrypted, err := read(archive.Bytes()); err != nil || !bytes.Equal(decrypted, contents) {
+		t.Fatalf("expected the archive contents to be decrypted: %v", err)
+	}
+
+	chunk := 4 + backupChunkSize + secretbox.Overhead
+	first := backupNoncePrefixSize
+	truncated := archive.Bytes()[:first+3*chunk]
+	swapped := append([]byte{}, archive.Bytes()...)
+	copy(swapped[first:], archive.Bytes()[first+chunk:first+2*chunk])
+	copy(swapped[first+chunk:], archive.Bytes()[first:first+chunk])
+	trailing := append(append([]byte{}, archive.Bytes()...), 0)
+	for name, corrupt := range map[string][]byte{"truncated": truncated, "reordered": swapped, "extended": trailing} {
+		if _, err := read(corrupt); err == nil {
+			t.Errorf("expected a %v archive to fail to decrypt", name)
+		}
+	}
+}
+
+func TestInstallBackupRollback(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	configDir, dir := path.Join(TestDir, "server"), path.Join(TestDir, "extracted")
+	for _, d := range []string{path.Join(configDir, "zz"), path.Join(dir, "zz")} {
+		os.MkdirAll(d, 0700)
+		os.WriteFile(path.Join(d, "file"), []byte{}, 0600)
+	}
+	os.WriteFile(path.Join(configDir, ServerConfigFile), []byte("installed"), 0600)
+	os.WriteFile(path.Join(configDir, tokenDBFile(1)), []byte("installed"), 0600)
+	os.WriteFile(path.Join(dir, ServerConfigFile), []byte("backed up"), 0600)
+	os.WriteFile(path.Join(dir, tokenDBFile(2)), []byte("backed up"), 0600)
+
+	// zz can't be moved over the non-empty directory in configDir
+	if err := installBackup(dir, configDir); err == nil {
+		t.Fatalf("expected installing the backup to fail")
+	}
+	entries, _ := os.ReadDir(configDir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || names[0] != ServerConfigFile || names[1] != tokenDBFile(1) || names[2] != "zz" {
+		t.Errorf("expected only the installed files to be left, got %v", names)
+	}
+	if data, _ := os.ReadFile(path.Join(configDir, ServerConfigFile)); string(data) != "installed" {
+		t.Errorf("expected the installed config to be put back, got %q", data)
+	}
+}
+
+func TestBackupEncryptedConfig(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, true, DefaultPassword, false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	s := newServer(config, nil)
+	defer s.Destroy()
+
+	var archive bytes.Buffer
+	if err := s.Backup(&archive, "not the config password"); err == nil {
+		t.Errorf("expected backing up an encrypted config with another password to fail")
+	}
+	archive.Reset()
+	if err := s.Backup(&archive, DefaultPassword); err != nil {
+		t.Fatalf("could not back up server: %v", err)
+	}
+	if err := s.Restore(&archive, DefaultPassword); err != nil {
+		t.Errorf("could not restore server: %v", err)
+	}
+}
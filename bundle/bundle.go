@@ -0,0 +1,202 @@
+package bundle
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"cwtch.im/cwtch/model"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/sha3"
+	"io"
+	"strings"
+)
+
+// A bundle is shared with the users of a server in one of these encodings:
+//   - a server bundle: "server:" followed by the base64 encoded json of the server's KeyBundle, which is signed by
+//     the server's onion key
+//   - a tofu bundle: "tofubundle:" followed by a server bundle, "||" and an invite to a group on the server, so a user
+//     can start a group on a server they trust on first use
+//   - the QR friendly encoding of either: "CWTCH:" followed by the unpadded base32 encoding of the bundle, which only
+//     uses characters of the QR alphanumeric mode so it fits in smaller codes
+const (
+	ServerPrefix = "server:"
+	TofuPrefix   = "tofubundle:"
+	QRPrefix     = "CWTCH:"
+	// MaxQRLength is the most characters a QR code can hold in alphanumeric mode
+	MaxQRLength     = 4296
+	inviteSeparator = "||"
+	// maxBundleBytes is the largest encoded bundle that will be decoded, far larger than any a server creates
+	maxBundleBytes = 64 * 1024
+)
+
+var (
+	// ErrInvalidBundle is returned when decoding a bundle that is malformed or is missing keys
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrInvalidSignature is returned when a KeyBundle isn't signed by the key of its server onion
+	ErrInvalidSignature = errors.New("key bundle is not signed by its server onion")
+	// ErrTooLarge is returned when a bundle doesn't fit in a QR code
+	ErrTooLarge = errors.New("bundle is too large for a QR code")
+)
+
+// qrEncoding is upper case base32 without padding, all characters of the QR alphanumeric mode
+var qrEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// requiredKeys are the keys a client needs to use a server
+var requiredKeys = []model.KeyType{model.KeyTypeServerOnion, model.KeyTypeTokenOnion, model.KeyTypePrivacyPass}
+
+// Bundle is a server bundle, or a tofu bundle if it has an Invite
+type Bundle struct {
+	KeyBundle *model.KeyBundle
+	// Invite is the group invite of a tofu bundle, or "" for a server bundle
+	Invite string
+}
+
+// IsTofu returns true if the bundle is a tofu bundle
+func (b *Bundle) IsTofu() bool {
+	return b.Invite != ""
+}
+
+// Onion returns the onion of the bundle's server
+func (b *Bundle) Onion() string {
+	if b.KeyBundle == nil {
+		return ""
+	}
+	return string(b.KeyBundle.Keys[model.KeyTypeServerOnion])
+}
+
+// Encode returns the bundle encoded as a server bundle or tofu bundle
+func (b *Bundle) Encode() string {
+	keyBundle := b.KeyBundle
+	if keyBundle == nil {
+		keyBundle = new(model.KeyBundle)
+	}
+	encoded := ServerPrefix + base64.StdEncoding.EncodeToString(keyBundle.Serialize())
+	if b.IsTofu() {
+		encoded = TofuPrefix + encoded + inviteSeparator + b.Invite
+	}
+	return encoded
+}
+
+// EncodeQR returns the QR friendly encoding of the bundle, or an ErrTooLarge if it doesn't fit in a QR code
+func (b *Bundle) EncodeQR() (string, error) {
+	encoded := QRPrefix + qrEncoding.EncodeToString([]byte(b.Encode()))
+	if len(encoded) > MaxQRLength {
+		return "", fmt.Errorf("%w: %d characters", ErrTooLarge, len(encoded))
+	}
+	return encoded, nil
+}
+
+// Export writes the bundle to w as a bundle file: comment lines starting with "#" describing the bundle, followed by
+// the encoded bundle on a line of its own
+func (b *Bundle) Export(w io.Writer) error {
+	kind := "server bundle"
+	if b.IsTofu() {
+		kind = "tofu bundle"
+	}
+	_, err := fmt.Fprintf(w, "# Cwtch %s of %s\n# Import into a Cwtch client to use the server\n%s\n", kind, b.Onion(), b.Encode())
+	return err
+}
+
+// Decode decodes and verifies a bundle in any of its encodings. Surrounding whitespace is ignored
+func Decode(encoded string) (*Bundle, error) {
+	encoded = strings.TrimSpace(encoded)
+	if len(encoded) > maxBundleBytes {
+		return nil, fmt.Errorf("%w: bundle of %d bytes is too large", ErrInvalidBundle, len(encoded))
+	}
+	if len(encoded) >= len(QRPrefix) && strings.EqualFold(encoded[:len(QRPrefix)], QRPrefix) {
+		data, err := qrEncoding.DecodeString(strings.ToUpper(encoded[len(QRPrefix):]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed QR encoding", ErrInvalidBundle)
+		}
+		encoded = string(data)
+	}
+
+	invite := ""
+	if strings.HasPrefix(encoded, TofuPrefix) {
+		server, tofuInvite, found := strings.Cut(strings.TrimPrefix(encoded, TofuPrefix), inviteSeparator)
+		if !found || tofuInvite == "" {
+			return nil, fmt.Errorf("%w: tofu bundle has no invite", ErrInvalidBundle)
+		}
+		encoded, invite = server, tofuInvite
+	}
+	if !strings.HasPrefix(encoded, ServerPrefix) {
+		return nil, fmt.Errorf("%w: not a server or tofu bundle", ErrInvalidBundle)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, ServerPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed key bundle encoding", ErrInvalidBundle)
+	}
+	keyBundle := new(model.KeyBundle)
+	if err := json.Unmarshal(data, keyBundle); err != nil {
+		return nil, fmt.Errorf("%w: malformed key bundle: %v", ErrInvalidBundle, err)
+	}
+	if err := Verify(keyBundle); err != nil {
+		return nil, err
+	}
+	return &Bundle{KeyBundle: keyBundle, Invite: invite}, nil
+}
+
+// Import reads and verifies a bundle file written by Export. Blank and comment lines are skipped, so a file holding
+// just an encoded bundle can also be imported
+func Import(r io.Reader) (*Bundle, error) {
+	scanner := bufio.NewScanner(io.LimitReader(r, maxBundleBytes))
+	scanner.Buffer(nil, maxBundleBytes)
+	encoded := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if encoded != "" {
+			return nil, fmt.Errorf("%w: file has more than one bundle", ErrInvalidBundle)
+		}
+		encoded = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("%w: file has no bundle", ErrInvalidBundle)
+	}
+	return Decode(encoded)
+}
+
+// Verify checks keyBundle has the keys a client needs to use its server and is signed by the key of its server onion
+func Verify(keyBundle *model.KeyBundle) error {
+	if keyBundle == nil {
+		return fmt.Errorf("%w: no key bundle", ErrInvalidBundle)
+	}
+	for _, keyType := range requiredKeys {
+		if key, ok := keyBundle.Keys[keyType]; !ok || key == "" {
+			return fmt.Errorf("%w: key bundle has no %v", ErrInvalidBundle, keyType)
+		}
+	}
+	// verified the same way a client verifies it
+	if _, err := model.DeserializeAndVerify(keyBundle.Serialize()); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// OnionPublicKey returns the ed25519 public key of a v3 onion (with or without the .onion suffix), checking its
+// version and checksum
+func OnionPublicKey(onion string) (ed25519.PublicKey, error) {
+	hostname := strings.TrimSuffix(onion, ".onion")
+	decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hostname))
+	// a v3 onion is the public key, a 2 byte checksum and the version (3)
+	if err != nil || len(hostname) != 56 || len(decoded) != ed25519.PublicKeySize+3 || decoded[len(decoded)-1] != 3 {
+		return nil, fmt.Errorf("%w: %q is not a v3 onion", ErrInvalidBundle, onion)
+	}
+	publicKey := ed25519.PublicKey(decoded[:ed25519.PublicKeySize])
+	checksum := sha3.New256()
+	checksum.Write([]byte(".onion checksum"))
+	checksum.Write(publicKey)
+	checksum.Write([]byte{3})
+	if sum := checksum.Sum(nil); sum[0] != decoded[ed25519.PublicKeySize] || sum[1] != decoded[ed25519.PublicKeySize+1] {
+		return nil, fmt.Errorf("%w: %q has an invalid checksum", ErrInvalidBundle, onion)
+	}
+	return publicKey, nil
+}
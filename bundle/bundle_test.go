@@ -0,0 +1,138 @@
+package bundle
+
+import (
+	"bytes"
+	"cwtch.im/cwtch/model"
+	"encoding/base64"
+	"errors"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives"
+	"strings"
+	"testing"
+)
+
+// signedKeyBundle returns a KeyBundle of a new server, signed by its onion key
+func signedKeyBundle() *model.KeyBundle {
+	identity, _ := primitives.InitializeEphemeralIdentity()
+	tokenIdentity, _ := primitives.InitializeEphemeralIdentity()
+	kb := model.NewKeyBundle()
+	kb.Keys[model.KeyTypeServerOnion] = model.Key(identity.Hostname())
+	kb.Keys[model.KeyTypeTokenOnion] = model.Key(tokenIdentity.Hostname())
+	kb.Keys[model.KeyTypePrivacyPass] = model.Key("privacy pass key")
+	kb.Sign(identity)
+	return kb
+}
+
+func TestEncodeDecode(t *testing.T) {
+	kb := signedKeyBundle()
+	for _, b := range []*Bundle{{KeyBundle: kb}, {KeyBundle: kb, Invite: "torv3invite"}} {
+		encoded := b.Encode()
+		qr, err := b.EncodeQR()
+		if err != nil {
+			t.Fatalf("could not encode bundle for a QR code: %v", err)
+		}
+		if strings.Trim(qr, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567:") != "" {
+			t.Errorf("expected the QR encoding to only use alphanumeric characters, got %v", qr)
+		}
+		for _, form := range []string{encoded, " " + encoded + "\n", qr, strings.ToLower(qr)} {
+			decoded, err := Decode(form)
+			if err != nil {
+				t.Fatalf("could not decode %v: %v", form, err)
+			}
+			if decoded.Onion() != b.Onion() || decoded.Invite != b.Invite || decoded.IsTofu() != b.IsTofu() {
+				t.Errorf("expected %v to decode to %+v, got %+v", form, b, decoded)
+			}
+		}
+	}
+	if encoded := (&Bundle{KeyBundle: kb, Invite: "torv3invite"}).Encode(); !strings.HasPrefix(encoded, "tofubundle:server:") || !strings.HasSuffix(encoded, "||torv3invite") {
+		t.Errorf("expected a tofu bundle, got %v", encoded)
+	}
+	if _, err := (&Bundle{KeyBundle: kb, Invite: strings.Repeat("a", MaxQRLength)}).EncodeQR(); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected a large bundle not to fit in a QR code, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if err := Verify(signedKeyBundle()); err != nil {
+		t.Fatalf("expected a signed key bundle to verify: %v", err)
+	}
+
+	tampered := signedKeyBundle()
+	tampered.Keys[model.KeyTypePrivacyPass] = model.Key("another key")
+	if err := Verify(tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a changed key bundle to fail verification, got %v", err)
+	}
+	// signed by another server
+	other := signedKeyBundle()
+	other.Keys[model.KeyTypeServerOnion] = signedKeyBundle().Keys[model.KeyTypeServerOnion]
+	if _, err := Decode((&Bundle{KeyBundle: other}).Encode()); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a key bundle signed by another onion to fail verification, got %v", err)
+	}
+	missing := signedKeyBundle()
+	delete(missing.Keys, model.KeyTypeTokenOnion)
+	if err := Verify(missing); !errors.Is(err, ErrInvalidBundle) {
+		t.Errorf("expected a key bundle without a token onion to be invalid, got %v", err)
+	}
+
+	onion := string(signedKeyBundle().Keys[model.KeyTypeServerOnion])
+	if _, err := OnionPublicKey(onion + ".onion"); err != nil {
+		t.Errorf("expected %v to be a v3 onion: %v", onion, err)
+	}
+	corrupt := []byte(onion)
+	corrupt[10] = 'a' + (corrupt[10]-'a'+1)%26
+	if _, err := OnionPublicKey(string(corrupt)); err == nil {
+		t.Errorf("expected an onion with a bad checksum to be rejected")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid := (&Bundle{KeyBundle: signedKeyBundle()}).Encode()
+	for _, encoded := range []string{
+		"",
+		"server:",
+		"server:!!!",
+		"server:" + base64.StdEncoding.EncodeToString([]byte("{")),
+		"server:" + base64.StdEncoding.EncodeToString([]byte("null")),
+		"server:" + base64.StdEncoding.EncodeToString([]byte(`{"Keys":null}`)),
+		"tofubundle:" + valid,
+		"tofubundle:" + valid + "||",
+		"CWTCH:",
+		"CWTCH:1",
+		"group:" + valid,
+		valid[:len(valid)-8],
+		strings.Repeat("a", maxBundleBytes+1),
+	} {
+		if b, err := Decode(encoded); err == nil || !(errors.Is(err, ErrInvalidBundle) || errors.Is(err, ErrInvalidSignature)) {
+			t.Errorf("expected %.40q to be invalid, got %+v %v", encoded, b, err)
+		}
+	}
+	// bundles without a key bundle encode without panicking, but aren't valid
+	empty := &Bundle{}
+	if _, err := Decode(empty.Encode()); err == nil || empty.Onion() != "" {
+		t.Errorf("expected an empty bundle to be invalid")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	b := &Bundle{KeyBundle: signedKeyBundle(), Invite: "torv3invite"}
+	var file bytes.Buffer
+	if err := b.Export(&file); err != nil {
+		t.Fatalf("could not export bundle: %v", err)
+	}
+	if !strings.Contains(file.String(), b.Onion()) {
+		t.Errorf("expected the bundle file to describe the server, got %v", file.String())
+	}
+	imported, err := Import(&file)
+	if err != nil || imported.Onion() != b.Onion() || imported.Invite != b.Invite {
+		t.Fatalf("expected to import the exported bundle, got %+v %v", imported, err)
+	}
+
+	// a file of just the bundle, as exported before bundle files had comments
+	if _, err := Import(strings.NewReader(b.Encode())); err != nil {
+		t.Errorf("could not import a bare bundle: %v", err)
+	}
+	for _, contents := range []string{"", "# comment only\n", b.Encode() + "\n" + b.Encode() + "\n"} {
+		if _, err := Import(strings.NewReader(contents)); !errors.Is(err, ErrInvalidBundle) {
+			t.Errorf("expected importing %.40q to fail, got %v", contents, err)
+		}
+	}
+}
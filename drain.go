@@ -0,0 +1,69 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// drainGroup tracks in-flight client requests so that a server can stop taking new requests and wait for
+// active ones (e.g. replays and posts) to finish before shutting down
+type drainGroup struct {
+	lock     sync.Mutex
+	draining bool
+	active   int
+	idle     chan bool
+}
+
+func newDrainGroup() *drainGroup {
+	return &drainGroup{idle: make(chan bool)}
+}
+
+// begin registers a new in-flight request, returning false if the group is draining and the request should be refused
+func (dg *drainGroup) begin() bool {
+	dg.lock.Lock()
+	defer dg.lock.Unlock()
+	if dg.draining {
+		return false
+	}
+	dg.active++
+	return true
+}
+
+// end marks an in-flight request as finished
+func (dg *drainGroup) end() {
+	dg.lock.Lock()
+	defer dg.lock.Unlock()
+	dg.active--
+	if dg.draining && dg.active == 0 {
+		close(dg.idle)
+	}
+}
+
+// isDraining returns true once drain has been called
+func (dg *drainGroup) isDraining() bool {
+	dg.lock.Lock()
+	defer dg.lock.Unlock()
+	return dg.draining
+}
+
+// drain refuses any new requests and waits up to timeout for in-flight requests to finish.
+// returns the number of requests still active when it returned
+func (dg *drainGroup) drain(timeout time.Duration) int {
+	dg.lock.Lock()
+	if !dg.draining {
+		dg.draining = true
+		if dg.active == 0 {
+			close(dg.idle)
+		}
+	}
+	dg.lock.Unlock()
+
+	select {
+	case <-dg.idle:
+	case <-time.After(timeout):
+	}
+
+	dg.lock.Lock()
+	defer dg.lock.Unlock()
+	return dg.active
+}
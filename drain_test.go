@@ -0,0 +1,82 @@
+package server
+
+import (
+	"git.openprivacy.ca/openprivacy/connectivity"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrainGroup(t *testing.T) {
+	dg := newDrainGroup()
+	if !dg.begin() {
+		t.Fatalf("expected to be able to begin a request before draining")
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		dg.end()
+	}()
+
+	if active := dg.drain(time.Second * 5); active != 0 {
+		t.Errorf("expected in-flight request to finish, %d still active", active)
+	}
+	if dg.begin() {
+		t.Errorf("expected new requests to be refused while draining")
+	}
+
+	dg = newDrainGroup()
+	dg.begin()
+	if active := dg.drain(time.Millisecond * 100); active != 1 {
+		t.Errorf("expected drain to timeout with 1 active request, got %d", active)
+	}
+}
+
+func TestStopDrainsUnlocked(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	s := newServer(config, nil)
+	defer s.Destroy()
+	if err := s.Run(connectivity.NewLocalACN()); err != nil {
+		t.Fatalf("could not run server: %v", err)
+	}
+	// an in-flight request keeps the server draining
+	s.drain.begin()
+	stopped := make(chan bool)
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	for !s.drain.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	checked := make(chan bool)
+	go func() {
+		s.CheckStatus()
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the status of a draining server to be checked without waiting for it to stop")
+	}
+	if err := s.Run(connectivity.NewLocalACN()); err == nil {
+		t.Errorf("expected a draining server not to be run")
+	}
+
+	s.drain.end()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the server to stop once the in-flight request finished")
+	}
+	if running, _ := s.CheckStatus(); running {
+		t.Errorf("expected the server to be stopped")
+	}
+}
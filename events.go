@@ -0,0 +1,175 @@
+package server
+
+import (
+	"git.openprivacy.ca/openprivacy/connectivity"
+	"git.openprivacy.ca/openprivacy/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of an Event
+type EventType string
+
+const (
+	// EventStarted is emitted when a server has started running
+	EventStarted = EventType("Started")
+	// EventStopped is emitted when a server has been stopped
+	EventStopped = EventType("Stopped")
+	// EventComponentFailed is emitted when a part of a running server has stopped unexpectedly (FieldComponent)
+	EventComponentFailed = EventType("ComponentFailed")
+	// EventMessageStored is emitted when a new message has been stored (FieldSignature)
+	EventMessageStored = EventType("MessageStored")
+	// EventPruneExecuted is emitted when the message store has pruned old messages (FieldCount)
+	EventPruneExecuted = EventType("PruneExecuted")
+	// EventTokenSpendRejected is emitted when a client tried to post with an invalid or spent token (FieldError)
+	EventTokenSpendRejected = EventType("TokenSpendRejected")
+	// EventAttributeChanged is emitted when a server attribute is changed (FieldKey, FieldValue)
+	EventAttributeChanged = EventType("AttributeChanged")
+	// EventTokenKeyRotated is emitted when the token key of a server has been rotated into a new epoch (FieldEpoch)
+	EventTokenKeyRotated = EventType("TokenKeyRotated")
+	// EventTokensPerRequestChanged is emitted when a server throttles the tokens it issues per request (FieldCount)
+	EventTokensPerRequestChanged = EventType("TokensPerRequestChanged")
+	// EventIdentityRotated is emitted when a server moves to a new onion (FieldOnion) from FieldPreviousOnion
+	EventIdentityRotated = EventType("IdentityRotated")
+	// EventPreviousIdentityExpired is emitted when the transition from a server's previous onion (FieldPreviousOnion)
+	// is over and it stops running
+	EventPreviousIdentityExpired = EventType("PreviousIdentityExpired")
+	// EventBackupRestored is emitted when a stopped server's state has been replaced from a backup archive
+	EventBackupRestored = EventType("BackupRestored")
+	// EventMirrorSynced is emitted when a mirror has replayed the messages of a peer server (FieldMirror, FieldCount)
+	// and is receiving its new messages
+	EventMirrorSynced = EventType("MirrorSynced")
+	// EventMirrorDisconnected is emitted when a mirror's connection to a peer server (FieldMirror) fails or closes
+	// (FieldError)
+	EventMirrorDisconnected = EventType("MirrorDisconnected")
+	// EventACNStatusChanged is emitted when the bootstrap status of the ACN changes (FieldProgress, FieldStatus)
+	EventACNStatusChanged = EventType("ACNStatusChanged")
+)
+
+// Event data fields
+const (
+	FieldOnion     = "Onion"
+	FieldComponent = "Component"
+	FieldError     = "Error"
+	FieldSignature = "Signature"
+	FieldCount     = "Count"
+	FieldKey       = "Key"
+	FieldValue     = "Value"
+	FieldProgress  = "Progress"
+	FieldStatus    = "Status"
+	FieldEpoch     = "Epoch"
+	// FieldPreviousOnion is the onion a server used before its identity was rotated
+	FieldPreviousOnion = "PreviousOnion"
+	// FieldMirror is the onion of a peer server being mirrored
+	FieldMirror = "Mirror"
+)
+
+// Event is a notification of something happening in a server. Data contents depend on the Type.
+// Events from a server always have a FieldOnion (ACN status events from Servers do not)
+type Event struct {
+	Type EventType
+	Data map[string]string
+}
+
+// eventEmitter publishes an event of eventType with data from a server
+type eventEmitter func(eventType EventType, data map[string]string)
+
+// eventQueueSize is how many events a subscription will buffer before new events are dropped
+const eventQueueSize = 100
+
+// Subscription receives events from an event bus
+type Subscription struct {
+	events chan Event
+	types  map[EventType]bool
+	bus    *eventBus
+	id     int
+}
+
+// Events returns the channel of events for this subscription. It is closed on Unsubscribe
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Unsubscribe stops delivery of events and closes the events channel
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.unsubscribe(sub.id)
+}
+
+// eventBus delivers events to subscriptions without blocking the publisher, and forwards them to an optional parent
+// (e.g. from a server to the Servers managing it)
+type eventBus struct {
+	lock          sync.Mutex
+	subscriptions map[int]*Subscription
+	nextID        int
+	parent        *eventBus
+}
+
+func newEventBus(parent *eventBus) *eventBus {
+	return &eventBus{subscriptions: make(map[int]*Subscription), parent: parent}
+}
+
+// subscribe returns a subscription to the given event types, or to all events if none are supplied
+func (bus *eventBus) subscribe(eventTypes ...EventType) *Subscription {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	sub := &Subscription{events: make(chan Event, eventQueueSize), types: make(map[EventType]bool), bus: bus, id: bus.nextID}
+	for _, eventType := range eventTypes {
+		sub.types[eventType] = true
+	}
+	bus.subscriptions[sub.id] = sub
+	bus.nextID++
+	return sub
+}
+
+func (bus *eventBus) unsubscribe(id int) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if sub, exists := bus.subscriptions[id]; exists {
+		delete(bus.subscriptions, id)
+		close(sub.events)
+	}
+}
+
+// publish delivers an event to every interested subscription, dropping it for any subscription that is full
+func (bus *eventBus) publish(event Event) {
+	bus.lock.Lock()
+	for _, sub := range bus.subscriptions {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Debugf("event subscription %d is full, dropping %v event", sub.id, event.Type)
+		}
+	}
+	bus.lock.Unlock()
+	if bus.parent != nil {
+		bus.parent.publish(event)
+	}
+}
+
+// acnStatusPollInterval is how often watchACN checks the ACN's bootstrap status
+const acnStatusPollInterval = time.Second
+
+// watchACN publishes an EventACNStatusChanged to bus every time the ACN's bootstrap status changes until stop is closed
+func watchACN(acn connectivity.ACN, bus *eventBus, data map[string]string, stop chan bool) {
+	lastProgress, lastStatus := -1, ""
+	for {
+		progress, status := acn.GetBootstrapStatus()
+		if progress != lastProgress || status != lastStatus {
+			lastProgress, lastStatus = progress, status
+			event := Event{Type: EventACNStatusChanged, Data: map[string]string{FieldProgress: strconv.Itoa(progress), FieldStatus: status}}
+			for key, val := range data {
+				event.Data[key] = val
+			}
+			bus.publish(event)
+		}
+		select {
+		case <-time.After(acnStatusPollInterval):
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	parent := newEventBus(nil)
+	bus := newEventBus(parent)
+
+	all := parent.subscribe()
+	stored := bus.subscribe(EventMessageStored)
+
+	bus.publish(Event{Type: EventStarted})
+	bus.publish(Event{Type: EventMessageStored, Data: map[string]string{FieldSignature: "sig"}})
+
+	select {
+	case event := <-stored.Events():
+		if event.Type != EventMessageStored || event.Data[FieldSignature] != "sig" {
+			t.Errorf("expected a message stored event, got %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected an event")
+	}
+	if len(stored.Events()) != 0 {
+		t.Errorf("expected subscription to filter out other event types")
+	}
+	if len(all.Events()) != 2 {
+		t.Errorf("expected parent to receive 2 forwarded events, got %v", len(all.Events()))
+	}
+
+	stored.Unsubscribe()
+	if _, open := <-stored.Events(); open {
+		t.Errorf("expected events channel to be closed on unsubscribe")
+	}
+
+	// a full subscription must not block publishing
+	for i := 0; i < eventQueueSize*2; i++ {
+		bus.publish(Event{Type: EventStarted})
+	}
+	all.Unsubscribe()
+}
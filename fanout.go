@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/openprivacy/log"
+	"sync"
+	"time"
+)
+
+// subscriberQueueSize is how many new messages can be queued for a subscriber before it falls behind and has to
+// catch up from the store
+const subscriberQueueSize = 256
+
+// newMessagesPageSize is the most new messages fetched from the store at once, so a bulk insert (e.g. an import) is
+// never held in memory in full
+const newMessagesPageSize = subscriberQueueSize
+
+// slowConsumerTimeout is how long a subscriber can stay behind before it is disconnected as a slow consumer
+const slowConsumerTimeout = time.Minute
+
+// fanout delivers new messages to the tokenboard connections that have finished replaying (subscribers).
+//
+// When notified that messages have been stored, the fanout fetches everything after the last message it has seen
+// from the store, a page at a time, and queues it for each subscriber. Each subscriber sends from its own queue in its own goroutine,
+// so posting never waits on a slow Tor circuit. A subscriber that falls subscriberQueueSize messages behind (a slow
+// consumer, or any subscriber after a bulk insert) stops being queued messages and instead catches up by fetching
+// everything after the last message it sent from the store, the same way it would after a replay. A subscriber that
+// is still behind slowConsumerTimeout after it first fell behind (it is stalled, or falls behind again while
+// catching up) is disconnected as a slow consumer, and its client can reconnect and replay what it missed.
+//
+// Each connection also keeps a high-water mark, the sequence number of the last message it sent its client, and
+// skips anything at or below it, so every message is delivered exactly once and in order no matter how posts,
+// replays and prunes interleave.
+type fanout struct {
+	ctx         context.Context
+	store       storage.MessageStoreInterface
+	slowFn      func()
+	slowTimeout time.Duration
+	lock        sync.Mutex
+	subscribers map[fanoutSubscriber]*subscriber
+	highWater   int64
+	wake        chan bool
+	stop        chan bool
+	stopOnce    sync.Once
+}
+
+// fanoutSubscriber receives new messages from a fanout (e.g. a TokenboardServer connection)
+type fanoutSubscriber interface {
+	// deliver sends a new message
+	deliver(message *storage.StoredMessage)
+	// catchUp sends every stored message after the last one sent. It is called when the subscriber has fallen too far
+	// behind for its messages to be queued
+	catchUp()
+	// disconnect closes the connection of a subscriber that can't keep up with new messages. It may be called while
+	// the subscriber is blocked in deliver or catchUp
+	disconnect()
+}
+
+// subscriber is a queue of new messages for a fanoutSubscriber
+type subscriber struct {
+	fs    fanoutSubscriber
+	queue chan *storage.StoredMessage
+	done  chan bool
+	// behind is signalled when the queue overflows, and lagging is true until the subscriber starts catching up.
+	// behindSince is when it first fell behind, or zero once it has caught up. Both are guarded by the fanout's lock
+	behind      chan bool
+	lagging     bool
+	behindSince time.Time
+}
+
+// newFanout starts a fanout of messages from store. slowFn (optional) is called whenever a slow consumer is
+// disconnected
+func newFanout(ctx context.Context, store storage.MessageStoreInterface, slowFn func()) *fanout {
+	f := &fanout{
+		ctx:         ctx,
+		store:       store,
+		slowFn:      slowFn,
+		slowTimeout: slowConsumerTimeout,
+		subscribers: make(map[fanoutSubscriber]*subscriber),
+		wake:        make(chan bool, 1),
+		stop:        make(chan bool),
+	}
+	highWater, err := store.LastSequence(ctx)
+	if err != nil {
+		// subscribers skip anything they have already sent, so starting from the beginning only costs a fetch
+		log.Errorf("could not read last message sequence: %v", err)
+	}
+	f.highWater = highWater
+	go f.run()
+	return f
+}
+
+// subscribe starts queuing new messages for fs, if it isn't already subscribed
+func (f *fanout) subscribe(fs fanoutSubscriber) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, exists := f.subscribers[fs]; exists {
+		return
+	}
+	sub := &subscriber{fs: fs, queue: make(chan *storage.StoredMessage, subscriberQueueSize), done: make(chan bool), behind: make(chan bool, 1)}
+	f.subscribers[fs] = sub
+	go f.runSubscriber(sub)
+}
+
+// unsubscribe stops queuing new messages for fs
+func (f *fanout) unsubscribe(fs fanoutSubscriber) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if sub, exists := f.subscribers[fs]; exists {
+		delete(f.subscribers, fs)
+		close(sub.done)
+	}
+}
+
+// notify tells the fanout that new messages have been stored. It never blocks
+func (f *fanout) notify() {
+	select {
+	case f.wake <- true:
+	default:
+		// already notified, and the fetch will include the new messages
+	}
+}
+
+// queueDepth returns the number of messages queued for the most backed up subscriber
+func (f *fanout) queueDepth() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	depth := 0
+	for _, sub := range f.subscribers {
+		if len(sub.queue) > depth {
+			depth = len(sub.queue)
+		}
+	}
+	return depth
+}
+
+// close stops the fanout and every subscriber
+func (f *fanout) close() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for fs, sub := range f.subscribers {
+		delete(f.subscribers, fs)
+		close(sub.done)
+	}
+}
+
+func (f *fanout) run() {
+	for {
+		select {
+		case <-f.wake:
+			f.deliver()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// deliver fetches any new messages, a page at a time, and queues them for every subscriber
+func (f *fanout) deliver() {
+	for {
+		messages, err := f.store.FetchMessagesAfter(f.ctx, f.highWater, newMessagesPageSize)
+		if err != nil {
+			// the messages will be fetched with the next ones
+			log.Errorf("could not fetch new messages: %v", err)
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		f.highWater = messages[len(messages)-1].Sequence
+		f.queue(messages)
+		if len(messages) < newMessagesPageSize {
+			return
+		}
+	}
+}
+
+// queue queues messages for every subscriber that isn't lagging, and disconnects slow consumers
+func (f *fanout) queue(messages []*storage.StoredMessage) {
+	now := time.Now()
+	var slow []fanoutSubscriber
+	f.lock.Lock()
+	for fs, sub := range f.subscribers {
+		if !sub.behindSince.IsZero() && now.Sub(sub.behindSince) > f.slowTimeout {
+			delete(f.subscribers, fs)
+			close(sub.done)
+			slow = append(slow, fs)
+			continue
+		}
+		if sub.lagging {
+			// it will fetch these when it catches up
+			continue
+		}
+	queue:
+		for _, message := range messages {
+			select {
+			case sub.queue <- message:
+			default:
+				sub.lagging = true
+				if sub.behindSince.IsZero() {
+					sub.behindSince = now
+				}
+				sub.behind <- true
+				break queue
+			}
+		}
+	}
+	f.lock.Unlock()
+
+	for _, fs := range slow {
+		if f.slowFn != nil {
+			f.slowFn()
+		}
+		fs.disconnect()
+	}
+}
+
+// runSubscriber sends the messages queued for sub, and catches it up from the store when it falls behind
+func (f *fanout) runSubscriber(sub *subscriber) {
+	for {
+		select {
+		case message := <-sub.queue:
+			sub.fs.deliver(message)
+		case <-sub.behind:
+			// queue messages again before catching up, so messages stored after the catch up's fetch aren't missed.
+			// Queued messages that were caught up are skipped by the subscriber's high-water mark
+			f.lock.Lock()
+			sub.lagging = false
+			f.lock.Unlock()
+			sub.fs.catchUp()
+			// it is still behind if it fell behind again while catching up
+			f.lock.Lock()
+			if !sub.lagging {
+				sub.behindSince = time.Time{}
+			}
+			f.lock.Unlock()
+		case <-sub.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sequenceStore is a message store holding messages with sequence numbers 1 to last
+type sequenceStore struct {
+	storage.MessageStoreInterface
+	lock sync.Mutex
+	last int64
+}
+
+func (ss *sequenceStore) add(count int) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.last += int64(count)
+}
+
+func (ss *sequenceStore) LastSequence(ctx context.Context) (int64, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.last, nil
+}
+
+func (ss *sequenceStore) FetchMessagesAfter(ctx context.Context, sequence int64, limit int) ([]*storage.StoredMessage, error) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	var messages []*storage.StoredMessage
+	for i := sequence + 1; i <= ss.last && (limit == 0 || len(messages) < limit); i++ {
+		messages = append(messages, &storage.StoredMessage{Sequence: i})
+	}
+	return messages, nil
+}
+
+// testSubscriber records the sequences delivered to it, optionally blocking until unblocked. Like a
+// TokenboardServer it skips anything at or below the last sequence it received, and catches up from store
+type testSubscriber struct {
+	store        storage.MessageStoreInterface
+	lock         sync.Mutex
+	sequences    []int64
+	blocked      chan bool
+	catchUps     int32
+	disconnected int32
+}
+
+func newTestSubscriber(store storage.MessageStoreInterface, blocked bool) *testSubscriber {
+	ts := &testSubscriber{store: store, blocked: make(chan bool)}
+	if !blocked {
+		close(ts.blocked)
+	}
+	return ts
+}
+
+func (ts *testSubscriber) deliver(message *storage.StoredMessage) {
+	<-ts.blocked
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.sequences) == 0 || message.Sequence > ts.sequences[len(ts.sequences)-1] {
+		ts.sequences = append(ts.sequences, message.Sequence)
+	}
+}
+
+func (ts *testSubscriber) catchUp() {
+	<-ts.blocked
+	atomic.AddInt32(&ts.catchUps, 1)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	var highWater int64
+	if len(ts.sequences) > 0 {
+		highWater = ts.sequences[len(ts.sequences)-1]
+	}
+	messages, _ := ts.store.FetchMessagesAfter(context.Background(), highWater, 0)
+	for _, message := range messages {
+		ts.sequences = append(ts.sequences, message.Sequence)
+	}
+}
+
+func (ts *testSubscriber) disconnect() {
+	atomic.AddInt32(&ts.disconnected, 1)
+}
+
+func (ts *testSubscriber) received() []int64 {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return append([]int64{}, ts.sequences...)
+}
+
+// waitForSequences waits for ts to receive every message from first to last, in order
+func (ts *testSubscriber) waitForSequences(t *testing.T, first int64, last int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for int64(len(ts.received())) < last-first+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := ts.received()
+	if int64(len(received)) != last-first+1 {
+		t.Fatalf("expected %d messages to be delivered, got %d", last-first+1, len(received))
+	}
+	for i, sequence := range received {
+		if sequence != first+int64(i) {
+			t.Fatalf("expected message %d to have sequence %d, got %d", i, first+int64(i), sequence)
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	store := &sequenceStore{last: 10}
+	var slow int32
+	f := newFanout(context.Background(), store, func() { atomic.AddInt32(&slow, 1) })
+	defer f.close()
+
+	fast, stalled := newTestSubscriber(store, false), newTestSubscriber(store, true)
+	f.subscribe(fast)
+	f.subscribe(stalled)
+
+	// messages are delivered in order, starting after those stored before the fanout started
+	for i := 0; i < 5; i++ {
+		store.add(20)
+		f.notify()
+	}
+	fast.waitForSequences(t, 11, 110)
+
+	// a stalled subscriber falls behind once its queue is full, without holding up anyone else
+	store.add(subscriberQueueSize)
+	f.notify()
+	fast.waitForSequences(t, 11, 110+subscriberQueueSize)
+	// and catches up from the store once it is unblocked, without being disconnected
+	store.add(5)
+	f.notify()
+	close(stalled.blocked)
+	stalled.waitForSequences(t, 11, 115+subscriberQueueSize)
+	fast.waitForSequences(t, 11, 115+subscriberQueueSize)
+	// queued messages that were caught up are skipped
+	deadline := time.Now().Add(5 * time.Second)
+	for f.queueDepth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := f.queueDepth(); depth != 0 {
+		t.Errorf("expected no queued messages once the stalled subscriber caught up, got %d", depth)
+	}
+	if slow := atomic.LoadInt32(&slow); slow != 0 || atomic.LoadInt32(&stalled.disconnected) != 0 {
+		t.Errorf("expected a subscriber that caught up not to be disconnected, %d slow consumers were", slow)
+	}
+}
+
+func TestFanoutSlowConsumer(t *testing.T) {
+	store := &sequenceStore{}
+	var slow int32
+	f := newFanout(context.Background(), store, func() { atomic.AddInt32(&slow, 1) })
+	defer f.close()
+	f.slowTimeout = 50 * time.Millisecond
+
+	fast, stalled := newTestSubscriber(store, false), newTestSubscriber(store, true)
+	defer close(stalled.blocked)
+	f.subscribe(fast)
+	f.subscribe(stalled)
+
+	// a subscriber that stays stalled after falling behind is disconnected once new messages arrive after the timeout
+	store.add(subscriberQueueSize + 2)
+	f.notify()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&stalled.disconnected) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		store.add(1)
+		f.notify()
+	}
+	if disconnected := atomic.LoadInt32(&stalled.disconnected); disconnected != 1 {
+		t.Fatalf("expected the stalled subscriber to be disconnected once, got %d", disconnected)
+	}
+	if slow := atomic.LoadInt32(&slow); slow != 1 {
+		t.Errorf("expected 1 slow consumer to be counted, got %d", slow)
+	}
+	f.lock.Lock()
+	_, subscribed := f.subscribers[stalled]
+	f.lock.Unlock()
+	if subscribed {
+		t.Errorf("expected a disconnected subscriber to be unsubscribed")
+	}
+
+	// everyone else keeps receiving new messages
+	store.add(5)
+	f.notify()
+	last, _ := store.LastSequence(context.Background())
+	fast.waitForSequences(t, 1, last)
+	if atomic.LoadInt32(&fast.disconnected) != 0 {
+		t.Errorf("expected a subscriber that kept up not to be disconnected")
+	}
+}
+
+func TestFanoutBulkInsert(t *testing.T) {
+	store := &sequenceStore{}
+	f := newFanout(context.Background(), store, nil)
+	defer f.close()
+	subscribers := []*testSubscriber{newTestSubscriber(store, false), newTestSubscriber(store, false)}
+	for _, ts := range subscribers {
+		f.subscribe(ts)
+	}
+
+	// more messages than fit in a queue, stored at once (e.g. by an import) and then notified once
+	store.add(3*subscriberQueueSize + 7)
+	f.notify()
+	for _, ts := range subscribers {
+		ts.waitForSequences(t, 1, 3*subscriberQueueSize+7)
+	}
+	// the subscribers keep receiving new messages
+	store.add(3)
+	f.notify()
+	for _, ts := range subscribers {
+		ts.waitForSequences(t, 1, 3*subscriberQueueSize+10)
+		if catchUps := atomic.LoadInt32(&ts.catchUps); catchUps == 0 {
+			t.Errorf("expected a subscriber to catch up after falling behind")
+		}
+	}
+}
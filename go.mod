@@ -9,6 +9,7 @@ require (
 	git.openprivacy.ca/openprivacy/log v1.0.3
 	github.com/gtank/ristretto255 v0.1.3-0.20210930101514-6bb39798585c
 	github.com/mattn/go-sqlite3 v1.14.7
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20220826181053-bd7e27e6170d
 )
 
@@ -17,7 +18,6 @@ require (
 	git.openprivacy.ca/openprivacy/bine v0.0.5 // indirect
 	github.com/gtank/merlin v0.1.1 // indirect
 	github.com/mimoo/StrobeGo v0.0.0-20220103164710-9a04d6ca976b // indirect
-	go.etcd.io/bbolt v1.3.6 // indirect
 	golang.org/x/net v0.0.0-20220826154423-83b083e8dc8b // indirect
 	golang.org/x/sys v0.0.0-20220825204002-c680a09ffe64 // indirect
 )
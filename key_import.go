@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/openprivacy/connectivity/tor"
+	"github.com/gtank/ristretto255"
+	"golang.org/x/crypto/ed25519"
+)
+
+// torSecretKeyHeader starts the hs_ed25519_secret_key files Tor keeps in its hidden service directories
+const torSecretKeyHeader = "== ed25519v1-secret: type0 =="
+
+// ImportedKeys are existing keys for a server to use instead of generated ones. Keys that are nil are left as they are
+type ImportedKeys struct {
+	// PrivateKey and TokenServerPrivateKey are the ed25519 keys of the server and token server onions
+	PrivateKey            ed25519.PrivateKey
+	TokenServerPrivateKey ed25519.PrivateKey
+	// TokenServiceK is the privacy pass token service scalar, tokens issued with it can be spent on the server
+	TokenServiceK *ristretto255.Scalar
+}
+
+// ParsePrivateKey reads an ed25519 private key (its seed followed by its public key), either raw or base64 encoded,
+// and checks the public key matches the seed. Tor's hs_ed25519_secret_key files are refused: they only hold the
+// expanded key, and tapir derives both the onion's signatures and its authentication key from the seed
+func ParsePrivateKey(raw []byte) (ed25519.PrivateKey, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if bytes.HasPrefix(trimmed, []byte(torSecretKeyHeader)) {
+		// Tor only keeps the hashed and clamped seed, which can't be turned back into the seed onion services and
+		// tapir sign with
+		return nil, errors.New("Tor hs_ed25519_secret_key files hold an expanded key without its seed, import the seed based private key the onion was created from instead")
+	}
+	key := raw
+	for _, ending := range []string{"\n", "\r\n"} {
+		// only a line ending is trimmed from a raw key, as its last bytes may themselves be whitespace
+		if len(raw) == ed25519.PrivateKeySize+len(ending) && bytes.HasSuffix(raw, []byte(ending)) {
+			key = raw[:ed25519.PrivateKeySize]
+		}
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		decoded, err := base64.StdEncoding.DecodeString(string(trimmed))
+		if err != nil {
+			return nil, fmt.Errorf("expected a %d byte ed25519 private key, raw or base64 encoded", ed25519.PrivateKeySize)
+		}
+		key = decoded
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("expected a %d byte ed25519 private key, got %d bytes", ed25519.PrivateKeySize, len(key))
+	}
+	privateKey := ed25519.NewKeyFromSeed(key[:ed25519.SeedSize])
+	if !bytes.Equal(privateKey, key) {
+		return nil, errors.New("ed25519 private key does not match its public key")
+	}
+	return privateKey, nil
+}
+
+// ParseTokenServiceK reads a base64 encoded privacy pass token service scalar, as it is stored in the config
+func ParseTokenServiceK(raw []byte) (*ristretto255.Scalar, error) {
+	k := ristretto255.NewScalar()
+	if err := k.UnmarshalText(bytes.TrimSpace(raw)); err != nil {
+		return nil, fmt.Errorf("invalid token service scalar: %v", err)
+	}
+	return k, nil
+}
+
+// ImportKeys replaces the config's keys with those set in keys, after checking they are valid and consistent with
+// each other and the rest of the config. Nothing is changed if they aren't. The config is not saved.
+func (config *Config) ImportKeys(keys ImportedKeys) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	privateKey, tokenServerPrivateKey, tokenServiceK := config.PrivateKey, config.TokenServerPrivateKey, config.TokenServiceK
+	if keys.PrivateKey != nil {
+		privateKey = keys.PrivateKey
+	}
+	if keys.TokenServerPrivateKey != nil {
+		tokenServerPrivateKey = keys.TokenServerPrivateKey
+	}
+	if keys.TokenServiceK != nil {
+		tokenServiceK = *keys.TokenServiceK
+	}
+	for name, key := range map[string]ed25519.PrivateKey{"server": privateKey, "token server": tokenServerPrivateKey} {
+		// the public key onion services use is the one derived from the seed, which must be the one the key holds
+		var seedPublicKey ed25519.PublicKey
+		if len(key) == ed25519.PrivateKeySize {
+			seedPublicKey = ed25519.NewKeyFromSeed(key.Seed()).Public().(ed25519.PublicKey)
+		}
+		if err := validateKeyPair(name, key, seedPublicKey); err != nil {
+			return err
+		}
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	tokenServerPublicKey := tokenServerPrivateKey.Public().(ed25519.PublicKey)
+	if bytes.Equal(publicKey, tokenServerPublicKey) {
+		return errors.New("the server and token server need different onions, got the same key for both")
+	}
+	if previous := config.PreviousIdentity; previous != nil {
+		for _, key := range []ed25519.PublicKey{publicKey, tokenServerPublicKey} {
+			if bytes.Equal(key, previous.PublicKey) || bytes.Equal(key, previous.TokenServerPublicKey) {
+				return fmt.Errorf("%s.onion is the server's previous identity", tor.GetTorV3Hostname(key))
+			}
+		}
+	}
+	if tokenServiceK.Equal(ristretto255.NewScalar()) == 1 {
+		return errors.New("tokenServiceK cannot be zero")
+	}
+	config.PrivateKey, config.PublicKey = privateKey, publicKey
+	config.TokenServerPrivateKey, config.TokenServerPublicKey = tokenServerPrivateKey, tokenServerPublicKey
+	config.TokenServiceK = tokenServiceK
+	return nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/base64"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives"
+	"git.openprivacy.ca/openprivacy/connectivity"
+	"golang.org/x/crypto/ed25519"
+	"os"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	_, pk := primitives.InitializeEphemeralIdentity()
+	for name, raw := range map[string][]byte{
+		"raw":                    pk,
+		"raw with a line ending": append(append([]byte{}, pk...), '\r', '\n'),
+		"base64":                 []byte(base64.StdEncoding.EncodeToString(pk) + "\n"),
+	} {
+		key, err := ParsePrivateKey(raw)
+		if err != nil || !key.Equal(pk) {
+			t.Errorf("expected a %s private key to be parsed: %v", name, err)
+		}
+	}
+	mismatched := append(append([]byte{}, pk[:32]...), make([]byte, 32)...)
+	if _, err := ParsePrivateKey(mismatched); err == nil {
+		t.Errorf("expected a private key with the wrong public key to be refused")
+	}
+	if _, err := ParsePrivateKey(pk[:32]); err == nil {
+		t.Errorf("expected a truncated private key to be refused")
+	}
+	torKey := append([]byte("\n"+torSecretKeyHeader+"\x00\x00\x00"), make([]byte, 64)...)
+	if _, err := ParsePrivateKey(torKey); err == nil {
+		t.Errorf("expected a Tor secret key file to be refused")
+	}
+}
+
+func TestImportKeys(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+
+	id, pk := primitives.InitializeEphemeralIdentity()
+	_, tpk := primitives.InitializeEphemeralIdentity()
+	k, err := ParseTokenServiceK([]byte(base64.StdEncoding.EncodeToString(make([]byte, 32))))
+	if err != nil {
+		t.Fatalf("could not parse token service scalar: %v", err)
+	}
+	config := initDefaultConfig(TestDir, ServerConfigFile, false)
+	if err := config.ImportKeys(ImportedKeys{PrivateKey: pk, TokenServiceK: k}); err == nil {
+		t.Errorf("expected a zero token service scalar to be refused")
+	}
+	if err := config.ImportKeys(ImportedKeys{PrivateKey: pk, TokenServerPrivateKey: pk}); err == nil {
+		t.Errorf("expected the same key for the server and token server to be refused")
+	}
+	mismatched := append(ed25519.PrivateKey{}, pk[:32]...)
+	mismatched = append(mismatched, tpk[32:]...)
+	if err := config.ImportKeys(ImportedKeys{PrivateKey: mismatched}); err == nil {
+		t.Errorf("expected a key whose public key doesn't match its seed to be refused")
+	}
+	if configID := config.Identity(); configID.Hostname() == id.Hostname() {
+		t.Errorf("expected keys to be left as they were when an import is refused")
+	}
+
+	if _, err := CreateConfigWithKeys(TestDir+"/refused", ServerConfigFile, false, "", false, ImportedKeys{PrivateKey: pk[:32]}); err == nil {
+		t.Errorf("expected creating a config with an invalid key to fail")
+	}
+	if _, err := os.Stat(TestDir + "/refused"); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written for an invalid key")
+	}
+
+	servers := NewServers(connectivity.NewLocalACN(), TestDir)
+	defer servers.Destroy()
+	s, err := servers.CreateServerWithKeys(DefaultPassword, ImportedKeys{PrivateKey: pk, TokenServerPrivateKey: tpk})
+	if err != nil {
+		t.Fatalf("could not create server with imported keys: %v", err)
+	}
+	if s.Onion() != id.Hostname()+".onion" {
+		t.Errorf("expected the server to use the imported onion %v, got %v", id.Hostname(), s.Onion())
+	}
+	if _, err := servers.CreateServerWithKeys(DefaultPassword, ImportedKeys{PrivateKey: pk}); err == nil {
+		t.Errorf("expected importing the key of an existing server to fail")
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"cwtch.im/cwtch/protocol/groups"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that allows up to limit units per interval (with bursts up to limit). A limit of 0 or
+// less is unlimited. Units can be taken while the bucket is not empty, which allows a single large request (e.g. a
+// big replay) to go through and put the bucket into debt rather than never being allowed.
+type rateLimiter struct {
+	lock     sync.Mutex
+	limit    int
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, interval: interval, tokens: float64(limit), last: time.Now()}
+}
+
+func (rl *rateLimiter) refill() {
+	now := time.Now()
+	rl.tokens += float64(rl.limit) * float64(now.Sub(rl.last)) / float64(rl.interval)
+	if rl.tokens > float64(rl.limit) {
+		rl.tokens = float64(rl.limit)
+	}
+	rl.last = now
+}
+
+// setLimit changes the limit of the bucket, keeping what is in it (up to the new limit) so that a change doesn't let a
+// burst of requests through. A bucket that was unlimited starts full
+func (rl *rateLimiter) setLimit(limit int) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.limit <= 0 {
+		rl.tokens = float64(limit)
+	} else {
+		rl.refill()
+	}
+	rl.limit = limit
+	rl.last = time.Now()
+	if rl.tokens > float64(limit) {
+		rl.tokens = float64(limit)
+	}
+}
+
+// allow returns true if the bucket is not empty, without taking anything from it
+func (rl *rateLimiter) allow() bool {
+	return takeAll(rateTake{rl, 0})
+}
+
+// take removes n units from the bucket if it is not empty and returns true, otherwise it returns false
+func (rl *rateLimiter) take(n int) bool {
+	return takeAll(rateTake{rl, n})
+}
+
+// rateTake is a number of units to take from a rateLimiter, 0 to only check that it is not empty
+type rateTake struct {
+	limiter *rateLimiter
+	n       int
+}
+
+// takeAll takes from every limiter if none of them are empty and returns true, otherwise it takes nothing and returns
+// false. The limiters are held locked together so concurrent requests can't overdraw them, and are locked in the order
+// given: callers list per connection limiters before the global ones
+func takeAll(takes ...rateTake) bool {
+	for _, take := range takes {
+		if take.limiter != nil {
+			take.limiter.lock.Lock()
+			defer take.limiter.lock.Unlock()
+		}
+	}
+	for _, take := range takes {
+		if rl := take.limiter; rl != nil && rl.limit > 0 {
+			rl.refill()
+			if rl.tokens < 1 {
+				return false
+			}
+		}
+	}
+	for _, take := range takes {
+		if rl := take.limiter; rl != nil && rl.limit > 0 {
+			rl.tokens -= float64(take.n)
+		}
+	}
+	return true
+}
+
+// tokenboardLimits holds the RateLimits and MessageLimits of a server and the global limiters shared by all of its
+// connections
+type tokenboardLimits struct {
+	lock          sync.Mutex
+	config        RateLimits
+	messageLimits MessageLimits
+	globalReplays *rateLimiter
+	globalPosts   *rateLimiter
+	limitedFn     func()
+	rejectedFn    func()
+}
+
+// newTokenboardLimits creates the limits for a server. limitedFn (optional) is called every time a request is rate
+// limited and rejectedFn (optional) every time a posted message fails checkMessage
+func newTokenboardLimits(config RateLimits, messageLimits MessageLimits, limitedFn func(), rejectedFn func()) *tokenboardLimits {
+	limits := &tokenboardLimits{limitedFn: limitedFn, rejectedFn: rejectedFn}
+	limits.update(config, messageLimits)
+	return limits
+}
+
+// update replaces the limits, existing connections keep their current per connection rate limits. The global limiters
+// keep what they have used, only their rates change
+func (tl *tokenboardLimits) update(config RateLimits, messageLimits MessageLimits) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if tl.globalReplays == nil {
+		tl.globalReplays = newRateLimiter(config.GlobalReplaysPerMinute, time.Minute)
+		tl.globalPosts = newRateLimiter(config.GlobalPostsPerMinute, time.Minute)
+	} else {
+		if config.GlobalReplaysPerMinute != tl.config.GlobalReplaysPerMinute {
+			tl.globalReplays.setLimit(config.GlobalReplaysPerMinute)
+		}
+		if config.GlobalPostsPerMinute != tl.config.GlobalPostsPerMinute {
+			tl.globalPosts.setLimit(config.GlobalPostsPerMinute)
+		}
+	}
+	tl.config = config
+	tl.messageLimits = messageLimits
+}
+
+// connectionLimits creates a new set of per connection limiters
+func (tl *tokenboardLimits) connectionLimits() *connectionLimits {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	return &connectionLimits{
+		global:         tl,
+		replays:        newRateLimiter(tl.config.ReplaysPerMinute, time.Minute),
+		replayMessages: newRateLimiter(tl.config.ReplayMessagesPerHour, time.Hour),
+		posts:          newRateLimiter(tl.config.PostsPerMinute, time.Minute),
+	}
+}
+
+// checkMessage returns the reason a posted message is invalid or exceeds the MessageLimits, or "" if it is acceptable
+func (tl *tokenboardLimits) checkMessage(egm groups.EncryptedGroupMessage) string {
+	tl.lock.Lock()
+	limits := tl.messageLimits
+	tl.lock.Unlock()
+	reason := ""
+	switch {
+	case len(egm.Signature) == 0:
+		reason = PostRejectedMissingSignature
+	case len(egm.Ciphertext) == 0:
+		reason = PostRejectedEmptyCiphertext
+	case limits.MaxSignatureBytes > 0 && len(egm.Signature) > limits.MaxSignatureBytes:
+		reason = PostRejectedSignatureSize
+	case limits.MaxCiphertextBytes > 0 && len(egm.Ciphertext) > limits.MaxCiphertextBytes:
+		reason = PostRejectedCiphertextSize
+	}
+	if reason != "" && tl.rejectedFn != nil {
+		tl.rejectedFn()
+	}
+	return reason
+}
+
+func (tl *tokenboardLimits) limited() {
+	if tl.limitedFn != nil {
+		tl.limitedFn()
+	}
+}
+
+// connectionLimits are the limiters for a single tokenboard connection
+type connectionLimits struct {
+	global         *tokenboardLimits
+	replays        *rateLimiter
+	replayMessages *rateLimiter
+	posts          *rateLimiter
+}
+
+// allowReplay checks the replay frequency and volume limits, taking a replay if allowed
+func (cl *connectionLimits) allowReplay() bool {
+	if takeAll(rateTake{cl.replayMessages, 0}, rateTake{cl.replays, 1}, rateTake{cl.global.globalReplays, 1}) {
+		return true
+	}
+	cl.global.limited()
+	return false
+}
+
+// replayed records the volume of a replay
+func (cl *connectionLimits) replayed(messages int) {
+	cl.replayMessages.take(messages)
+}
+
+// allowPost checks the post rate limits, taking a post if allowed
+func (cl *connectionLimits) allowPost() bool {
+	if takeAll(rateTake{cl.posts, 1}, rateTake{cl.global.globalPosts, 1}) {
+		return true
+	}
+	cl.global.limited()
+	return false
+}
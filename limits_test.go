@@ -0,0 +1,152 @@
+package server
+
+import (
+	"cwtch.im/cwtch/protocol/groups"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	unlimited := newRateLimiter(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if !unlimited.take(1) {
+			t.Fatalf("unlimited rate limiter should always allow")
+		}
+	}
+
+	rl := newRateLimiter(2, time.Minute)
+	if !rl.take(1) || !rl.take(1) {
+		t.Errorf("expected burst of 2 to be allowed")
+	}
+	if rl.take(1) {
+		t.Errorf("expected 3rd take to be limited")
+	}
+
+	// a large take is allowed while the bucket is not empty, leaving it in debt
+	volume := newRateLimiter(10, time.Hour)
+	if !volume.take(50) {
+		t.Errorf("expected large take to be allowed from a full bucket")
+	}
+	if volume.allow() {
+		t.Errorf("expected bucket to be empty after large take")
+	}
+
+	refill := newRateLimiter(10, time.Millisecond*100)
+	refill.take(10)
+	time.Sleep(time.Millisecond * 50)
+	if !refill.allow() {
+		t.Errorf("expected bucket to refill over time")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	limitedCount := 0
+	limits := newTokenboardLimits(RateLimits{ReplaysPerMinute: 1, GlobalPostsPerMinute: 1}, MessageLimits{}, func() { limitedCount++ }, nil)
+	conn1 := limits.connectionLimits()
+	conn2 := limits.connectionLimits()
+
+	if !conn1.allowReplay() || conn1.allowReplay() {
+		t.Errorf("expected 1 replay per connection to be allowed")
+	}
+	if !conn2.allowReplay() {
+		t.Errorf("expected replay limits to be per connection")
+	}
+	if !conn1.allowPost() || conn2.allowPost() {
+		t.Errorf("expected 1 post across all connections to be allowed")
+	}
+	if limitedCount != 2 {
+		t.Errorf("expected 2 limited requests, got %v", limitedCount)
+	}
+}
+
+func TestUpdateLimits(t *testing.T) {
+	limits := newTokenboardLimits(RateLimits{GlobalReplaysPerMinute: 1, GlobalPostsPerMinute: 2}, MessageLimits{}, nil, nil)
+	conn := limits.connectionLimits()
+	if !conn.allowReplay() || !conn.allowPost() || !conn.allowPost() || conn.allowPost() {
+		t.Fatalf("expected the global limits to be used up")
+	}
+
+	// changing other settings, or the global rates, doesn't refill the global limiters
+	limits.update(RateLimits{GlobalReplaysPerMinute: 1, GlobalPostsPerMinute: 10}, MessageLimits{MaxCiphertextBytes: 10})
+	if conn.allowReplay() || conn.allowPost() {
+		t.Errorf("expected an update not to refill the global limits")
+	}
+	if limits.connectionLimits().allowReplay() {
+		t.Errorf("expected the global limits to apply to new connections after an update")
+	}
+
+	// lowering a rate empties a bucket down to the new limit, and removing a limit allows everything
+	rl := newRateLimiter(10, time.Minute)
+	rl.setLimit(2)
+	if !rl.take(1) || !rl.take(1) || rl.take(1) {
+		t.Errorf("expected a lowered limit to allow 2")
+	}
+	rl.setLimit(0)
+	if !rl.take(100) {
+		t.Errorf("expected a removed limit to allow everything")
+	}
+	rl.setLimit(1)
+	if !rl.take(1) || rl.take(1) {
+		t.Errorf("expected a new limit to start full")
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	rejectedCount := 0
+	limits := newTokenboardLimits(RateLimits{}, MessageLimits{MaxSignatureBytes: 4, MaxCiphertextBytes: 8}, nil, func() { rejectedCount++ })
+	tests := []struct {
+		egm    groups.EncryptedGroupMessage
+		reason string
+	}{
+		{groups.EncryptedGroupMessage{Signature: []byte("sig"), Ciphertext: []byte("hello")}, ""},
+		{groups.EncryptedGroupMessage{Ciphertext: []byte("hello")}, PostRejectedMissingSignature},
+		{groups.EncryptedGroupMessage{Signature: []byte("sig")}, PostRejectedEmptyCiphertext},
+		{groups.EncryptedGroupMessage{Signature: []byte("signature"), Ciphertext: []byte("hello")}, PostRejectedSignatureSize},
+		{groups.EncryptedGroupMessage{Signature: []byte("sig"), Ciphertext: []byte("hello world")}, PostRejectedCiphertextSize},
+	}
+	for _, test := range tests {
+		if reason := limits.checkMessage(test.egm); reason != test.reason {
+			t.Errorf("expected %v to be rejected with %q, got %q", test.egm, test.reason, reason)
+		}
+	}
+	if rejectedCount != 4 {
+		t.Errorf("expected 4 rejected messages, got %v", rejectedCount)
+	}
+}
+
+func TestConcurrentPostLimits(t *testing.T) {
+	limits := newTokenboardLimits(RateLimits{PostsPerMinute: 1, GlobalPostsPerMinute: 10}, MessageLimits{}, nil, nil)
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 50; i++ {
+		conn := limits.connectionLimits()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2; j++ {
+				if conn.allowPost() {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Errorf("expected concurrent posts not to overdraw the global limit of 10, got %d", allowed)
+	}
+
+	// a post limited by the connection isn't taken from the global limit, and the reverse
+	limits = newTokenboardLimits(RateLimits{PostsPerMinute: 1, GlobalPostsPerMinute: 2}, MessageLimits{}, nil, nil)
+	conn1, conn2, conn3 := limits.connectionLimits(), limits.connectionLimits(), limits.connectionLimits()
+	if !conn1.allowPost() || conn1.allowPost() {
+		t.Fatalf("expected the connection limit to allow 1 post")
+	}
+	if !conn2.allowPost() {
+		t.Errorf("expected a post limited by the connection not to be taken from the global limit")
+	}
+	if conn3.allowPost() || conn3.posts.tokens != 1 {
+		t.Errorf("expected a post limited globally not to be taken from the connection limit, it has %v left", conn3.posts.tokens)
+	}
+}
@@ -54,6 +54,66 @@ func (c *counter) GetStarttime() time.Time {
 	return c.startTime
 }
 
+// rateBucket is the count of events in one minute of a rateCounter's window
+type rateBucket struct {
+	minute int64
+	count  int
+}
+
+type rateCounter struct {
+	window  time.Duration
+	buckets []rateBucket
+	now     func() time.Time
+	lock    sync.Mutex
+}
+
+// RateCounter provides a threadsafe count of events over a sliding window (e.g. tokens issued in the last hour)
+type RateCounter interface {
+	Add(unit int)
+	Count() int
+}
+
+// NewRateCounter initializes a RateCounter counting events within the last window (to the nearest minute)
+func NewRateCounter(window time.Duration) RateCounter {
+	return &rateCounter{window: window, now: time.Now}
+}
+
+// Add adds a count of unit events now
+func (rc *rateCounter) Add(unit int) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	minute := rc.expire()
+	if last := len(rc.buckets) - 1; last >= 0 && rc.buckets[last].minute == minute {
+		rc.buckets[last].count += unit
+		return
+	}
+	rc.buckets = append(rc.buckets, rateBucket{minute: minute, count: unit})
+}
+
+// Count returns the count of events within the window
+func (rc *rateCounter) Count() int {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.expire()
+	count := 0
+	for _, bucket := range rc.buckets {
+		count += bucket.count
+	}
+	return count
+}
+
+// expire drops buckets that have left the window and returns the current minute. lock must be held
+func (rc *rateCounter) expire() int64 {
+	minute := rc.now().Unix() / 60
+	oldest := minute - int64(rc.window/time.Minute) + 1
+	expired := 0
+	for expired < len(rc.buckets) && rc.buckets[expired].minute < oldest {
+		expired++
+	}
+	rc.buckets = rc.buckets[expired:]
+	return minute
+}
+
 // MonitorType controls how the monitor will report itself
 type MonitorType int
 
@@ -35,3 +35,25 @@ func TestCounter(t *testing.T) {
 		t.Errorf("counter's starttime was innaccurate %v", counterStart.Sub(starttime))
 	}
 }
+
+func TestRateCounter(t *testing.T) {
+	now := time.Now()
+	rc := NewRateCounter(time.Hour).(*rateCounter)
+	rc.now = func() time.Time { return now }
+
+	rc.Add(10)
+	now = now.Add(30 * time.Minute)
+	rc.Add(5)
+	rc.Add(5)
+	if count := rc.Count(); count != 20 {
+		t.Errorf("expected 20 events in the last hour, got %d", count)
+	}
+	now = now.Add(45 * time.Minute)
+	if count := rc.Count(); count != 10 {
+		t.Errorf("expected events older than an hour to be dropped leaving 10, got %d", count)
+	}
+	now = now.Add(time.Hour)
+	if count := rc.Count(); count != 0 {
+		t.Errorf("expected no events in the last hour, got %d", count)
+	}
+}
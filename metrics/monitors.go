@@ -16,21 +16,46 @@ const (
 	reportFile = "serverMonitorReport.txt"
 )
 
-type MessageCountFn func() int
+// MessageCountFn returns the total number of stored messages, or an error if they can't be counted
+type MessageCountFn func() (int, error)
+
+// QueueDepthFn returns the number of messages queued for the most backed up subscriber
+type QueueDepthFn func() int
+
+// SizeFn returns the size of some storage in bytes
+type SizeFn func() int64
 
 // Monitors is a package of metrics for a Cwtch Server including message count, CPU, Mem, and conns
 type Monitors struct {
-	MessageCounter Counter
-	Messages       MonitorHistory
-	Memory         MonitorHistory
-	ClientConns    MonitorHistory
-	messageCountFn MessageCountFn
-	starttime      time.Time
-	breakChannel   chan bool
-	log            bool
-	configDir      string
-	running        bool
-	lock           sync.Mutex
+	MessageCounter      Counter
+	Messages            MonitorHistory
+	RateLimitCounter    Counter
+	RateLimited         MonitorHistory
+	RejectedPostCounter Counter
+	RejectedPosts       MonitorHistory
+	SlowConsumerCounter Counter
+	SlowConsumers       MonitorHistory
+	QueueDepth          MonitorHistory
+	SpentTokens         MonitorHistory
+	TokensIssuedCounter Counter
+	TokensIssued        MonitorHistory
+	PowFailedCounter    Counter
+	PowFailed           MonitorHistory
+	TokenSpendCounter   Counter
+	TokenSpends         MonitorHistory
+	DoubleSpendCounter  Counter
+	DoubleSpends        MonitorHistory
+	InvalidTokenCounter Counter
+	InvalidTokens       MonitorHistory
+	Memory              MonitorHistory
+	ClientConns         MonitorHistory
+	messageCountFn      MessageCountFn
+	starttime           time.Time
+	breakChannel        chan bool
+	log                 bool
+	configDir           string
+	running             bool
+	lock                sync.Mutex
 }
 
 func bToMb(b uint64) uint64 {
@@ -38,7 +63,7 @@ func bToMb(b uint64) uint64 {
 }
 
 // Start initializes a Monitors's monitors
-func (mp *Monitors) Start(ts tapir.Service, mcfn MessageCountFn, configDir string, doLogging bool) {
+func (mp *Monitors) Start(ts tapir.Service, mcfn MessageCountFn, qdfn QueueDepthFn, stfn SizeFn, configDir string, doLogging bool) {
 	mp.log = doLogging
 	mp.configDir = configDir
 	mp.starttime = time.Now()
@@ -52,6 +77,66 @@ func (mp *Monitors) Start(ts tapir.Service, mcfn MessageCountFn, configDir strin
 		return
 	})
 
+	mp.RateLimitCounter = NewCounter()
+	mp.RateLimited = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.RateLimitCounter.Count())
+		mp.RateLimitCounter.Reset()
+		return
+	})
+
+	mp.RejectedPostCounter = NewCounter()
+	mp.RejectedPosts = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.RejectedPostCounter.Count())
+		mp.RejectedPostCounter.Reset()
+		return
+	})
+
+	mp.SlowConsumerCounter = NewCounter()
+	mp.SlowConsumers = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.SlowConsumerCounter.Count())
+		mp.SlowConsumerCounter.Reset()
+		return
+	})
+
+	mp.QueueDepth = NewMonitorHistory(Count, Average, func() float64 { return float64(qdfn()) })
+
+	mp.SpentTokens = NewMonitorHistory(MegaBytes, Average, func() float64 { return float64(stfn()) })
+
+	mp.TokensIssuedCounter = NewCounter()
+	mp.TokensIssued = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.TokensIssuedCounter.Count())
+		mp.TokensIssuedCounter.Reset()
+		return
+	})
+
+	mp.PowFailedCounter = NewCounter()
+	mp.PowFailed = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.PowFailedCounter.Count())
+		mp.PowFailedCounter.Reset()
+		return
+	})
+
+	mp.TokenSpendCounter = NewCounter()
+	mp.TokenSpends = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.TokenSpendCounter.Count())
+		mp.TokenSpendCounter.Reset()
+		return
+	})
+
+	mp.DoubleSpendCounter = NewCounter()
+	mp.DoubleSpends = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.DoubleSpendCounter.Count())
+		mp.DoubleSpendCounter.Reset()
+		return
+	})
+
+	mp.InvalidTokenCounter = NewCounter()
+	mp.InvalidTokens = NewMonitorHistory(Count, Cumulative, func() (c float64) {
+		c = float64(mp.InvalidTokenCounter.Count())
+		mp.InvalidTokenCounter.Reset()
+		return
+	})
+
 	mp.Memory = NewMonitorHistory(MegaBytes, Average, func() float64 {
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
@@ -105,11 +190,45 @@ func (mp *Monitors) report() {
 	w := bufio.NewWriter(f)
 
 	fmt.Fprintf(w, "Uptime: %v \n", FormatDuration(time.Since(mp.starttime)))
-	fmt.Fprintf(w, "Total Messages: %v \n\n", mp.messageCountFn())
+	if count, err := mp.messageCountFn(); err == nil {
+		fmt.Fprintf(w, "Total Messages: %v \n\n", count)
+	} else {
+		fmt.Fprintf(w, "Total Messages: unavailable (%v) \n\n", err)
+	}
 
 	fmt.Fprintln(w, "Messages:")
 	mp.Messages.Report(w)
 
+	fmt.Fprintln(w, "\nRate Limited Requests:")
+	mp.RateLimited.Report(w)
+
+	fmt.Fprintln(w, "\nRejected Posts:")
+	mp.RejectedPosts.Report(w)
+
+	fmt.Fprintln(w, "\nSlow Consumers Disconnected:")
+	mp.SlowConsumers.Report(w)
+
+	fmt.Fprintln(w, "\nMax Subscriber Queue Depth:")
+	mp.QueueDepth.Report(w)
+
+	fmt.Fprintln(w, "\nSpent Token Storage:")
+	mp.SpentTokens.Report(w)
+
+	fmt.Fprintln(w, "\nTokens Issued:")
+	mp.TokensIssued.Report(w)
+
+	fmt.Fprintln(w, "\nFailed Proofs of Work:")
+	mp.PowFailed.Report(w)
+
+	fmt.Fprintln(w, "\nTokens Spent:")
+	mp.TokenSpends.Report(w)
+
+	fmt.Fprintln(w, "\nDouble Spends Rejected:")
+	mp.DoubleSpends.Report(w)
+
+	fmt.Fprintln(w, "\nInvalid Tokens Rejected:")
+	mp.InvalidTokens.Report(w)
+
 	fmt.Fprintln(w, "\nClient Connections:")
 	mp.ClientConns.Report(w)
 
@@ -129,6 +248,16 @@ func (mp *Monitors) Stop() {
 			mp.breakChannel <- true
 		}
 		mp.Messages.Stop()
+		mp.RateLimited.Stop()
+		mp.RejectedPosts.Stop()
+		mp.SlowConsumers.Stop()
+		mp.QueueDepth.Stop()
+		mp.SpentTokens.Stop()
+		mp.TokensIssued.Stop()
+		mp.PowFailed.Stop()
+		mp.TokenSpends.Stop()
+		mp.DoubleSpends.Stop()
+		mp.InvalidTokens.Stop()
 		mp.Memory.Stop()
 		mp.ClientConns.Stop()
 	}
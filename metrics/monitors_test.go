@@ -15,7 +15,7 @@ func TestMonitors(t *testing.T) {
 	os.Mkdir("testLog", 0700)
 	service := new(tor2.BaseOnionService)
 	mp := Monitors{}
-	mp.Start(service, func() int { return 1 }, "testLog", true)
+	mp.Start(service, func() (int, error) { return 1, nil }, func() int { return 0 }, func() int64 { return 0 }, "testLog", true)
 	mp.MessageCounter.Add(1)
 	log.Infof("sleeping for minute to give to for monitors to trigger...")
 	// wait a minute for it to trigger
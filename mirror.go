@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"git.openprivacy.ca/cwtch.im/tapir/applications"
+	tor2 "git.openprivacy.ca/cwtch.im/tapir/networks/tor"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives"
+	"git.openprivacy.ca/openprivacy/connectivity"
+	"git.openprivacy.ca/openprivacy/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mirrorRetryInterval is how long a mirror waits to reconnect to a peer server after its connection fails,
+	// doubling with each failure to sync until mirrorMaxRetryInterval
+	mirrorRetryInterval    = 30 * time.Second
+	mirrorMaxRetryInterval = 10 * time.Minute
+)
+
+// errMirrorClosed is returned by a mirror's sync when the peer closes the connection
+var errMirrorClosed = errors.New("connection closed")
+
+// MirrorStatus describes the replication of a peer server's messages into a server's message store
+type MirrorStatus struct {
+	Onion     string
+	Connected bool
+	// Synced is true once the peer's messages have been replayed and its new messages are being received
+	Synced bool
+	// Mirrored is the number of the peer's messages stored since the server started
+	Mirrored  int
+	LastError string
+}
+
+// mirrorEnv connects mirrors to the server running them
+type mirrorEnv struct {
+	// ctx is used for storage operations and is cancelled when the server stops
+	ctx    context.Context
+	acn    connectivity.ACN
+	store  storage.MessageStoreInterface
+	limits *tokenboardLimits
+	emit   eventEmitter
+	// storedFn is called with every message of a peer that is stored
+	storedFn func(egm groups.EncryptedGroupMessage)
+	// replayLimit returns how many of a peer's newest messages are replayed on first connecting (<= 0 for all)
+	replayLimit func() int
+}
+
+// mirrors replicates the messages of peer servers into a server's message store, so the groups of a peer can fail
+// over to the server. Each mirror connects to its peer as a tokenboard client (replays don't need tokens), replays the
+// peer's messages and then stores its new messages as they arrive. On reconnecting a mirror replays from the last
+// message it received, and messages the server already has (e.g. posted to both servers) are skipped.
+type mirrors struct {
+	mirrorEnv
+	lock    sync.Mutex
+	running map[string]*mirror
+	// stopping counts the mirrors that have been stopped but may not have finished, and stopped is true once every
+	// mirror has been stopped
+	stopping sync.WaitGroup
+	stopped  bool
+}
+
+func newMirrors(env mirrorEnv) *mirrors {
+	return &mirrors{mirrorEnv: env, running: make(map[string]*mirror)}
+}
+
+// update starts mirroring the onions that aren't being mirrored and stops mirroring those that are no longer listed.
+// It doesn't wait for the mirrors it stops to finish
+func (ms *mirrors) update(onions []string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.stopped {
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, onion := range onions {
+		onion = strings.TrimSuffix(onion, ".onion")
+		wanted[onion] = true
+		if ms.running[onion] == nil {
+			log.Infof("mirroring messages of %v", onion)
+			ms.running[onion] = startMirror(ms.mirrorEnv, onion)
+		}
+	}
+	for onion, m := range ms.running {
+		if !wanted[onion] {
+			log.Infof("no longer mirroring messages of %v", onion)
+			ms.stopMirror(onion, m)
+		}
+	}
+}
+
+// stopMirror stops the mirror of onion and stops counting it as running. ms.lock must be held
+func (ms *mirrors) stopMirror(onion string, m *mirror) {
+	m.stop()
+	delete(ms.running, onion)
+	ms.stopping.Add(1)
+	go func() {
+		<-m.done
+		ms.stopping.Done()
+	}()
+}
+
+// stop stops every mirror and waits for them (including those stopped by update) to finish storing messages. No
+// mirrors are started after it is called
+func (ms *mirrors) stop() {
+	ms.lock.Lock()
+	ms.stopped = true
+	for onion, m := range ms.running {
+		ms.stopMirror(onion, m)
+	}
+	ms.lock.Unlock()
+	ms.stopping.Wait()
+}
+
+// status returns the status of each mirror, ordered by onion
+func (ms *mirrors) status() []MirrorStatus {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	statuses := make([]MirrorStatus, 0, len(ms.running))
+	for _, m := range ms.running {
+		statuses = append(statuses, m.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Onion < statuses[j].Onion })
+	return statuses
+}
+
+// mirror replicates the messages of a single peer server
+type mirror struct {
+	mirrorEnv
+	onion   string
+	service tapir.Service
+	cancel  context.CancelFunc
+	done    chan bool
+	// lastCommit is the signature of the last message received from the peer, only used by the run goroutine
+	lastCommit []byte
+
+	// lock guards conn and status
+	lock   sync.Mutex
+	conn   tapir.Connection
+	status MirrorStatus
+}
+
+// startMirror starts mirroring the messages of the server at onion
+func startMirror(env mirrorEnv, onion string) *mirror {
+	m := &mirror{mirrorEnv: env, onion: onion, service: new(tor2.BaseOnionService), done: make(chan bool), status: MirrorStatus{Onion: onion}}
+	m.ctx, m.cancel = context.WithCancel(env.ctx)
+	// the peer doesn't need to know who is mirroring it, so each mirror connects with a new identity
+	identity, privateKey := primitives.InitializeEphemeralIdentity()
+	m.service.Init(m.acn, privateKey, &identity)
+	go m.run()
+	return m
+}
+
+// stop closes the mirror's connection and shuts down its service, without waiting for it to finish (done is closed
+// when it has)
+func (m *mirror) stop() {
+	m.cancel()
+	m.lock.Lock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.lock.Unlock()
+	m.service.Shutdown()
+}
+
+func (m *mirror) getStatus() MirrorStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
+
+// run connects to the peer and syncs with it until the mirror is stopped, backing off while connections fail
+func (m *mirror) run() {
+	defer close(m.done)
+	retry := mirrorRetryInterval
+	for {
+		err := m.connect()
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.lock.Lock()
+		synced := m.status.Synced
+		m.conn = nil
+		m.status.Connected = false
+		m.status.Synced = false
+		m.status.LastError = err.Error()
+		m.lock.Unlock()
+		log.Warnf("mirror of %v disconnected: %v", m.onion, err)
+		m.emit(EventMirrorDisconnected, map[string]string{FieldMirror: m.onion, FieldError: err.Error()})
+
+		if synced {
+			retry = mirrorRetryInterval
+		}
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if !synced {
+			retry *= 2
+			if retry > mirrorMaxRetryInterval {
+				retry = mirrorMaxRetryInterval
+			}
+		}
+	}
+}
+
+// connect opens an authenticated connection to the peer and syncs with it until the connection closes
+func (m *mirror) connect() error {
+	if _, err := m.service.Connect(m.onion, new(mirrorClient)); err != nil {
+		return err
+	}
+	conn, err := m.service.WaitForCapabilityOrClose(m.onion, applications.AuthCapability)
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return errMirrorClosed
+	}
+	defer conn.Close()
+	m.lock.Lock()
+	// a mirror stopped while connecting has already closed any connection it had
+	if m.ctx.Err() != nil {
+		m.lock.Unlock()
+		return m.ctx.Err()
+	}
+	m.conn = conn
+	m.status.Connected = true
+	m.lock.Unlock()
+	return m.sync(conn)
+}
+
+// sync replays the peer's messages since the last one received (or its newest messages up to the replay limit on
+// first connecting), storing them, and then stores new messages from the peer until the connection closes or a
+// message can't be stored
+func (m *mirror) sync(conn tapir.Connection) error {
+	request := ReplayRequest{ReplayRequest: groups.ReplayRequest{LastCommit: m.lastCommit}, Compression: ReplayCompressionGzip}
+	if len(m.lastCommit) == 0 && m.replayLimit != nil {
+		if limit := m.replayLimit(); limit > 0 {
+			request.Limit = limit
+		}
+	}
+	data, _ := json.Marshal(Message{Message: groups.Message{MessageType: groups.ReplayRequestMessage}, ReplayRequest: &request})
+	if err := conn.Send(data); err != nil {
+		return err
+	}
+
+	data = conn.Expect()
+	if len(data) == 0 {
+		return errMirrorClosed
+	}
+	var response Message
+	if err := json.Unmarshal(data, &response); err != nil || response.MessageType != groups.ReplayResultMessage || response.ReplayResult == nil {
+		return errors.New("peer did not send a replay result")
+	}
+	result := response.ReplayResult
+	if result.Truncated {
+		log.Warnf("mirror of %v: the peer has pruned messages since the last one mirrored, they can't be replicated", m.onion)
+	}
+	replayed := 0
+	for replayed < result.NumMessages {
+		data := conn.Expect()
+		if len(data) == 0 {
+			return errMirrorClosed
+		}
+		var egms []*groups.EncryptedGroupMessage
+		if result.Compression == ReplayCompressionGzip {
+			frame, err := DecodeReplayFrame(data)
+			if err != nil {
+				return fmt.Errorf("malformed replay frame: %v", err)
+			}
+			egms = frame
+		} else {
+			egm := new(groups.EncryptedGroupMessage)
+			if err := json.Unmarshal(data, egm); err != nil {
+				return fmt.Errorf("malformed replayed message: %v", err)
+			}
+			egms = append(egms, egm)
+		}
+		for _, egm := range egms {
+			if err := m.storeMessage(*egm); err != nil {
+				return err
+			}
+		}
+		replayed += len(egms)
+	}
+	m.lock.Lock()
+	m.status.Synced = true
+	m.status.LastError = ""
+	m.lock.Unlock()
+	log.Infof("mirror of %v synced %d messages", m.onion, replayed)
+	m.emit(EventMirrorSynced, map[string]string{FieldMirror: m.onion, FieldCount: strconv.Itoa(replayed)})
+
+	for {
+		data := conn.Expect()
+		if len(data) == 0 {
+			return errMirrorClosed
+		}
+		var message groups.Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			return fmt.Errorf("malformed message: %v", err)
+		}
+		if message.MessageType == groups.NewMessageMessage && message.NewMessage != nil {
+			if err := m.storeMessage(message.NewMessage.EGM); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storeMessage stores a message received from the peer, skipping messages that are already stored, that the local
+// store has pruned or that exceed the server's MessageLimits. Returns an error if the message couldn't be stored
+func (m *mirror) storeMessage(egm groups.EncryptedGroupMessage) error {
+	if m.store.WasPruned(egm.Signature) {
+		log.Debugf("mirror of %v: skipping a message that has been pruned", m.onion)
+	} else if reason := m.limits.checkMessage(egm); reason != "" {
+		log.Debugf("mirror of %v: skipping a message: %v", m.onion, reason)
+	} else {
+		switch err := m.store.AddMessage(m.ctx, egm); {
+		case err == nil:
+			m.lock.Lock()
+			m.status.Mirrored++
+			m.lock.Unlock()
+			if m.storedFn != nil {
+				m.storedFn(egm)
+			}
+		case errors.Is(err, storage.ErrDuplicateMessage):
+		default:
+			return fmt.Errorf("could not store message: %v", err)
+		}
+	}
+	if len(egm.Signature) > 0 {
+		m.lastCommit = egm.Signature
+	}
+	return nil
+}
+
+// mirrorClient authenticates a mirror's connection to a peer server, which the mirror then uses as a tokenboard client
+type mirrorClient struct {
+	applications.AuthApp
+}
+
+// NewInstance creates a new mirrorClient
+func (mc *mirrorClient) NewInstance() tapir.Application {
+	return new(mirrorClient)
+}
+
+// Init authenticates the connection, closing it if authentication fails
+func (mc *mirrorClient) Init(connection tapir.Connection) {
+	mc.AuthApp.Init(connection)
+	if !connection.HasCapability(applications.AuthCapability) {
+		connection.Close()
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/json"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scriptedConnection is a connection to a peer server that sends a script of responses and then closes
+type scriptedConnection struct {
+	tapir.Connection
+	lock         sync.Mutex
+	responses    [][]byte
+	sent         [][]byte
+	closed       bool
+	capabilities map[tapir.Capability]bool
+}
+
+func (sc *scriptedConnection) SetCapability(capability tapir.Capability) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.capabilities == nil {
+		sc.capabilities = make(map[tapir.Capability]bool)
+	}
+	sc.capabilities[capability] = true
+}
+
+func (sc *scriptedConnection) HasCapability(capability tapir.Capability) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.capabilities[capability]
+}
+
+func (sc *scriptedConnection) Expect() []byte {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if len(sc.responses) == 0 {
+		return nil
+	}
+	response := sc.responses[0]
+	sc.responses = sc.responses[1:]
+	return response
+}
+
+func (sc *scriptedConnection) Send(message []byte) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.sent = append(sc.sent, message)
+	return nil
+}
+
+func (sc *scriptedConnection) Close() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.closed = true
+}
+
+// sentReplayRequest returns the replay request sent on the connection
+func (sc *scriptedConnection) sentReplayRequest(t *testing.T) ReplayRequest {
+	if len(sc.sent) != 1 {
+		t.Fatalf("expected a single replay request to be sent, got %d messages", len(sc.sent))
+	}
+	var message Message
+	if err := json.Unmarshal(sc.sent[0], &message); err != nil || message.MessageType != groups.ReplayRequestMessage || message.ReplayRequest == nil {
+		t.Fatalf("expected a replay request to be sent, got %s", sc.sent[0])
+	}
+	return *message.ReplayRequest
+}
+
+func peerMessage(i int) *groups.EncryptedGroupMessage {
+	return &groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")}
+}
+
+func replayResultResponse(numMessages int, compression string) []byte {
+	data, _ := json.Marshal(Message{Message: groups.Message{MessageType: groups.ReplayResultMessage}, ReplayResult: &ReplayResult{ReplayResult: groups.ReplayResult{NumMessages: numMessages}, Compression: compression}})
+	return data
+}
+
+func newMessageResponse(egm *groups.EncryptedGroupMessage) []byte {
+	data, _ := json.Marshal(groups.Message{MessageType: groups.NewMessageMessage, NewMessage: &groups.NewMessage{EGM: *egm}})
+	return data
+}
+
+func TestMirrorSync(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	store, err := storage.InitializeSqliteMessageStore(path.Join(TestDir, messageStoreFile), -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open message store: %v", err)
+	}
+	defer store.Close()
+	// posted to both servers
+	store.AddMessage(context.Background(), *peerMessage(0))
+
+	var lock sync.Mutex
+	var stored, synced []string
+	env := mirrorEnv{
+		ctx:    context.Background(),
+		store:  store,
+		limits: newTokenboardLimits(RateLimits{}, MessageLimits{MaxCiphertextBytes: 100}, nil, nil),
+		emit: func(eventType EventType, data map[string]string) {
+			lock.Lock()
+			defer lock.Unlock()
+			if eventType == EventMirrorSynced {
+				synced = append(synced, data[FieldCount])
+			}
+		},
+		storedFn: func(egm groups.EncryptedGroupMessage) {
+			lock.Lock()
+			defer lock.Unlock()
+			stored = append(stored, string(egm.Signature))
+		},
+		replayLimit: func() int { return 1000 },
+	}
+	m := &mirror{mirrorEnv: env, onion: "peer", status: MirrorStatus{Onion: "peer"}}
+
+	// a compressed replay of the peer's newest messages, followed by new messages
+	frames, _ := EncodeReplayFrames([]*groups.EncryptedGroupMessage{peerMessage(0), peerMessage(1), peerMessage(2)})
+	tooLarge := &groups.EncryptedGroupMessage{Signature: []byte("signature 4"), Ciphertext: bytes.Repeat([]byte{1}, 101)}
+	conn := &scriptedConnection{responses: append(append([][]byte{replayResultResponse(3, ReplayCompressionGzip)}, frames...), newMessageResponse(peerMessage(3)), newMessageResponse(tooLarge))}
+	if err := m.sync(conn); err != errMirrorClosed {
+		t.Fatalf("expected sync to run until the connection closed, got %v", err)
+	}
+	if request := conn.sentReplayRequest(t); len(request.LastCommit) != 0 || request.Limit != 1000 || request.Compression != ReplayCompressionGzip {
+		t.Errorf("expected a compressed replay of the newest 1000 messages to be requested, got %+v", request)
+	}
+	if count, _ := store.MessagesCount(context.Background()); count != 4 {
+		t.Errorf("expected 4 messages to be stored, got %d", count)
+	}
+	if strings.Join(stored, ",") != "signature 1,signature 2,signature 3" || strings.Join(synced, ",") != "3" {
+		t.Errorf("expected 3 messages to be mirrored after a sync of 3, got %v and %v", stored, synced)
+	}
+	if status := m.getStatus(); !status.Synced || status.Mirrored != 3 {
+		t.Errorf("expected a synced mirror with 3 messages, got %+v", status)
+	}
+
+	// reconnecting replays from the last message received, even if it was skipped
+	egm3, _ := json.Marshal(peerMessage(3))
+	egm5, _ := json.Marshal(peerMessage(5))
+	conn = &scriptedConnection{responses: [][]byte{replayResultResponse(2, ""), egm3, egm5}}
+	if err := m.sync(conn); err != errMirrorClosed {
+		t.Fatalf("expected sync to run until the connection closed, got %v", err)
+	}
+	if request := conn.sentReplayRequest(t); string(request.LastCommit) != "signature 4" || request.Limit != 0 {
+		t.Errorf("expected a replay from the last message received, got %+v", request)
+	}
+	if status := m.getStatus(); status.Mirrored != 4 {
+		t.Errorf("expected 4 mirrored messages, got %+v", status)
+	}
+
+	conn = &scriptedConnection{responses: [][]byte{newMessageResponse(peerMessage(6))}}
+	if err := m.sync(conn); err == nil || err == errMirrorClosed {
+		t.Errorf("expected sync to fail without a replay result, got %v", err)
+	}
+
+	// frames with a null message or no messages are malformed
+	nullFrame, _ := encodeReplayFrame([]*groups.EncryptedGroupMessage{peerMessage(7), nil})
+	emptyFrame, _ := encodeReplayFrame([]*groups.EncryptedGroupMessage{})
+	for _, frame := range [][]byte{nullFrame, emptyFrame} {
+		conn = &scriptedConnection{responses: [][]byte{replayResultResponse(2, ReplayCompressionGzip), frame, frame}}
+		if err := m.sync(conn); err == nil || err == errMirrorClosed {
+			t.Errorf("expected sync to fail on a malformed frame, got %v", err)
+		}
+	}
+	if count, _ := store.MessagesCount(context.Background()); count != 5 {
+		t.Errorf("expected no messages of a malformed frame to be stored, got %d messages", count)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	// the peers can't be reached, so the mirrors keep retrying until they are stopped
+	ms := newMirrors(mirrorEnv{ctx: context.Background(), emit: func(EventType, map[string]string) {}})
+	peerA, peerB := strings.Repeat("a", 56), strings.Repeat("b", 56)
+	ms.update([]string{peerB + ".onion", peerA})
+	if statuses := ms.status(); len(statuses) != 2 || statuses[0].Onion != peerA || statuses[1].Onion != peerB {
+		t.Fatalf("expected both peers to be mirrored, got %+v", statuses)
+	}
+	ms.update([]string{peerA})
+	if statuses := ms.status(); len(statuses) != 1 || statuses[0].Onion != peerA || statuses[0].Connected {
+		t.Errorf("expected only %v to be mirrored, got %+v", peerA, statuses)
+	}
+	ms.stop()
+	ms.update([]string{peerA})
+	if statuses := ms.status(); len(statuses) != 0 {
+		t.Errorf("expected no mirrors after stopping, got %+v", statuses)
+	}
+}
+
+func TestValidateMirrors(t *testing.T) {
+	self := strings.Repeat("s", 56)
+	if err := validateMirrors([]string{strings.Repeat("a", 56), strings.Repeat("b", 56) + ".onion"}, self); err != nil {
+		t.Errorf("expected mirrors to be valid: %v", err)
+	}
+	for _, mirrors := range [][]string{
+		{"notanonion"},
+		{strings.Repeat("A", 56)},
+		{self + ".onion"},
+		{strings.Repeat("a", 56), strings.Repeat("a", 56) + ".onion"},
+	} {
+		if err := validateMirrors(mirrors, self); err == nil {
+			t.Errorf("expected mirrors %v to be invalid", mirrors)
+		}
+	}
+}
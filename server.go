@@ -1,30 +1,38 @@
 package server
 
 import (
+	"context"
 	"crypto/ed25519"
 	"cwtch.im/cwtch/model"
+	"cwtch.im/cwtch/protocol/groups"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/bundle"
 	"git.openprivacy.ca/cwtch.im/server/metrics"
 	"git.openprivacy.ca/cwtch.im/server/storage"
 	"git.openprivacy.ca/cwtch.im/tapir"
 	"git.openprivacy.ca/cwtch.im/tapir/applications"
 	tor2 "git.openprivacy.ca/cwtch.im/tapir/networks/tor"
-	"git.openprivacy.ca/cwtch.im/tapir/persistence"
 	"git.openprivacy.ca/cwtch.im/tapir/primitives"
-	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
 	"git.openprivacy.ca/openprivacy/connectivity"
 	"git.openprivacy.ca/openprivacy/connectivity/tor"
 	"git.openprivacy.ca/openprivacy/log"
+	"io"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	// ServerConfigFile is the standard filename for a server's config to be written to in a directory
 	ServerConfigFile = "serverConfig.json"
+
+	messageStoreFile = "cwtch.messages"
 )
 
 // Server encapsulates a complete, compliant Cwtch server.
@@ -39,38 +47,87 @@ type Server interface {
 	Delete(password string) error
 	Onion() string
 	ServerBundle() string
-	TofuBundle() string
+	TofuBundle() (string, error)
 	GetAttribute(string) string
 	SetAttribute(string, string)
 	SetMonitorLogging(bool)
+	GetMaxStorageMBs() int
+	SetMaxStorageMBs(int) error
+	GetStorageUsage() (StorageUsage, error)
+	PreviewMaxStorageMBs(int) (int, error)
+	ApplyConfig(*Config) error
+	Subscribe(eventTypes ...EventType) *Subscription
+	RotateTokenKey() error
+	SetTokenIssuance(TokenIssuance) error
+	CompactSpentTokens() (SpentTokenCompaction, error)
+	RotateIdentity(transition time.Duration) (string, error)
+	EndorsementBundle() *model.KeyBundle
+	Backup(w io.Writer, password string) error
+	Restore(r io.Reader, password string) error
+	ExportMessages(w io.Writer) (int, error)
+	ImportMessages(r io.Reader) (storage.MessageImport, error)
+	MirrorStatus() []MirrorStatus
 }
 
+const (
+	// KeyTypeSuccessorOnion is the onion a server has moved to, in a KeyBundle signed by its previous identity
+	KeyTypeSuccessorOnion = model.KeyType("successor_bulletin_board_onion")
+	// KeyTypeSuccessorTokenOnion is the token service onion a server has moved to, in a KeyBundle signed by its
+	// previous identity
+	KeyTypeSuccessorTokenOnion = model.KeyType("successor_token_service_onion")
+)
+
 type server struct {
 	config              *Config
 	service             tapir.Service
-	messageStore        storage.MessageStoreInterface
+	messageStore        *checkedMessageStore
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	drain               *drainGroup
+	limits              *tokenboardLimits
+	fanout              *fanout
+	mirrors             *mirrors
 	metricsPack         metrics.Monitors
 	tokenTapirService   tapir.Service
-	tokenServer         *privacypass.TokenServer
+	tokenEpochs         *tokenEpochs
+	tokenIssuance       *tokenIssuance
+	backgroundStop      chan bool
 	tokenService        primitives.Identity
 	tokenServicePrivKey ed25519.PrivateKey
 	tokenServiceStopped bool
 	onionServiceStopped bool
 	running             bool
-	lock                sync.RWMutex
+	events              *eventBus
+	acnWatchStop        chan bool
+	acn                 connectivity.ACN
+	// stopped is closed once a Stop in progress has finished, and is nil if the server isn't stopping
+	stopped chan bool
+	// tokenKeyLock serializes rotations and expiries of the token key epochs, and guards tokenKeyRotationDeferred
+	tokenKeyLock sync.Mutex
+	// tokenKeyRotationDeferred is true while a due rotation is waiting for the previous epoch to expire
+	tokenKeyRotationDeferred bool
+	// previousService and previousTokenService run the onions of the previous identity during an identity transition
+	previousService      tapir.Service
+	previousTokenService tapir.Service
+	lock                 sync.RWMutex
 }
 
 // NewServer creates and configures a new server based on the supplied configuration
 func NewServer(serverConfig *Config) Server {
+	return newServer(serverConfig, nil)
+}
+
+// newServer creates a server that also forwards its events to parentEvents (if not nil)
+func newServer(serverConfig *Config, parentEvents *eventBus) *server {
 	server := new(server)
 	server.running = false
 	server.config = serverConfig
+	server.events = newEventBus(parentEvents)
 	server.tokenService = server.config.TokenServiceIdentity()
 	server.tokenServicePrivKey = server.config.TokenServerPrivateKey
-	bs := new(persistence.BoltPersistence)
-	bs.Open(path.Join(serverConfig.ConfigDir, "tokens.db"))
-	server.tokenServer = privacypass.NewTokenServerFromStore(&serverConfig.TokenServiceK, bs)
-	log.Infof("Y: %v", server.tokenServer.Y)
+	server.tokenEpochs = newTokenEpochs(serverConfig)
+	server.tokenIssuance = newTokenIssuance(serverConfig.GetTokenIssuance(), server.incTokensIssuedCount, server.incPowFailedCount)
+	log.Infof("Y: %v", server.tokenEpochs.currentServer().Y)
 	return server
 }
 
@@ -80,13 +137,56 @@ func (s *server) Identity() primitives.Identity {
 }
 
 // helper fn to pass to metrics
-func (s *server) getStorageTotalMessageCount() int {
+func (s *server) getStorageTotalMessageCount() (int, error) {
 	if s.messageStore != nil {
-		return s.messageStore.MessagesCount()
+		return s.messageStore.MessagesCount(s.ctx)
+	}
+	return 0, nil
+}
+
+// helper fn to pass to metrics
+func (s *server) getSubscriberQueueDepth() int {
+	if s.fanout != nil {
+		return s.fanout.queueDepth()
 	}
 	return 0
 }
 
+// helper fn to pass to the token service
+func (s *server) incTokensIssuedCount(count int) {
+	if s.metricsPack.TokensIssuedCounter != nil {
+		s.metricsPack.TokensIssuedCounter.Add(count)
+	}
+}
+
+// helper fn to pass to the token service
+func (s *server) incPowFailedCount() {
+	if s.metricsPack.PowFailedCounter != nil {
+		s.metricsPack.PowFailedCounter.Add(1)
+	}
+}
+
+// helper fn to pass to the tokenboard
+func (s *server) countTokenSpend(err error) {
+	counter := s.metricsPack.TokenSpendCounter
+	if err != nil {
+		counter = s.metricsPack.InvalidTokenCounter
+		if isDoubleSpend(err) {
+			counter = s.metricsPack.DoubleSpendCounter
+		}
+	}
+	if counter != nil {
+		counter.Add(1)
+	}
+}
+
+// helper fn to pass to the fanout
+func (s *server) incSlowConsumerCount() {
+	if s.metricsPack.SlowConsumerCounter != nil {
+		s.metricsPack.SlowConsumerCounter.Add(1)
+	}
+}
+
 // helper fn to pass to storage
 func (s *server) incMessageCount() {
 	if s.metricsPack.MessageCounter != nil {
@@ -94,10 +194,71 @@ func (s *server) incMessageCount() {
 	}
 }
 
+// helper fn to pass to the tokenboard
+func (s *server) incRateLimitedCount() {
+	if s.metricsPack.RateLimitCounter != nil {
+		s.metricsPack.RateLimitCounter.Add(1)
+	}
+}
+
+// helper fn to pass to the tokenboard
+func (s *server) incRejectedPostCount() {
+	if s.metricsPack.RejectedPostCounter != nil {
+		s.metricsPack.RejectedPostCounter.Add(1)
+	}
+}
+
+// helper fn to pass to storage
+func (s *server) messagesPruned(count int) {
+	s.emit(EventPruneExecuted, map[string]string{FieldCount: strconv.Itoa(count)})
+}
+
+// helper fn to pass to the mirrors
+func (s *server) mirroredMessage(egm groups.EncryptedGroupMessage) {
+	s.emit(EventMessageStored, map[string]string{FieldSignature: base64.StdEncoding.EncodeToString(egm.Signature)})
+	s.fanout.notify()
+}
+
+// helper fn to pass to the message store health check
+func (s *server) storageFailed(err error) {
+	log.Errorf("message store is failing: %v", err)
+	s.emit(EventComponentFailed, map[string]string{FieldComponent: "message store", FieldError: err.Error()})
+}
+
+// emit publishes an event from this server to its subscribers
+func (s *server) emit(eventType EventType, data map[string]string) {
+	event := Event{Type: eventType, Data: map[string]string{FieldOnion: s.Onion()}}
+	for key, val := range data {
+		event.Data[key] = val
+	}
+	s.events.publish(event)
+}
+
+// componentStopped records that a component's Listen has returned and emits an EventComponentFailed if the server
+// wasn't being stopped
+func (s *server) componentStopped(component string, stopped *bool) {
+	s.lock.Lock()
+	*stopped = true
+	running := s.running
+	s.lock.Unlock()
+	if running {
+		log.Errorf("server component %v has stopped", component)
+		s.emit(EventComponentFailed, map[string]string{FieldComponent: component})
+	}
+}
+
+// Subscribe returns a subscription to events from this server of the given types (or all events if none are given)
+func (s *server) Subscribe(eventTypes ...EventType) *Subscription {
+	return s.events.subscribe(eventTypes...)
+}
+
 // Run starts a server with the given privateKey
 func (s *server) Run(acn connectivity.ACN) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.stopped != nil {
+		return errors.New("cannot run a server while it is stopping")
+	}
 	if s.running {
 		return nil
 	}
@@ -108,33 +269,55 @@ func (s *server) Run(acn connectivity.ACN) error {
 	s.service = service
 	log.Infof("cwtch server running on cwtch:%s\n", s.Onion())
 
-	if s.config.ServerReporting.LogMetricsToFile {
-		s.metricsPack.Start(service, s.getStorageTotalMessageCount, s.config.ConfigDir, s.config.ServerReporting.LogMetricsToFile)
-	}
-
-	var err error
-	s.messageStore, err = storage.InitializeSqliteMessageStore(path.Join(s.config.ConfigDir, "cwtch.messages"), s.config.GetMaxMessages(), s.incMessageCount)
+	messageStore, err := storage.InitializeSqliteMessageStore(path.Join(s.config.ConfigDir, messageStoreFile), s.config.GetMaxMessages(), s.incMessageCount, s.messagesPruned)
 	if err != nil {
 		return fmt.Errorf("could not open database: %v", err)
 	}
+	s.messageStore = newCheckedMessageStore(messageStore, s.storageFailed)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.fanout = newFanout(s.ctx, s.messageStore, s.incSlowConsumerCount)
+
+	if s.config.ServerReporting.LogMetricsToFile {
+		s.metricsPack.Start(service, s.getStorageTotalMessageCount, s.getSubscriberQueueDepth, s.getSpentTokenBytes, s.config.ConfigDir, s.config.ServerReporting.LogMetricsToFile)
+	}
 
+	s.drain = newDrainGroup()
+	s.limits = newTokenboardLimits(s.config.GetRateLimits(), s.config.GetMessageLimits(), s.incRateLimitedCount, s.incRejectedPostCount)
 	s.tokenTapirService = new(tor2.BaseOnionService)
 	s.tokenTapirService.Init(acn, s.tokenServicePrivKey, &s.tokenService)
-	tokenApplication := new(applications.TokenApplication)
-	tokenApplication.TokenService = s.tokenServer
+	tokenApplication := &epochTokenApplication{epochs: s.tokenEpochs, issuance: s.tokenIssuance}
 	powTokenApp := new(applications.ApplicationChain).
-		ChainApplication(new(applications.ProofOfWorkApplication), applications.SuccessfulProofOfWorkCapability).
+		ChainApplication(&proofOfWorkApplication{issuance: s.tokenIssuance}, applications.SuccessfulProofOfWorkCapability).
 		ChainApplication(tokenApplication, applications.HasTokensCapability)
+	s.tokenServiceStopped = false
+	s.onionServiceStopped = false
 	go func() {
 		s.tokenTapirService.Listen(powTokenApp)
-		s.tokenServiceStopped = true
+		s.componentStopped("token service", &s.tokenServiceStopped)
 	}()
+	tokenboardApp := newTokenBoardServer(s.messageStore, s.tokenEpochs.currentServer(), tokenboardEnv{ctx: s.ctx, drain: s.drain, limits: s.limits, emit: s.emit, fanout: s.fanout, tokens: s.tokenEpochs, spentFn: s.countTokenSpend})
 	go func() {
-		s.service.Listen(NewTokenBoardServer(s.messageStore, s.tokenServer))
-		s.onionServiceStopped = true
+		s.service.Listen(tokenboardApp)
+		s.componentStopped("onion service", &s.onionServiceStopped)
 	}()
+	s.runPreviousIdentity(acn, tokenboardApp, powTokenApp)
+	s.acn = acn
+	s.mirrors = newMirrors(mirrorEnv{ctx: s.ctx, acn: acn, store: s.messageStore, limits: s.limits, emit: s.emit, storedFn: s.mirroredMessage, replayLimit: s.config.GetMaxMessages})
+	s.mirrors.update(s.config.GetMirrors())
+
+	s.checkTokenEpochs(time.Now())
+	s.backgroundStop = make(chan bool)
+	go s.runPeriodicChecks(s.backgroundStop)
+	go s.adaptTokenIssuance(s.backgroundStop)
+
+	// a server managed by Servers gets ACN events from it
+	if s.events.parent == nil {
+		s.acnWatchStop = make(chan bool)
+		go watchACN(acn, s.events, map[string]string{FieldOnion: s.Onion()}, s.acnWatchStop)
+	}
 
 	s.running = true
+	s.emit(EventStarted, nil)
 	return nil
 }
 
@@ -144,36 +327,79 @@ func (s *server) KeyBundle() *model.KeyBundle {
 	identity := s.config.Identity()
 	kb.Keys[model.KeyTypeServerOnion] = model.Key(identity.Hostname())
 	kb.Keys[model.KeyTypeTokenOnion] = model.Key(s.tokenService.Hostname())
-	kb.Keys[model.KeyTypePrivacyPass] = model.Key(s.tokenServer.Y.String())
+	kb.Keys[model.KeyTypePrivacyPass] = model.Key(s.tokenEpochs.currentServer().Y.String())
 	kb.Sign(identity)
 	return kb
 }
 
-// CheckStatus returns true if the server is running and/or an error if any part of the server needs to be restarted.
+// CheckStatus returns true if the server is running and/or an error if any part of the server needs to be restarted
+// or its message store is failing.
 func (s *server) CheckStatus() (bool, error) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	if s.onionServiceStopped || s.tokenServiceStopped {
 		return s.running, fmt.Errorf("one of more server components are down: onion:%v token service: %v", s.onionServiceStopped, s.tokenServiceStopped)
 	}
+	if s.running {
+		if err := s.messageStore.lastError(); err != nil {
+			return s.running, fmt.Errorf("message store is failing: %v", err)
+		}
+	}
 	return s.running, nil
 }
 
 // Stop turns off the server so it cannot receive connections and frees most resourses.
+// New requests are refused while in-flight replays and posts are given up to Config.ShutdownTimeoutSeconds to finish.
+// The server isn't locked while it drains and stops its mirrors, so its status can still be checked. A Stop called
+// while the server is already stopping waits for that Stop to finish.
 // The server is still in a reRunable state and tokenServer still has an active persistence
 func (s *server) Stop() {
+	s.lock.Lock()
+	if s.stopped != nil {
+		stopped := s.stopped
+		s.lock.Unlock()
+		<-stopped
+		return
+	}
+	if !s.running {
+		s.lock.Unlock()
+		return
+	}
 	log.Infof("Shutting down server")
+	s.stopped = make(chan bool)
+	drain, mirrors := s.drain, s.mirrors
+	s.lock.Unlock()
+
+	timeout := s.config.GetShutdownTimeout()
+	log.Infof("Waiting up to %v for in-flight requests to finish...", timeout)
+	if active := drain.drain(timeout); active > 0 {
+		log.Warnf("Shutdown timeout reached with %d requests still in-flight", active)
+	}
+	mirrors.stop()
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if s.running {
-		s.service.Shutdown()
-		s.messageStore.Close()
-		s.tokenTapirService.Shutdown()
-		log.Infof("Closing Token server Database...")
+	// abandon any storage operations of requests that didn't finish in time
+	s.cancel()
+	s.fanout.close()
+	s.service.Shutdown()
+	s.tokenTapirService.Shutdown()
+	s.stopPreviousIdentity()
+	log.Infof("Closing Message Database...")
+	if err := s.messageStore.Close(); err != nil {
+		log.Errorf("could not close message database: %v", err)
+	}
 
-		s.metricsPack.Stop()
-		s.running = false
+	s.metricsPack.Stop()
+	close(s.backgroundStop)
+	if s.acnWatchStop != nil {
+		close(s.acnWatchStop)
+		s.acnWatchStop = nil
 	}
+	s.running = false
+	close(s.stopped)
+	s.stopped = nil
+	s.emit(EventStopped, nil)
 }
 
 // Destroy frees the last of the resources the server has active (tokenServer persistence) leaving it un-re-runable and completely shutdown
@@ -181,25 +407,270 @@ func (s *server) Destroy() {
 	s.Stop()
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.tokenServer.Close()
+	log.Infof("Closing Token server Database...")
+	s.tokenEpochs.close()
+}
+
+// RotateTokenKey starts a new token key epoch with a newly generated privacy pass key. Tokens issued with the
+// previous key are accepted until the config's TokenKeyRotation.GraceHours have passed, after which they are
+// rejected and the previous epoch's spent tokens are deleted. Clients need the new KeyBundle to use new tokens.
+// The key can't be rotated again until the previous epoch's grace window is over, as rotating would expire it early.
+func (s *server) RotateTokenKey() error {
+	s.tokenKeyLock.Lock()
+	defer s.tokenKeyLock.Unlock()
+	now := time.Now()
+	epoch, _, _, previousK, previousExpires := s.config.tokenKeyEpochs()
+	if previousK != nil && now.Before(previousExpires) {
+		log.Warnf("Not rotating token key epoch %d, the grace window of epoch %d is not over until %v", epoch, epoch-1, previousExpires)
+		return fmt.Errorf("cannot rotate the token key until the grace window of the previous key is over at %v", previousExpires)
+	}
+	return s.rotateTokenKey(now)
+}
+
+// rotateTokenKey starts a new token key epoch at now. tokenKeyLock must be held
+func (s *server) rotateTokenKey(now time.Time) error {
+	epoch, k := s.config.rotateTokenKey(now)
+	s.tokenEpochs.rotate(epoch, k)
+	s.tokenKeyRotationDeferred = false
+	log.Infof("Rotated token key to epoch %d, Y: %v", epoch, s.tokenEpochs.currentServer().Y)
+	s.emit(EventTokenKeyRotated, map[string]string{FieldEpoch: strconv.Itoa(epoch)})
+	return s.config.Save()
+}
+
+// checkTokenEpochs rotates the token key if the current epoch has lasted for the rotation interval or its spent tokens
+// have reached TokenKeyRotation.MaxSpentTokenMBs, and expires the previous epoch if its grace window is over. A
+// rotation that is due while the previous epoch is still in its grace window is deferred until it is over.
+func (s *server) checkTokenEpochs(now time.Time) {
+	s.tokenKeyLock.Lock()
+	defer s.tokenKeyLock.Unlock()
+	epoch, _, rotatedAt, previousK, previousExpires := s.config.tokenKeyEpochs()
+	if previousK != nil && !now.Before(previousExpires) {
+		log.Infof("Grace window of token key epoch %d is over", epoch-1)
+		s.config.expirePreviousTokenKey()
+		s.tokenEpochs.expirePrevious(epoch - 1)
+		previousK = nil
+		if err := s.config.Save(); err != nil {
+			log.Errorf("could not save config: %v", err)
+		}
+	}
+	s.tokenEpochs.removeStale()
+	rotation := s.config.GetTokenKeyRotation()
+	reason := ""
+	if rotation.IntervalHours > 0 && !now.Before(rotatedAt.Add(time.Duration(rotation.IntervalHours)*time.Hour)) {
+		reason = "its rotation interval is over"
+	}
+	if rotation.MaxSpentTokenMBs > 0 && s.tokenEpochs.currentBytes() >= int64(rotation.MaxSpentTokenMBs)*1024*1024 {
+		reason = fmt.Sprintf("its spent tokens have reached %d MBs", rotation.MaxSpentTokenMBs)
+	}
+	if reason == "" {
+		return
+	}
+	if previousK != nil {
+		if !s.tokenKeyRotationDeferred {
+			log.Warnf("Token key epoch %d is due to be rotated as %s, deferring until the grace window of epoch %d is over at %v", epoch, reason, epoch-1, previousExpires)
+			s.tokenKeyRotationDeferred = true
+		}
+		return
+	}
+	log.Infof("Rotating token key epoch %d as %s", epoch, reason)
+	if err := s.rotateTokenKey(now); err != nil {
+		log.Errorf("could not save config: %v", err)
+	}
+}
+
+// RotateIdentity moves the server to newly generated server and token server onions, keeping its message store and
+// token keys. The previous onions keep running alongside the new ones for transition so clients can move over, and
+// the EndorsementBundle signed by the previous identity points them to the new onions. Rotating again during a
+// transition ends it. A running server is restarted on the new onions. Returns the new onion.
+func (s *server) RotateIdentity(transition time.Duration) (string, error) {
+	if transition < 0 {
+		return "", fmt.Errorf("identity transition cannot be negative, got %v", transition)
+	}
+	s.lock.RLock()
+	running, acn := s.running, s.acn
+	s.lock.RUnlock()
+	if running {
+		s.Stop()
+	}
+	previous := s.config.rotateIdentity(time.Now(), transition)
+	s.lock.Lock()
+	s.tokenService = s.config.TokenServiceIdentity()
+	s.tokenServicePrivKey = s.config.TokenServerPrivateKey
+	s.lock.Unlock()
+	log.Infof("Rotated identity from %v to %v, the previous onion runs until %v", previous.Onion(), s.Onion(), previous.Expires)
+	err := s.config.Save()
+	s.emit(EventIdentityRotated, map[string]string{FieldPreviousOnion: previous.Onion()})
+	if running {
+		if runErr := s.Run(acn); runErr != nil {
+			return s.Onion(), fmt.Errorf("could not restart server on its new identity: %v", runErr)
+		}
+	}
+	return s.Onion(), err
+}
+
+// EndorsementBundle returns the KeyBundle of the server's previous identity endorsing its current onions (as
+// KeyTypeSuccessorOnion and KeyTypeSuccessorTokenOnion), signed by the previous identity. Returns nil if the server
+// hasn't rotated its identity or the transition is over.
+func (s *server) EndorsementBundle() *model.KeyBundle {
+	previous := s.config.previousIdentity()
+	if previous == nil {
+		return nil
+	}
+	kb := model.NewKeyBundle()
+	identity := previous.Identity()
+	tokenIdentity := previous.TokenServiceIdentity()
+	kb.Keys[model.KeyTypeServerOnion] = model.Key(identity.Hostname())
+	kb.Keys[model.KeyTypeTokenOnion] = model.Key(tokenIdentity.Hostname())
+	kb.Keys[model.KeyTypePrivacyPass] = model.Key(s.tokenEpochs.currentServer().Y.String())
+	successor := s.config.Identity()
+	successorToken := s.config.TokenServiceIdentity()
+	kb.Keys[KeyTypeSuccessorOnion] = model.Key(successor.Hostname())
+	kb.Keys[KeyTypeSuccessorTokenOnion] = model.Key(successorToken.Hostname())
+	kb.Sign(identity)
+	return kb
+}
+
+// runPreviousIdentity runs the onion and token services of the previous identity (if its transition isn't over)
+// with the same applications as the current ones. s.lock must be held
+func (s *server) runPreviousIdentity(acn connectivity.ACN, tokenboardApp tapir.Application, tokenApp tapir.Application) {
+	previous := s.config.previousIdentity()
+	if previous == nil || !time.Now().Before(previous.Expires) {
+		return
+	}
+	identity := previous.Identity()
+	service := new(tor2.BaseOnionService)
+	service.Init(acn, previous.PrivateKey, &identity)
+	tokenIdentity := previous.TokenServiceIdentity()
+	tokenService := new(tor2.BaseOnionService)
+	tokenService.Init(acn, previous.TokenServerPrivateKey, &tokenIdentity)
+	s.previousService = service
+	s.previousTokenService = tokenService
+	log.Infof("cwtch server also running on its previous onion cwtch:%s until %v\n", previous.Onion(), previous.Expires)
+	go func() {
+		service.Listen(tokenboardApp)
+		log.Infof("previous onion service has stopped")
+	}()
+	go func() {
+		tokenService.Listen(tokenApp)
+		log.Infof("previous token service has stopped")
+	}()
+}
+
+// stopPreviousIdentity stops the onion and token services of the previous identity, if they are running. s.lock
+// must be held
+func (s *server) stopPreviousIdentity() {
+	if s.previousService != nil {
+		s.previousService.Shutdown()
+		s.previousTokenService.Shutdown()
+		s.previousService = nil
+		s.previousTokenService = nil
+	}
+}
+
+// checkPreviousIdentity stops the previous identity once its transition is over
+func (s *server) checkPreviousIdentity(now time.Time) {
+	previous := s.config.previousIdentity()
+	if previous == nil || now.Before(previous.Expires) {
+		return
+	}
+	log.Infof("Transition from previous onion %v is over", previous.Onion())
+	s.lock.Lock()
+	s.stopPreviousIdentity()
+	s.lock.Unlock()
+	s.config.expirePreviousIdentity()
+	if err := s.config.Save(); err != nil {
+		log.Errorf("could not save config: %v", err)
+	}
+	s.emit(EventPreviousIdentityExpired, map[string]string{FieldPreviousOnion: previous.Onion()})
+}
+
+// CompactSpentTokens deletes the spent tokens of token key epochs that are no longer accepted and compacts the
+// spent token databases of the current and previous epochs. The server must be stopped.
+func (s *server) CompactSpentTokens() (SpentTokenCompaction, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running {
+		return SpentTokenCompaction{}, errors.New("cannot compact the spent tokens of a running server")
+	}
+	s.tokenEpochs.close()
+	defer s.tokenEpochs.reopen(s.config)
+	return CompactSpentTokens(s.config)
+}
+
+// SetTokenIssuance sets and saves how a server issues tokens (see TokenIssuance), applying it to new token service
+// connections straight away
+func (s *server) SetTokenIssuance(issuance TokenIssuance) error {
+	if err := validateTokenIssuance(issuance); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.config.SetTokenIssuance(issuance)
+	s.tokenIssuance.update(issuance)
+	return s.config.Save()
+}
+
+// adaptTokenIssuance adapts the tokens issued per request to recent token issuance every
+// tokenIssuanceAdjustInterval until stop is closed
+func (s *server) adaptTokenIssuance(stop chan bool) {
+	for {
+		select {
+		case <-time.After(tokenIssuanceAdjustInterval):
+			if perRequest, changed := s.tokenIssuance.adapt(); changed {
+				log.Infof("%d tokens issued in the last hour, now issuing %d tokens per request", s.tokenIssuance.issuedLastHour(), perRequest)
+				s.emit(EventTokensPerRequestChanged, map[string]string{FieldCount: strconv.Itoa(perRequest)})
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// getSpentTokenBytes returns the size of the server's spent token databases
+func (s *server) getSpentTokenBytes() int64 {
+	return spentTokenBytes(s.config.ConfigDir)
+}
+
+// runPeriodicChecks checks the token key epochs and the previous identity every tokenEpochCheckInterval until stop
+// is closed
+func (s *server) runPeriodicChecks(stop chan bool) {
+	for {
+		select {
+		case <-time.After(tokenEpochCheckInterval):
+			s.checkTokenEpochs(time.Now())
+			s.checkPreviousIdentity(time.Now())
+		case <-stop:
+			return
+		}
+	}
 }
 
 // Statistics is an encapsulation of information about the server that an operator might want to know at a glance.
 type Statistics struct {
 	TotalMessages    int
 	TotalConnections int
+	// StorageError is set if TotalMessages couldn't be read from the message store
+	StorageError error
+	// SpentTokenBytes is the size of the spent token databases
+	SpentTokenBytes int64
+	// TokensPerRequest is the most tokens the token service currently issues for one proof of work
+	TokensPerRequest int
 }
 
 // GetStatistics is a stub method for providing some high level information about
 // the server operation to bundling applications (e.g. the UI)
 func (s *server) GetStatistics() Statistics {
 	if s.running {
+		totalMessages, err := s.messageStore.MessagesCount(s.ctx)
 		return Statistics{
-			TotalMessages:    s.messageStore.MessagesCount(),
+			TotalMessages:    totalMessages,
 			TotalConnections: s.service.Metrics().ConnectionCount,
+			StorageError:     err,
+			SpentTokenBytes:  s.getSpentTokenBytes(),
+			TokensPerRequest: s.tokenIssuance.tokensPerRequest(),
 		}
 	}
-	return Statistics{}
+	return Statistics{SpentTokenBytes: s.getSpentTokenBytes(), TokensPerRequest: s.tokenIssuance.tokensPerRequest()}
 }
 
 func (s *server) Delete(password string) error {
@@ -221,19 +692,20 @@ func (s *server) Onion() string {
 
 // ServerBundle returns a bundle of the server keys required to access it (torv3 keys are addresses)
 func (s *server) ServerBundle() string {
-	bundle := s.KeyBundle().Serialize()
-	return fmt.Sprintf("server:%s", base64.StdEncoding.EncodeToString(bundle))
+	return (&bundle.Bundle{KeyBundle: s.KeyBundle()}).Encode()
 }
 
 // TofuBundle returns a Server Bundle + a newly created group invite
-func (s *server) TofuBundle() string {
-	group, _ := model.NewGroup(tor.GetTorV3Hostname(s.config.PublicKey))
+func (s *server) TofuBundle() (string, error) {
+	group, err := model.NewGroup(tor.GetTorV3Hostname(s.config.PublicKey))
+	if err != nil {
+		return "", fmt.Errorf("could not create group: %v", err)
+	}
 	invite, err := group.Invite()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("could not create group invite: %v", err)
 	}
-	bundle := s.KeyBundle().Serialize()
-	return fmt.Sprintf("tofubundle:server:%s||%s", base64.StdEncoding.EncodeToString(bundle), invite)
+	return (&bundle.Bundle{KeyBundle: s.KeyBundle(), Invite: invite}).Encode(), nil
 }
 
 // GetAttribute gets a server attribute
@@ -244,17 +716,77 @@ func (s *server) GetAttribute(key string) string {
 // SetAttribute sets a server attribute
 func (s *server) SetAttribute(key, val string) {
 	s.config.SetAttribute(key, val)
+	s.emit(EventAttributeChanged, map[string]string{FieldKey: key, FieldValue: val})
 }
 
-// GetMessageCap gets a server's MaxStorageMBs value
+// GetMaxStorageMBs gets a server's MaxStorageMBs value
 func (s *server) GetMaxStorageMBs() int {
 	return s.config.GetMaxMessageMBs()
 }
 
-// SetMaxStorageMBs sets a server's MaxStorageMBs and sets MaxMessages for storage (which can trigger a prune)
-func (s *server) SetMaxStorageMBs(val int) {
+// SetMaxStorageMBs sets and saves a server's MaxStorageMBs (-1 for unlimited) and if running sets MaxMessages for
+// storage (which can trigger a prune)
+func (s *server) SetMaxStorageMBs(val int) error {
+	if err := validateMaxStorageMBs(val); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.config.SetMaxMessageMBs(val)
-	s.messageStore.SetMessageCap(s.config.GetMaxMessages())
+	if s.running {
+		if err := s.messageStore.SetMessageCap(s.ctx, s.config.GetMaxMessages()); err != nil {
+			return fmt.Errorf("could not apply storage cap: %v", err)
+		}
+	}
+	return s.config.Save()
+}
+
+// StorageUsage is a summary of a server's message storage against its storage cap
+type StorageUsage struct {
+	Messages      int
+	MaxMessages   int // -1 for unlimited
+	MaxStorageMBs int // -1 for unlimited
+	DatabaseBytes int64
+}
+
+// GetStorageUsage returns the server's current message storage usage against its storage cap. Message counts
+// are only available while the server is running.
+func (s *server) GetStorageUsage() (StorageUsage, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	usage := StorageUsage{MaxMessages: s.config.GetMaxMessages(), MaxStorageMBs: s.config.GetMaxMessageMBs()}
+	if s.running {
+		count, err := s.messageStore.MessagesCount(s.ctx)
+		if err != nil {
+			return usage, fmt.Errorf("could not count messages: %v", err)
+		}
+		usage.Messages = count
+	}
+	// recently written messages may only be in the write-ahead log
+	for _, file := range []string{messageStoreFile, messageStoreFile + "-wal"} {
+		if info, err := os.Stat(path.Join(s.config.ConfigDir, file)); err == nil {
+			usage.DatabaseBytes += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+// PreviewMaxStorageMBs returns how many stored messages would be pruned if MaxStorageMBs was set to val, without
+// changing anything
+func (s *server) PreviewMaxStorageMBs(val int) (int, error) {
+	if err := validateMaxStorageMBs(val); err != nil {
+		return 0, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !s.running {
+		return 0, errors.New("server is not running")
+	}
+	count, err := s.messageStore.MessagesCount(s.ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not count messages: %v", err)
+	}
+	return storage.PruneCount(count, maxMessages(val)), nil
 }
 
 // SetMonitorLogging turns on or off the monitor logging suite, and logging to a file in the server dir
@@ -262,8 +794,68 @@ func (s *server) SetMonitorLogging(do bool) {
 	s.config.ServerReporting.LogMetricsToFile = do
 	s.config.Save()
 	if do {
-		s.metricsPack.Start(s.service, s.getStorageTotalMessageCount, s.config.ConfigDir, s.config.ServerReporting.LogMetricsToFile)
+		s.metricsPack.Start(s.service, s.getStorageTotalMessageCount, s.getSubscriberQueueDepth, s.getSpentTokenBytes, s.config.ConfigDir, s.config.ServerReporting.LogMetricsToFile)
 	} else {
 		s.metricsPack.Stop()
 	}
 }
+
+// ApplyConfig updates the server with the settings from newConfig, applying them live if the server is running,
+// and saves the result. If newConfig changes settings that can't be applied without recreating the server
+// (identities and token service keys) it is rejected and nothing is changed.
+func (s *server) ApplyConfig(newConfig *Config) error {
+	if err := newConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	live, restart := s.config.diff(newConfig)
+	if len(restart) > 0 {
+		return fmt.Errorf("config not applied: %v cannot be changed on a running server, a restart is required", strings.Join(restart, ", "))
+	}
+	if len(live) == 0 {
+		log.Infof("config unchanged")
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	wasLogging := s.config.ServerReporting.LogMetricsToFile
+	s.config.update(newConfig)
+	if s.running {
+		if err := s.messageStore.SetMessageCap(s.ctx, s.config.GetMaxMessages()); err != nil {
+			log.Errorf("could not apply storage cap: %v", err)
+		}
+		s.limits.update(s.config.GetRateLimits(), s.config.GetMessageLimits())
+		s.tokenIssuance.update(s.config.GetTokenIssuance())
+		s.mirrors.update(s.config.GetMirrors())
+		if do := s.config.ServerReporting.LogMetricsToFile; do != wasLogging {
+			if do {
+				s.metricsPack.Start(s.service, s.getStorageTotalMessageCount, s.getSubscriberQueueDepth, s.getSpentTokenBytes, s.config.ConfigDir, do)
+			} else {
+				s.metricsPack.Stop()
+			}
+		}
+	}
+	for _, setting := range live {
+		if key := strings.TrimPrefix(setting, "attributes."); key != setting {
+			s.emit(EventAttributeChanged, map[string]string{FieldKey: key, FieldValue: s.config.GetAttribute(key)})
+		}
+	}
+	log.Infof("applied config changes: %v", strings.Join(live, ", "))
+	return s.config.Save()
+}
+
+// MirrorStatus returns the status of each peer server the server mirrors, ordered by onion. The mirrors of a
+// stopped server are reported as disconnected
+func (s *server) MirrorStatus() []MirrorStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.running {
+		return s.mirrors.status()
+	}
+	statuses := []MirrorStatus{}
+	for _, onion := range s.config.GetMirrors() {
+		statuses = append(statuses, MirrorStatus{Onion: strings.TrimSuffix(onion, ".onion")})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Onion < statuses[j].Onion })
+	return statuses
+}
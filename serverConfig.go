@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"git.openprivacy.ca/cwtch.im/server/storage"
 	"git.openprivacy.ca/cwtch.im/tapir/primitives"
 	"git.openprivacy.ca/openprivacy/connectivity/tor"
@@ -11,7 +14,9 @@ import (
 	"golang.org/x/crypto/ed25519"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -41,9 +46,81 @@ type Reporting struct {
 	LogMetricsToFile bool `json:"logMetricsToFile"`
 }
 
+// RateLimits configures limits on client requests to the tokenboard, a limit of 0 is unlimited
+type RateLimits struct {
+	// ReplaysPerMinute is the number of replay requests one connection can make per minute
+	ReplaysPerMinute int `json:"replaysPerMinute"`
+	// ReplayMessagesPerHour is the number of messages one connection can be sent in replays per hour
+	ReplayMessagesPerHour int `json:"replayMessagesPerHour"`
+	// PostsPerMinute is the number of messages one connection can post per minute
+	PostsPerMinute int `json:"postsPerMinute"`
+	// GlobalReplaysPerMinute is the number of replay requests the server will process per minute from all connections
+	GlobalReplaysPerMinute int `json:"globalReplaysPerMinute"`
+	// GlobalPostsPerMinute is the number of messages the server will accept per minute from all connections
+	GlobalPostsPerMinute int `json:"globalPostsPerMinute"`
+}
+
+// MessageLimits configures the sizes of messages the tokenboard will accept
+type MessageLimits struct {
+	MaxSignatureBytes  int `json:"maxSignatureBytes"`
+	MaxCiphertextBytes int `json:"maxCiphertextBytes"`
+}
+
+// TokenKeyRotation configures the rotation of the privacy pass token key (TokenServiceK) into a new epoch
+type TokenKeyRotation struct {
+	// IntervalHours is how long each key is used to issue tokens, 0 never rotates the key
+	IntervalHours int `json:"intervalHours"`
+	// GraceHours is how long tokens issued with the previous key are still accepted after a rotation
+	GraceHours int `json:"graceHours"`
+	// MaxSpentTokenMBs rotates the key early once the spent tokens of the current key use this much storage, bounding
+	// the size of the spent token databases. 0 for unlimited
+	MaxSpentTokenMBs int `json:"maxSpentTokenMBs"`
+}
+
+// TokenIssuance configures how the token service issues privacy pass tokens for proofs of work. The proof of work
+// itself is tapir's ProofOfWorkApplication, at the fixed difficulty Cwtch clients solve to
+type TokenIssuance struct {
+	// TokensPerRequest is the most tokens issued for one proof of work, requests for more are refused
+	TokensPerRequest int `json:"tokensPerRequest"`
+	// TargetTokensPerHour throttles issuance to about this many tokens an hour: the tokens issued per request are
+	// lowered by one (down to MinTokensPerRequest) while more tokens than this were issued in the last hour and raised
+	// by one (up to TokensPerRequest) while less than half were. Clients asking for more tokens than are currently
+	// issued per request are refused and have to try again later. 0 keeps issuing TokensPerRequest
+	TargetTokensPerHour int `json:"targetTokensPerHour"`
+	MinTokensPerRequest int `json:"minTokensPerRequest"`
+}
+
+// PreviousIdentity is a server's onion identity from before it was rotated. It keeps running alongside the new
+// identity, sharing its message store, until Expires so clients can move over to the new onion.
+type PreviousIdentity struct {
+	PublicKey             ed25519.PublicKey  `json:"publicKey"`
+	PrivateKey            ed25519.PrivateKey `json:"privateKey"`
+	TokenServerPublicKey  ed25519.PublicKey  `json:"tokenServerPublicKey"`
+	TokenServerPrivateKey ed25519.PrivateKey `json:"tokenServerPrivateKey"`
+	Expires               time.Time          `json:"expires"`
+}
+
+// Identity returns an encapsulation of the previous server keys
+func (previous *PreviousIdentity) Identity() primitives.Identity {
+	return primitives.InitializeIdentity("", &previous.PrivateKey, &previous.PublicKey)
+}
+
+// TokenServiceIdentity returns an encapsulation of the previous token server keys
+func (previous *PreviousIdentity) TokenServiceIdentity() primitives.Identity {
+	return primitives.InitializeIdentity("", &previous.TokenServerPrivateKey, &previous.TokenServerPublicKey)
+}
+
+// Onion returns the previous onion address of the server
+func (previous *PreviousIdentity) Onion() string {
+	return tor.GetTorV3Hostname(previous.PublicKey) + ".onion"
+}
+
 // messages are ~4kb of storage
 const MessagesPerMB = 250
 
+// DefaultShutdownTimeoutSeconds is the default time a stopping server gives in-flight requests to finish
+const DefaultShutdownTimeoutSeconds = 10
+
 // Config is a struct for storing basic server configuration
 type Config struct {
 	ConfigDir string `json:"-"`
@@ -59,16 +136,44 @@ type Config struct {
 
 	TokenServiceK ristretto255.Scalar `json:"tokenServiceK"`
 
+	TokenKeyRotation TokenKeyRotation `json:"tokenKeyRotation"`
+
+	TokenIssuance TokenIssuance `json:"tokenIssuance"`
+
+	// TokenKeyEpoch counts the rotations of TokenServiceK, which was last rotated (or first used) at TokenKeyRotatedAt
+	TokenKeyEpoch     int       `json:"tokenKeyEpoch"`
+	TokenKeyRotatedAt time.Time `json:"tokenKeyRotatedAt"`
+
+	// PreviousTokenServiceK is the key of the previous epoch, and tokens issued with it are accepted until
+	// PreviousTokenKeyExpires
+	PreviousTokenServiceK   *ristretto255.Scalar `json:"previousTokenServiceK,omitempty"`
+	PreviousTokenKeyExpires time.Time            `json:"previousTokenKeyExpires"`
+
+	// PreviousIdentity is set while the server is moving to a new onion identity (see Server.RotateIdentity)
+	PreviousIdentity *PreviousIdentity `json:"previousIdentity,omitempty"`
+
 	ServerReporting Reporting `json:"serverReporting"`
 
+	RateLimits RateLimits `json:"rateLimits"`
+
+	MessageLimits MessageLimits `json:"messageLimits"`
+
+	// Mirrors are the onions of peer servers whose messages are replicated into this server's store
+	Mirrors []string `json:"mirrors,omitempty"`
+
 	Attributes map[string]string `json:"attributes"`
 
 	// messages are ~4kb of storage
 	// -1 == infinite
 	MaxStorageMBs int `json:"maxStorageMBs"`
 
+	// ShutdownTimeoutSeconds is how long Stop will wait for in-flight replays and posts to finish
+	ShutdownTimeoutSeconds int `json:"shutdownTimeoutSeconds"`
+
 	lock         sync.Mutex
 	encFileStore storage.FileStore
+	// overrides are the settings overridden from outside the config file (see ConfigOption.Override)
+	overrides map[string]configOverride
 }
 
 // Identity returns an encapsulation of the servers keys
@@ -95,7 +200,39 @@ func initDefaultConfig(configDir, filename string, encrypted bool) *Config {
 	}
 	config.Attributes[AttrAutostart] = "false"
 	config.MaxStorageMBs = -1
+	config.ShutdownTimeoutSeconds = DefaultShutdownTimeoutSeconds
+	config.RateLimits = RateLimits{
+		ReplaysPerMinute:       2,
+		ReplayMessagesPerHour:  0,
+		PostsPerMinute:         60,
+		GlobalReplaysPerMinute: 120,
+		GlobalPostsPerMinute:   0,
+	}
+	// ed25519 signatures and padded, encrypted group messages with plenty of headroom
+	config.MessageLimits = MessageLimits{
+		MaxSignatureBytes:  128,
+		MaxCiphertextBytes: 8192,
+	}
 
+	config.TokenKeyRotation = TokenKeyRotation{
+		IntervalHours: 0,
+		GraceHours:    7 * 24,
+	}
+	config.TokenIssuance = TokenIssuance{
+		TokensPerRequest:    10,
+		TargetTokensPerHour: 0,
+		MinTokensPerRequest: 1,
+	}
+
+	// configs from before key rotation start their first epoch when they are first loaded
+	config.TokenKeyRotatedAt = time.Now()
+
+	config.TokenServiceK = newTokenServiceK()
+	return config
+}
+
+// newTokenServiceK generates a random privacy pass token service key
+func newTokenServiceK() ristretto255.Scalar {
 	k := new(ristretto255.Scalar)
 	b := make([]byte, 64)
 	_, err := rand.Read(b)
@@ -104,8 +241,7 @@ func initDefaultConfig(configDir, filename string, encrypted bool) *Config {
 		panic("unable to generate secure random numbers")
 	}
 	k.SetUniformBytes(b)
-	config.TokenServiceK = *k
-	return config
+	return *k
 }
 
 // LoadCreateDefaultConfigFile loads a Config from or creates a default config and saves it to a json file specified by filename
@@ -120,9 +256,18 @@ func LoadCreateDefaultConfigFile(configDir, filename string, encrypted bool, pas
 // CreateConfig creates a default config and saves it to a json file specified by filename
 // if the encrypted flag is true the config is store encrypted by password
 func CreateConfig(configDir, filename string, encrypted bool, password string, defaultLogToFile bool) (*Config, error) {
+	return CreateConfigWithKeys(configDir, filename, encrypted, password, defaultLogToFile, ImportedKeys{})
+}
+
+// CreateConfigWithKeys creates a config like CreateConfig, using the keys set in keys instead of generating them.
+// Nothing is written if the keys are invalid
+func CreateConfigWithKeys(configDir, filename string, encrypted bool, password string, defaultLogToFile bool, keys ImportedKeys) (*Config, error) {
 	log.Debugf("CreateConfig for server with configDir: %s\n", configDir)
-	os.MkdirAll(configDir, 0700)
 	config := initDefaultConfig(configDir, filename, encrypted)
+	if err := config.ImportKeys(keys); err != nil {
+		return nil, fmt.Errorf("could not import keys: %v", err)
+	}
+	os.MkdirAll(configDir, 0700)
 	config.ServerReporting.LogMetricsToFile = defaultLogToFile
 	if encrypted {
 		key, _, err := storage.InitV1Directory(configDir, password)
@@ -141,8 +286,6 @@ func CreateConfig(configDir, filename string, encrypted bool, password string, d
 // LoadConfig loads a Config from a json file specified by filename
 func LoadConfig(configDir, filename string, encrypted bool, password string) (*Config, error) {
 	config := initDefaultConfig(configDir, filename, encrypted)
-	var raw []byte
-	var err error
 	if encrypted {
 		salt, err := os.ReadFile(path.Join(configDir, storage.SaltFile))
 		if err != nil {
@@ -150,34 +293,61 @@ func LoadConfig(configDir, filename string, encrypted bool, password string) (*C
 		}
 		config.key = storage.CreateKey(password, salt)
 		config.encFileStore = storage.NewFileStore(configDir, ServerConfigFile, config.key)
+	}
+
+	if err := config.read(); err != nil {
+		return nil, err
+	}
+
+	// Always save (first time generation, new version with new variables populated)
+	config.Save()
+	return config, nil
+}
+
+// ReloadFromFile reads the latest version of the config from disk using the location (and key) of this config and
+// returns it without saving or applying it
+func (config *Config) ReloadFromFile() (*Config, error) {
+	newConfig := initDefaultConfig(config.ConfigDir, config.FilePath, config.Encrypted)
+	config.lock.Lock()
+	newConfig.key = config.key
+	newConfig.encFileStore = config.encFileStore
+	config.lock.Unlock()
+	if err := newConfig.read(); err != nil {
+		return nil, err
+	}
+	return newConfig, nil
+}
+
+// read populates the config from its (possibly encrypted) json file
+func (config *Config) read() error {
+	var raw []byte
+	var err error
+	if config.Encrypted {
 		raw, err = config.encFileStore.Read()
 		if err != nil {
 			// Not an error to log as load config is called blindly across all dirs with a password to see what it applies to
 			log.Debugf("read enc bytes failed: %s\n", err)
-			return nil, err
+			return err
 		}
 	} else {
-		raw, err = os.ReadFile(path.Join(configDir, filename))
+		raw, err = os.ReadFile(path.Join(config.ConfigDir, config.FilePath))
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	if err = json.Unmarshal(raw, &config); err != nil {
+	if err = json.Unmarshal(raw, config); err != nil {
 		log.Errorf("reading config: %v", err)
-		return nil, err
+		return err
 	}
-
-	// Always save (first time generation, new version with new variables populated)
-	config.Save()
-	return config, nil
+	return nil
 }
 
 // Save dumps the latest version of the config to a json file given by filename
 func (config *Config) Save() error {
 	config.lock.Lock()
 	defer config.lock.Unlock()
-	bytes, _ := json.MarshalIndent(config, "", "\t")
+	bytes := config.savedJSON()
 	if config.Encrypted {
 		return config.encFileStore.Write(bytes)
 	}
@@ -223,20 +393,334 @@ func (config *Config) GetAttribute(key string) string {
 func (config *Config) GetMaxMessages() int {
 	config.lock.Lock()
 	defer config.lock.Unlock()
-	if config.MaxStorageMBs == -1 {
+	return maxMessages(config.MaxStorageMBs)
+}
+
+// maxMessages converts a storage cap in MBs to a number of messages (-1 for infinite)
+func maxMessages(mbs int) int {
+	if mbs == -1 {
 		return -1
 	}
-	return config.MaxStorageMBs * MessagesPerMB
+	return mbs * MessagesPerMB
 }
 
+// GetMaxMessageMBs returns the config setting for MaxStorageMBs
 func (config *Config) GetMaxMessageMBs() int {
 	config.lock.Lock()
 	defer config.lock.Unlock()
 	return config.MaxStorageMBs
 }
 
+// SetMaxMessageMBs sets MaxStorageMBs, the config is not saved
 func (config *Config) SetMaxMessageMBs(newval int) {
 	config.lock.Lock()
 	defer config.lock.Unlock()
 	config.MaxStorageMBs = newval
 }
+
+// GetShutdownTimeout returns how long a stopping server should wait for in-flight requests
+func (config *Config) GetShutdownTimeout() time.Duration {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+}
+
+// GetRateLimits returns the tokenboard rate limits
+func (config *Config) GetRateLimits() RateLimits {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.RateLimits
+}
+
+// GetMessageLimits returns the tokenboard message size limits
+func (config *Config) GetMessageLimits() MessageLimits {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.MessageLimits
+}
+
+// GetTokenKeyRotation returns the token key rotation settings
+func (config *Config) GetTokenKeyRotation() TokenKeyRotation {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.TokenKeyRotation
+}
+
+// GetMirrors returns the onions of the servers mirrored by this server
+func (config *Config) GetMirrors() []string {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return append([]string{}, config.Mirrors...)
+}
+
+// SetMirrors sets the onions of the servers mirrored by this server. The config is not saved.
+func (config *Config) SetMirrors(onions []string) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.Mirrors = append([]string{}, onions...)
+}
+
+// GetTokenIssuance returns the token issuance settings
+func (config *Config) GetTokenIssuance() TokenIssuance {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.TokenIssuance
+}
+
+// SetTokenIssuance sets the token issuance settings. The config is not saved.
+func (config *Config) SetTokenIssuance(issuance TokenIssuance) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.TokenIssuance = issuance
+}
+
+// tokenKeyEpochs returns the current token key epoch with a copy of its key and when it started, and a copy of the
+// previous epoch's key and when it expires (or nil if there is no previous key)
+func (config *Config) tokenKeyEpochs() (epoch int, k ristretto255.Scalar, rotatedAt time.Time, previousK *ristretto255.Scalar, previousExpires time.Time) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.PreviousTokenServiceK != nil {
+		previous := *config.PreviousTokenServiceK
+		previousK = &previous
+	}
+	return config.TokenKeyEpoch, config.TokenServiceK, config.TokenKeyRotatedAt, previousK, config.PreviousTokenKeyExpires
+}
+
+// rotateTokenKey starts a new token key epoch with a new TokenServiceK, keeping the current key as the previous key
+// for the grace window. Returns the new epoch and a copy of its key. The config is not saved.
+func (config *Config) rotateTokenKey(now time.Time) (int, ristretto255.Scalar) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	previous := config.TokenServiceK
+	config.PreviousTokenServiceK = &previous
+	config.PreviousTokenKeyExpires = now.Add(time.Duration(config.TokenKeyRotation.GraceHours) * time.Hour)
+	config.TokenServiceK = newTokenServiceK()
+	config.TokenKeyEpoch++
+	config.TokenKeyRotatedAt = now
+	return config.TokenKeyEpoch, config.TokenServiceK
+}
+
+// expirePreviousTokenKey forgets the previous token key. The config is not saved.
+func (config *Config) expirePreviousTokenKey() {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.PreviousTokenServiceK = nil
+	config.PreviousTokenKeyExpires = time.Time{}
+}
+
+// rotateIdentity replaces the server and token server onion identities with newly generated ones, keeping the
+// current identities as the PreviousIdentity until now+transition. Returns a copy of the previous identity. The config
+// is not saved.
+func (config *Config) rotateIdentity(now time.Time, transition time.Duration) PreviousIdentity {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	previous := PreviousIdentity{
+		PublicKey:             config.PublicKey,
+		PrivateKey:            config.PrivateKey,
+		TokenServerPublicKey:  config.TokenServerPublicKey,
+		TokenServerPrivateKey: config.TokenServerPrivateKey,
+		Expires:               now.Add(transition),
+	}
+	config.PreviousIdentity = &previous
+	id, pk := primitives.InitializeEphemeralIdentity()
+	tid, tpk := primitives.InitializeEphemeralIdentity()
+	config.PrivateKey = pk
+	config.PublicKey = id.PublicKey()
+	config.TokenServerPrivateKey = tpk
+	config.TokenServerPublicKey = tid.PublicKey()
+	return previous
+}
+
+// previousIdentity returns a copy of the previous identity, or nil if the server isn't moving to a new identity
+func (config *Config) previousIdentity() *PreviousIdentity {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.PreviousIdentity == nil {
+		return nil
+	}
+	previous := *config.PreviousIdentity
+	return &previous
+}
+
+// expirePreviousIdentity forgets the previous identity. The config is not saved.
+func (config *Config) expirePreviousIdentity() {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.PreviousIdentity = nil
+}
+
+// Validate checks the config for missing or inconsistent values and returns an error describing the first problem found
+func (config *Config) Validate() error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if err := validateKeyPair("server", config.PrivateKey, config.PublicKey); err != nil {
+		return err
+	}
+	if err := validateKeyPair("token server", config.TokenServerPrivateKey, config.TokenServerPublicKey); err != nil {
+		return err
+	}
+	if previous := config.PreviousIdentity; previous != nil {
+		if err := validateKeyPair("previous server", previous.PrivateKey, previous.PublicKey); err != nil {
+			return err
+		}
+		if err := validateKeyPair("previous token server", previous.TokenServerPrivateKey, previous.TokenServerPublicKey); err != nil {
+			return err
+		}
+	}
+	if config.TokenServiceK.Equal(ristretto255.NewScalar()) == 1 {
+		return errors.New("tokenServiceK is not set")
+	}
+	if err := validateMaxStorageMBs(config.MaxStorageMBs); err != nil {
+		return err
+	}
+	if config.ShutdownTimeoutSeconds < 0 {
+		return fmt.Errorf("shutdownTimeoutSeconds cannot be negative, got %d", config.ShutdownTimeoutSeconds)
+	}
+	limits := config.RateLimits
+	if limits.ReplaysPerMinute < 0 || limits.ReplayMessagesPerHour < 0 || limits.PostsPerMinute < 0 || limits.GlobalReplaysPerMinute < 0 || limits.GlobalPostsPerMinute < 0 {
+		return fmt.Errorf("rateLimits cannot be negative (use 0 for unlimited), got %+v", limits)
+	}
+	if config.MessageLimits.MaxSignatureBytes <= 0 || config.MessageLimits.MaxCiphertextBytes <= 0 {
+		return fmt.Errorf("messageLimits must be positive, got %+v", config.MessageLimits)
+	}
+	rotation := config.TokenKeyRotation
+	if rotation.IntervalHours < 0 || rotation.GraceHours < 0 || rotation.MaxSpentTokenMBs < 0 {
+		return fmt.Errorf("tokenKeyRotation cannot be negative, got %+v", rotation)
+	}
+	// only one previous key is kept, so it has to expire before the next rotation
+	if rotation.IntervalHours > 0 && rotation.GraceHours > rotation.IntervalHours {
+		return fmt.Errorf("tokenKeyRotation graceHours cannot be longer than intervalHours, got %+v", rotation)
+	}
+	if err := validateTokenIssuance(config.TokenIssuance); err != nil {
+		return err
+	}
+	if err := validateMirrors(config.Mirrors, tor.GetTorV3Hostname(config.PublicKey)); err != nil {
+		return err
+	}
+	if autostart, exists := config.Attributes[AttrAutostart]; exists && autostart != "true" && autostart != "false" {
+		return fmt.Errorf("autostart must be true or false, got %q", autostart)
+	}
+	return nil
+}
+
+func validateMaxStorageMBs(mbs int) error {
+	if mbs < -1 || mbs == 0 {
+		return fmt.Errorf("maxStorageMBs must be a positive number of MBs or -1 for unlimited, got %d", mbs)
+	}
+	return nil
+}
+
+func validateTokenIssuance(issuance TokenIssuance) error {
+	if issuance.TokensPerRequest < 1 {
+		return fmt.Errorf("tokenIssuance tokensPerRequest must be positive, got %d", issuance.TokensPerRequest)
+	}
+	if issuance.TargetTokensPerHour < 0 {
+		return fmt.Errorf("tokenIssuance targetTokensPerHour cannot be negative (use 0 to not adapt), got %d", issuance.TargetTokensPerHour)
+	}
+	if issuance.TargetTokensPerHour > 0 && (issuance.MinTokensPerRequest < 1 || issuance.MinTokensPerRequest > issuance.TokensPerRequest) {
+		return fmt.Errorf("tokenIssuance minTokensPerRequest must be between 1 and tokensPerRequest, got %d", issuance.MinTokensPerRequest)
+	}
+	return nil
+}
+
+// validateMirrors checks mirrors are distinct v3 onions (with or without the .onion suffix) other than onion
+func validateMirrors(mirrors []string, onion string) error {
+	seen := make(map[string]bool)
+	for _, mirror := range mirrors {
+		hostname := strings.TrimSuffix(mirror, ".onion")
+		if len(hostname) != 56 || strings.Trim(hostname, "abcdefghijklmnopqrstuvwxyz234567") != "" {
+			return fmt.Errorf("mirror %q is not a v3 onion", mirror)
+		}
+		if hostname == onion {
+			return errors.New("a server cannot mirror itself")
+		}
+		if seen[hostname] {
+			return fmt.Errorf("mirror %q is listed more than once", mirror)
+		}
+		seen[hostname] = true
+	}
+	return nil
+}
+
+func validateKeyPair(name string, privateKey ed25519.PrivateKey, publicKey ed25519.PublicKey) error {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%s private key must be %d bytes, got %d", name, ed25519.PrivateKeySize, len(privateKey))
+	}
+	if !bytes.Equal(privateKey.Public().(ed25519.PublicKey), publicKey) {
+		return fmt.Errorf("%s public key does not match its private key", name)
+	}
+	return nil
+}
+
+// diff compares the config with newConfig and returns the names of changed settings that can be applied to a running
+// server and those that can't (identities and token service keys)
+func (config *Config) diff(newConfig *Config) (live []string, restart []string) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if !bytes.Equal(config.PrivateKey, newConfig.PrivateKey) || !bytes.Equal(config.PublicKey, newConfig.PublicKey) {
+		restart = append(restart, "privateKey")
+	}
+	if !bytes.Equal(config.TokenServerPrivateKey, newConfig.TokenServerPrivateKey) || !bytes.Equal(config.TokenServerPublicKey, newConfig.TokenServerPublicKey) {
+		restart = append(restart, "tokenServerPrivateKey")
+	}
+	if (config.PreviousIdentity == nil) != (newConfig.PreviousIdentity == nil) || (config.PreviousIdentity != nil && !bytes.Equal(config.PreviousIdentity.PrivateKey, newConfig.PreviousIdentity.PrivateKey)) {
+		restart = append(restart, "previousIdentity")
+	}
+	if config.TokenServiceK.Equal(&newConfig.TokenServiceK) != 1 {
+		restart = append(restart, "tokenServiceK")
+	}
+	if config.MaxStorageMBs != newConfig.MaxStorageMBs {
+		live = append(live, "maxStorageMBs")
+	}
+	if config.ShutdownTimeoutSeconds != newConfig.ShutdownTimeoutSeconds {
+		live = append(live, "shutdownTimeoutSeconds")
+	}
+	if config.ServerReporting != newConfig.ServerReporting {
+		live = append(live, "serverReporting")
+	}
+	if config.RateLimits != newConfig.RateLimits {
+		live = append(live, "rateLimits")
+	}
+	if config.MessageLimits != newConfig.MessageLimits {
+		live = append(live, "messageLimits")
+	}
+	if config.TokenKeyRotation != newConfig.TokenKeyRotation {
+		live = append(live, "tokenKeyRotation")
+	}
+	if config.TokenIssuance != newConfig.TokenIssuance {
+		live = append(live, "tokenIssuance")
+	}
+	if strings.Join(config.Mirrors, ",") != strings.Join(newConfig.Mirrors, ",") {
+		live = append(live, "mirrors")
+	}
+	for key := range newConfig.Attributes {
+		if config.Attributes[key] != newConfig.Attributes[key] {
+			live = append(live, "attributes."+key)
+		}
+	}
+	for key := range config.Attributes {
+		if _, exists := newConfig.Attributes[key]; !exists {
+			live = append(live, "attributes."+key)
+		}
+	}
+	return
+}
+
+// update copies the settings that can be applied to a running server from newConfig
+func (config *Config) update(newConfig *Config) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.MaxStorageMBs = newConfig.MaxStorageMBs
+	config.ShutdownTimeoutSeconds = newConfig.ShutdownTimeoutSeconds
+	config.ServerReporting = newConfig.ServerReporting
+	config.RateLimits = newConfig.RateLimits
+	config.MessageLimits = newConfig.MessageLimits
+	config.TokenKeyRotation = newConfig.TokenKeyRotation
+	config.TokenIssuance = newConfig.TokenIssuance
+	config.Mirrors = append([]string{}, newConfig.Mirrors...)
+	config.overrides = newConfig.overrides
+	config.Attributes = make(map[string]string)
+	for key, val := range newConfig.Attributes {
+		config.Attributes[key] = val
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ConfigOption describes a Config setting that can be supplied from outside of the config file (e.g. from the
+// environment or command line flags of a bundling application)
+type ConfigOption struct {
+	// Name matches the json name of the setting in serverConfig.json
+	Name  string
+	Usage string
+	// Bool is true if the option takes a boolean value (so can be used as a bare command line flag)
+	Bool bool
+	// Secret is true if the option is a key that must not be supplied as a command line flag, where it would be
+	// visible to other users in the process list
+	Secret bool
+	set    func(config *Config, value string) error
+}
+
+// Set parses value and applies it to the config. The config is not saved.
+func (opt ConfigOption) Set(config *Config, value string) error {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if err := opt.set(config, value); err != nil {
+		return fmt.Errorf("invalid value for %v: %v", opt.Name, err)
+	}
+	return nil
+}
+
+// Override applies value to the config like Set, but only in memory: Save keeps writing the value the setting had
+// before it was overridden (e.g. in serverConfig.json), unless the setting is changed again after the override.
+// This keeps values from the environment or flags out of the config file, so removing them restores the file's value.
+func (opt ConfigOption) Override(config *Config, value string) error {
+	before := config.settings()
+	if err := opt.Set(config, value); err != nil {
+		return err
+	}
+	after := config.settings()
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.overrides == nil {
+		config.overrides = make(map[string]configOverride)
+	}
+	for key, val := range after {
+		if previous, exists := before[key]; !exists || !reflect.DeepEqual(previous, val) {
+			override, overridden := config.overrides[key]
+			if !overridden {
+				override = configOverride{saved: previous, inFile: exists}
+			}
+			override.value = val
+			config.overrides[key] = override
+		}
+	}
+	return nil
+}
+
+// configOverride records the saved value of an overridden setting, and the value it was overridden with
+type configOverride struct {
+	saved  interface{}
+	inFile bool
+	value  interface{}
+}
+
+// settingSeparator joins the json names of nested settings into a settings key
+const settingSeparator = "\x00"
+
+// settings returns the json values of every setting in the config, keyed by their path in the json
+func (config *Config) settings() map[string]interface{} {
+	config.lock.Lock()
+	data, _ := json.Marshal(config)
+	config.lock.Unlock()
+	tree := decodeSettings(data)
+	settings := make(map[string]interface{})
+	flattenSettings("", tree, settings)
+	return settings
+}
+
+// decodeSettings decodes the json of a config, keeping numbers as they were written
+func decodeSettings(data []byte) map[string]interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	tree := make(map[string]interface{})
+	decoder.Decode(&tree)
+	return tree
+}
+
+func flattenSettings(prefix string, tree map[string]interface{}, settings map[string]interface{}) {
+	for name, val := range tree {
+		if subtree, ok := val.(map[string]interface{}); ok {
+			flattenSettings(prefix+name+settingSeparator, subtree, settings)
+		} else {
+			settings[prefix+name] = val
+		}
+	}
+}
+
+// savedJSON returns the json of the config to save, with overridden settings that haven't changed since they were
+// overridden set back to their saved values. config.lock must be held
+func (config *Config) savedJSON() []byte {
+	data, _ := json.MarshalIndent(config, "", "\t")
+	if len(config.overrides) == 0 {
+		return data
+	}
+	tree := decodeSettings(data)
+	for key, override := range config.overrides {
+		path := strings.Split(key, settingSeparator)
+		parent := tree
+		for _, name := range path[:len(path)-1] {
+			subtree, ok := parent[name].(map[string]interface{})
+			if !ok {
+				subtree = make(map[string]interface{})
+				parent[name] = subtree
+			}
+			parent = subtree
+		}
+		name := path[len(path)-1]
+		if !reflect.DeepEqual(parent[name], override.value) {
+			// changed since it was overridden, so the new value is saved
+			continue
+		}
+		if override.inFile {
+			parent[name] = override.saved
+		} else {
+			delete(parent, name)
+		}
+	}
+	// round trip through a Config to keep the order and format of the file
+	data, _ = json.Marshal(tree)
+	saved := new(Config)
+	json.Unmarshal(data, saved)
+	data, _ = json.MarshalIndent(saved, "", "\t")
+	return data
+}
+
+// ConfigOptions lists every Config setting that can be overridden
+var ConfigOptions = []ConfigOption{
+	{Name: "maxStorageMBs", Usage: "Maximum storage for messages in MBs (-1 for unlimited)", set: setMaxStorageMBs},
+	{Name: "shutdownTimeoutSeconds", Usage: "Seconds to wait for in-flight requests to finish when stopping", set: setShutdownTimeoutSeconds},
+	{Name: "replaysPerMinute", Usage: "Replay requests allowed per connection per minute (0 for unlimited)", set: setRateLimit(func(l *RateLimits) *int { return &l.ReplaysPerMinute })},
+	{Name: "replayMessagesPerHour", Usage: "Messages sent in replays allowed per connection per hour (0 for unlimited)", set: setRateLimit(func(l *RateLimits) *int { return &l.ReplayMessagesPerHour })},
+	{Name: "postsPerMinute", Usage: "Posts allowed per connection per minute (0 for unlimited)", set: setRateLimit(func(l *RateLimits) *int { return &l.PostsPerMinute })},
+	{Name: "globalReplaysPerMinute", Usage: "Replay requests allowed from all connections per minute (0 for unlimited)", set: setRateLimit(func(l *RateLimits) *int { return &l.GlobalReplaysPerMinute })},
+	{Name: "globalPostsPerMinute", Usage: "Posts allowed from all connections per minute (0 for unlimited)", set: setRateLimit(func(l *RateLimits) *int { return &l.GlobalPostsPerMinute })},
+	{Name: "maxSignatureBytes", Usage: "Maximum size of a posted message signature in bytes", set: setMessageLimit(func(l *MessageLimits) *int { return &l.MaxSignatureBytes })},
+	{Name: "maxCiphertextBytes", Usage: "Maximum size of a posted message ciphertext in bytes", set: setMessageLimit(func(l *MessageLimits) *int { return &l.MaxCiphertextBytes })},
+	{Name: "tokenKeyRotationHours", Usage: "Hours between rotations of the privacy pass token key (0 to never rotate)", set: setTokenKeyRotation(func(r *TokenKeyRotation) *int { return &r.IntervalHours })},
+	{Name: "tokenKeyGraceHours", Usage: "Hours tokens issued with the previous token key are accepted after a rotation", set: setTokenKeyRotation(func(r *TokenKeyRotation) *int { return &r.GraceHours })},
+	{Name: "maxSpentTokenMBs", Usage: "Rotate the token key early once its spent tokens use this many MBs (0 for unlimited)", set: setTokenKeyRotation(func(r *TokenKeyRotation) *int { return &r.MaxSpentTokenMBs })},
+	{Name: "tokensPerRequest", Usage: "Most tokens issued for one proof of work", set: setTokenIssuance(func(i *TokenIssuance) *int { return &i.TokensPerRequest })},
+	{Name: "targetTokensPerHour", Usage: "Throttle the tokens issued per request to issue about this many tokens per hour (0 to not throttle)", set: setTokenIssuance(func(i *TokenIssuance) *int { return &i.TargetTokensPerHour })},
+	{Name: "minTokensPerRequest", Usage: "Fewest tokens per request a throttled server will issue", set: setTokenIssuance(func(i *TokenIssuance) *int { return &i.MinTokensPerRequest })},
+	{Name: "mirrors", Usage: "Comma separated onions of servers to mirror the messages of", set: setMirrors},
+	{Name: "logMetricsToFile", Usage: "Log server metrics to serverMonitorReport.txt", Bool: true, set: setLogMetricsToFile},
+	{Name: AttrDescription, Usage: "A description of the server", set: setDescription},
+	{Name: AttrAutostart, Usage: "Start the server automatically (used by bundling applications)", Bool: true, set: setAutostart},
+	{Name: "privateKey", Usage: "Base64 encoded ed25519 private key of the server onion", Secret: true, set: setPrivateKey},
+	{Name: "tokenServerPrivateKey", Usage: "Base64 encoded ed25519 private key of the token server onion", Secret: true, set: setTokenServerPrivateKey},
+	{Name: "tokenServiceK", Usage: "Base64 encoded privacy pass token service scalar", Secret: true, set: setTokenServiceK},
+}
+
+// LookupConfigOption returns the ConfigOption with the given name
+func LookupConfigOption(name string) (ConfigOption, bool) {
+	for _, opt := range ConfigOptions {
+		if opt.Name == name {
+			return opt, true
+		}
+	}
+	return ConfigOption{}, false
+}
+
+func setMaxStorageMBs(config *Config, value string) error {
+	mbs, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	config.MaxStorageMBs = mbs
+	return nil
+}
+
+func setShutdownTimeoutSeconds(config *Config, value string) error {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	config.ShutdownTimeoutSeconds = seconds
+	return nil
+}
+
+// setRateLimit returns a setter for the RateLimits field returned by limit
+func setRateLimit(limit func(limits *RateLimits) *int) func(config *Config, value string) error {
+	return func(config *Config, value string) error {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*limit(&config.RateLimits) = count
+		return nil
+	}
+}
+
+// setMessageLimit returns a setter for the MessageLimits field returned by limit
+func setMessageLimit(limit func(limits *MessageLimits) *int) func(config *Config, value string) error {
+	return func(config *Config, value string) error {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*limit(&config.MessageLimits) = size
+		return nil
+	}
+}
+
+// setTokenKeyRotation returns a setter for the TokenKeyRotation field returned by setting
+func setTokenKeyRotation(setting func(rotation *TokenKeyRotation) *int) func(config *Config, value string) error {
+	return func(config *Config, value string) error {
+		hours, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*setting(&config.TokenKeyRotation) = hours
+		return nil
+	}
+}
+
+// setTokenIssuance returns a setter for the TokenIssuance field returned by setting
+func setTokenIssuance(setting func(issuance *TokenIssuance) *int) func(config *Config, value string) error {
+	return func(config *Config, value string) error {
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*setting(&config.TokenIssuance) = count
+		return nil
+	}
+}
+
+func setLogMetricsToFile(config *Config, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	config.ServerReporting.LogMetricsToFile = b
+	return nil
+}
+
+func setDescription(config *Config, value string) error {
+	config.Attributes[AttrDescription] = value
+	return nil
+}
+
+func setAutostart(config *Config, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	config.Attributes[AttrAutostart] = strconv.FormatBool(b)
+	return nil
+}
+
+func decodePrivateKey(value string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PrivateKeySize, len(raw))
+	}
+	privateKey := ed25519.PrivateKey(raw)
+	return privateKey, privateKey.Public().(ed25519.PublicKey), nil
+}
+
+func setPrivateKey(config *Config, value string) error {
+	privateKey, publicKey, err := decodePrivateKey(value)
+	if err != nil {
+		return err
+	}
+	config.PrivateKey = privateKey
+	config.PublicKey = publicKey
+	return nil
+}
+
+func setTokenServerPrivateKey(config *Config, value string) error {
+	privateKey, publicKey, err := decodePrivateKey(value)
+	if err != nil {
+		return err
+	}
+	config.TokenServerPrivateKey = privateKey
+	config.TokenServerPublicKey = publicKey
+	return nil
+}
+
+func setMirrors(config *Config, value string) error {
+	config.Mirrors = nil
+	for _, onion := range strings.Split(value, ",") {
+		if onion = strings.TrimSpace(onion); onion != "" {
+			config.Mirrors = append(config.Mirrors, onion)
+		}
+	}
+	return nil
+}
+
+func setTokenServiceK(config *Config, value string) error {
+	return config.TokenServiceK.UnmarshalText([]byte(value))
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigOptions(t *testing.T) {
+	config := initDefaultConfig(TestDir, ServerConfigFile, false)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+
+	maxStorage, _ := LookupConfigOption("maxStorageMBs")
+	if err := maxStorage.Set(config, "10"); err != nil {
+		t.Fatalf("could not set maxStorageMBs: %v", err)
+	}
+	if config.GetMaxMessages() != 10*MessagesPerMB {
+		t.Errorf("expected max messages of %d got %d", 10*MessagesPerMB, config.GetMaxMessages())
+	}
+	if err := maxStorage.Set(config, "ten"); err == nil {
+		t.Errorf("expected error setting maxStorageMBs to a non number")
+	}
+	maxStorage.Set(config, "0")
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected maxStorageMBs of 0 to fail validation")
+	}
+	maxStorage.Set(config, "-1")
+
+	autostart, _ := LookupConfigOption(AttrAutostart)
+	if err := autostart.Set(config, "1"); err != nil || config.GetAttribute(AttrAutostart) != "true" {
+		t.Errorf("expected autostart to be set to true: %v", err)
+	}
+
+	id, pk := primitives.InitializeEphemeralIdentity()
+	privateKey, _ := LookupConfigOption("privateKey")
+	if err := privateKey.Set(config, base64.StdEncoding.EncodeToString(pk)); err != nil {
+		t.Fatalf("could not set privateKey: %v", err)
+	}
+	configID := config.Identity()
+	if configID.Hostname() != id.Hostname() {
+		t.Errorf("expected config identity to be %v got %v", id.Hostname(), configID.Hostname())
+	}
+	if err := privateKey.Set(config, base64.StdEncoding.EncodeToString(pk[:32])); err == nil {
+		t.Errorf("expected error setting a truncated privateKey")
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("config should be valid: %v", err)
+	}
+
+	config.PublicKey = config.TokenServerPublicKey
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected mismatched public key to fail validation")
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	fileKey, fileReplays := config.PrivateKey, config.GetRateLimits().ReplaysPerMinute
+	_, pk := primitives.InitializeEphemeralIdentity()
+	for name, value := range map[string]string{"maxStorageMBs": "10", "replaysPerMinute": "5", AttrDescription: "overridden", "privateKey": base64.StdEncoding.EncodeToString(pk)} {
+		opt, _ := LookupConfigOption(name)
+		if err := opt.Override(config, value); err != nil {
+			t.Fatalf("could not override %v: %v", name, err)
+		}
+	}
+	if config.GetMaxMessageMBs() != 10 || config.GetRateLimits().ReplaysPerMinute != 5 || !bytes.Equal(config.PrivateKey, pk) {
+		t.Fatalf("expected overrides to be applied")
+	}
+	// settings changed after they were overridden are saved, the rest keep their file values
+	config.SetAttribute(AttrDescription, "changed")
+	config.SetAttribute(AttrAutostart, "true")
+	if err := config.Save(); err != nil {
+		t.Fatalf("could not save config: %v", err)
+	}
+	saved, err := LoadConfig(TestDir, ServerConfigFile, false, "")
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if saved.GetMaxMessageMBs() != -1 || saved.GetRateLimits().ReplaysPerMinute != fileReplays || !bytes.Equal(saved.PrivateKey, fileKey) {
+		t.Errorf("expected overrides not to be saved, got %v MBs, %v replays", saved.GetMaxMessageMBs(), saved.GetRateLimits().ReplaysPerMinute)
+	}
+	if saved.GetAttribute(AttrDescription) != "changed" || saved.GetAttribute(AttrAutostart) != "true" {
+		t.Errorf("expected settings changed after the overrides to be saved")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+
+	onDisk, _ := LoadConfig(TestDir, ServerConfigFile, false, "")
+	onDisk.MaxStorageMBs = 5
+	onDisk.Attributes[AttrDescription] = TestServerDesc
+	onDisk.Mirrors = []string{strings.Repeat("a", 56) + ".onion"}
+	onDisk.Save()
+
+	newConfig, err := config.ReloadFromFile()
+	if err != nil {
+		t.Fatalf("could not reload config: %v", err)
+	}
+	live, restart := config.diff(newConfig)
+	if len(live) != 3 || len(restart) != 0 {
+		t.Errorf("expected 3 live changes and no restart changes, got %v and %v", live, restart)
+	}
+
+	s := NewServer(config)
+	defer s.Destroy()
+	if err := s.ApplyConfig(newConfig); err != nil {
+		t.Fatalf("could not apply config: %v", err)
+	}
+	if config.GetMaxMessageMBs() != 5 || config.GetAttribute(AttrDescription) != TestServerDesc {
+		t.Errorf("config changes were not applied")
+	}
+	if mirrors := s.MirrorStatus(); len(mirrors) != 1 || mirrors[0].Onion != strings.Repeat("a", 56) || mirrors[0].Connected {
+		t.Errorf("expected a disconnected mirror of the stopped server, got %+v", mirrors)
+	}
+
+	newConfig.TokenServerPrivateKey, newConfig.TokenServerPublicKey = config.PrivateKey, config.PublicKey
+	if err := s.ApplyConfig(newConfig); err == nil {
+		t.Errorf("expected changing the token server key to be rejected")
+	}
+}
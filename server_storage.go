@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/openprivacy/log"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// checkedMessageStore wraps a message store and records whether it is failing so storage failures can be surfaced
+// by CheckStatus. Errors caused by the request (duplicate or invalid messages, cancelled contexts) are not failures.
+type checkedMessageStore struct {
+	storage.MessageStoreInterface
+	lock     sync.Mutex
+	err      error
+	failedFn func(err error)
+}
+
+func newCheckedMessageStore(store storage.MessageStoreInterface, failedFn func(err error)) *checkedMessageStore {
+	return &checkedMessageStore{MessageStoreInterface: store, failedFn: failedFn}
+}
+
+// check records the result of a store operation and returns err. failedFn is called when the store starts failing
+func (cs *checkedMessageStore) check(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrDuplicateMessage), errors.Is(err, storage.ErrInvalidMessage),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	cs.lock.Lock()
+	wasFailing := cs.err != nil
+	cs.err = err
+	cs.lock.Unlock()
+	if err != nil && !wasFailing && cs.failedFn != nil {
+		cs.failedFn(err)
+	}
+	return err
+}
+
+// lastError returns the error from the most recent store operation, or nil if it succeeded
+func (cs *checkedMessageStore) lastError() error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.err
+}
+
+func (cs *checkedMessageStore) AddMessage(ctx context.Context, message groups.EncryptedGroupMessage) error {
+	return cs.check(cs.MessageStoreInterface.AddMessage(ctx, message))
+}
+
+func (cs *checkedMessageStore) MessageExists(ctx context.Context, signature []byte) (bool, error) {
+	exists, err := cs.MessageStoreInterface.MessageExists(ctx, signature)
+	return exists, cs.check(err)
+}
+
+func (cs *checkedMessageStore) FetchMessages(ctx context.Context) ([]*storage.StoredMessage, error) {
+	messages, err := cs.MessageStoreInterface.FetchMessages(ctx)
+	return messages, cs.check(err)
+}
+
+func (cs *checkedMessageStore) MessagesCount(ctx context.Context) (int, error) {
+	count, err := cs.MessageStoreInterface.MessagesCount(ctx)
+	return count, cs.check(err)
+}
+
+func (cs *checkedMessageStore) FetchMessagesFrom(ctx context.Context, signature []byte) ([]*storage.StoredMessage, error) {
+	messages, err := cs.MessageStoreInterface.FetchMessagesFrom(ctx, signature)
+	return messages, cs.check(err)
+}
+
+func (cs *checkedMessageStore) FetchMessagesBounded(ctx context.Context, since time.Time, limit int) ([]*storage.StoredMessage, error) {
+	messages, err := cs.MessageStoreInterface.FetchMessagesBounded(ctx, since, limit)
+	return messages, cs.check(err)
+}
+
+func (cs *checkedMessageStore) FetchMessagesAfter(ctx context.Context, sequence int64, limit int) ([]*storage.StoredMessage, error) {
+	messages, err := cs.MessageStoreInterface.FetchMessagesAfter(ctx, sequence, limit)
+	return messages, cs.check(err)
+}
+
+func (cs *checkedMessageStore) LastSequence(ctx context.Context) (int64, error) {
+	sequence, err := cs.MessageStoreInterface.LastSequence(ctx)
+	return sequence, cs.check(err)
+}
+
+func (cs *checkedMessageStore) SetMessageCap(ctx context.Context, newcap int) error {
+	return cs.check(cs.MessageStoreInterface.SetMessageCap(ctx, newcap))
+}
+
+// withMessageStore calls fn with the server's message store, opening it for the call if the server isn't running
+func (s *server) withMessageStore(fn func(ctx context.Context, store storage.MessageStoreInterface) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.running {
+		return fn(s.ctx, s.messageStore)
+	}
+	store, err := storage.InitializeSqliteMessageStore(path.Join(s.config.ConfigDir, messageStoreFile), s.config.GetMaxMessages(), nil, nil)
+	if err != nil {
+		return fmt.Errorf("could not open database: %v", err)
+	}
+	defer store.Close()
+	return fn(context.Background(), store)
+}
+
+// ExportMessages writes every stored message to w in the message export format (see storage.MessageExportWriter),
+// oldest first with the times they were stored. Returns the number of messages exported
+func (s *server) ExportMessages(w io.Writer) (int, error) {
+	count := 0
+	err := s.withMessageStore(func(ctx context.Context, store storage.MessageStoreInterface) (err error) {
+		count, err = store.Export(ctx, w)
+		return err
+	})
+	return count, err
+}
+
+// ImportMessages adds the messages of a message export to the server's store after those already stored, skipping
+// any with the signature of a stored or pruned message. Messages imported into a running server are sent to clients
+// listening for new messages like posted ones (clients that fall behind catch up from the store a page at a time),
+// including those imported before an error
+func (s *server) ImportMessages(r io.Reader) (storage.MessageImport, error) {
+	var result storage.MessageImport
+	err := s.withMessageStore(func(ctx context.Context, store storage.MessageStoreInterface) (err error) {
+		result, err = store.Import(ctx, r)
+		if s.running && result.Imported > 0 {
+			s.fanout.notify()
+		}
+		return err
+	})
+	if err == nil {
+		log.Infof("Imported %d messages, skipped %d already stored and %d pruned", result.Imported, result.Duplicates, result.Pruned)
+	}
+	return result, err
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/openprivacy/connectivity"
+	"os"
+	"path"
+	"testing"
+)
+
+// failingMessageStore is a message store whose AddMessage returns err
+type failingMessageStore struct {
+	storage.MessageStoreInterface
+	err error
+}
+
+func (fs *failingMessageStore) AddMessage(ctx context.Context, message groups.EncryptedGroupMessage) error {
+	return fs.err
+}
+
+func TestCheckedMessageStore(t *testing.T) {
+	failures := 0
+	store := &failingMessageStore{}
+	cs := newCheckedMessageStore(store, func(err error) { failures++ })
+
+	for _, err := range []error{nil, storage.ErrDuplicateMessage, storage.ErrInvalidMessage, context.Canceled} {
+		store.err = err
+		if got := cs.AddMessage(context.Background(), groups.EncryptedGroupMessage{}); got != err {
+			t.Errorf("expected error %v to be returned, got %v", err, got)
+		}
+		if cs.lastError() != nil || failures != 0 {
+			t.Errorf("expected %v not to be a storage failure", err)
+		}
+	}
+
+	store.err = errors.New("disk I/O error")
+	cs.AddMessage(context.Background(), groups.EncryptedGroupMessage{})
+	cs.AddMessage(context.Background(), groups.EncryptedGroupMessage{})
+	if cs.lastError() != store.err {
+		t.Errorf("expected store to be failing with %v, got %v", store.err, cs.lastError())
+	}
+	if failures != 1 {
+		t.Errorf("expected failedFn to be called once when the store started failing, got %d", failures)
+	}
+
+	store.err = nil
+	cs.AddMessage(context.Background(), groups.EncryptedGroupMessage{})
+	if cs.lastError() != nil {
+		t.Errorf("expected store to recover after a successful operation, got %v", cs.lastError())
+	}
+}
+
+func TestExportImportMessages(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	from, to := path.Join(TestDir, "from"), path.Join(TestDir, "to")
+	fromConfig, _ := CreateConfig(from, ServerConfigFile, false, "", false)
+	toConfig, _ := CreateConfig(to, ServerConfigFile, false, "", false)
+	addStoredMessages(t, from, 0, 5)
+	addStoredMessages(t, to, 3, 5)
+
+	fromServer, toServer := newServer(fromConfig, nil), newServer(toConfig, nil)
+	defer fromServer.Destroy()
+	defer toServer.Destroy()
+	var export bytes.Buffer
+	if count, err := fromServer.ExportMessages(&export); err != nil || count != 5 {
+		t.Fatalf("expected 5 messages to be exported, got %d: %v", count, err)
+	}
+	result, err := toServer.ImportMessages(&export)
+	if err != nil || result.Imported != 3 || result.Duplicates != 2 {
+		t.Errorf("expected 3 messages to be imported and 2 duplicates skipped, got %+v: %v", result, err)
+	}
+	if count := storedMessages(t, to); count != 8 {
+		t.Errorf("expected the stores to be merged into 8 messages, got %d", count)
+	}
+}
+
+func TestImportMessagesRunning(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	from, to := path.Join(TestDir, "from"), path.Join(TestDir, "to")
+	fromConfig, _ := CreateConfig(from, ServerConfigFile, false, "", false)
+	toConfig, _ := CreateConfig(to, ServerConfigFile, false, "", false)
+	// more than a page of new messages
+	imported := 3*newMessagesPageSize + 10
+	addStoredMessages(t, from, 0, imported)
+	addStoredMessages(t, to, imported, 5)
+
+	fromServer, toServer := newServer(fromConfig, nil), newServer(toConfig, nil)
+	defer fromServer.Destroy()
+	defer toServer.Destroy()
+	var export bytes.Buffer
+	if _, err := fromServer.ExportMessages(&export); err != nil {
+		t.Fatalf("could not export messages: %v", err)
+	}
+	if err := toServer.Run(connectivity.NewLocalACN()); err != nil {
+		t.Fatalf("could not run server: %v", err)
+	}
+	listener := newTestSubscriber(toServer.messageStore, false)
+	toServer.fanout.subscribe(listener)
+
+	// imported messages are sent to listening clients like posted ones
+	if result, err := toServer.ImportMessages(&export); err != nil || result.Imported != imported {
+		t.Fatalf("expected %d messages to be imported, got %+v: %v", imported, result, err)
+	}
+	last, _ := toServer.messageStore.LastSequence(context.Background())
+	listener.waitForSequences(t, last-int64(imported)+1, last)
+}
+
+func TestServerStorageUsage(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	s := newServer(config, nil)
+	defer s.Destroy()
+
+	// a stopped server has no message counts, but its cap can still be changed
+	if usage, err := s.GetStorageUsage(); err != nil || usage.Messages != 0 || usage.MaxStorageMBs != -1 || usage.MaxMessages != -1 {
+		t.Errorf("expected the unlimited usage of a stopped server, got %+v %v", usage, err)
+	}
+	if _, err := s.PreviewMaxStorageMBs(1); err == nil {
+		t.Errorf("expected previewing the cap of a stopped server to fail")
+	}
+	if err := s.SetMaxStorageMBs(0); err == nil {
+		t.Errorf("expected a cap of 0 MBs to be rejected")
+	}
+	if err := s.SetMaxStorageMBs(2); err != nil {
+		t.Fatalf("could not set the cap of a stopped server: %v", err)
+	}
+	if saved, _ := LoadConfig(TestDir, ServerConfigFile, false, ""); saved.GetMaxMessageMBs() != 2 {
+		t.Errorf("expected the cap to be saved, got %d", saved.GetMaxMessageMBs())
+	}
+
+	if err := s.Run(connectivity.NewLocalACN()); err != nil {
+		t.Fatalf("could not run server: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := s.messageStore.AddMessage(context.Background(), groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")}); err != nil {
+			t.Fatalf("could not add message: %v", err)
+		}
+	}
+	if usage, err := s.GetStorageUsage(); err != nil || usage.Messages != 300 || usage.MaxMessages != 2*MessagesPerMB || usage.DatabaseBytes == 0 {
+		t.Errorf("expected 300 messages of 500 to be stored, got %+v %v", usage, err)
+	}
+	// 50 messages over the cap, and 10% of the cap
+	if pruned, err := s.PreviewMaxStorageMBs(1); err != nil || pruned != 75 {
+		t.Errorf("expected 75 messages to be pruned by a cap of 1 MB, got %d %v", pruned, err)
+	}
+	if usage, _ := s.GetStorageUsage(); usage.Messages != 300 || usage.MaxStorageMBs != 2 {
+		t.Errorf("expected a preview not to change the storage, got %+v", usage)
+	}
+	if err := s.SetMaxStorageMBs(1); err != nil {
+		t.Fatalf("could not set the cap of a running server: %v", err)
+	}
+	if usage, err := s.GetStorageUsage(); err != nil || usage.Messages != 225 || usage.MaxMessages != MessagesPerMB {
+		t.Errorf("expected a lower cap to prune 75 messages, got %+v %v", usage, err)
+	}
+	if saved, _ := LoadConfig(TestDir, ServerConfigFile, false, ""); saved.GetMaxMessageMBs() != 1 {
+		t.Errorf("expected the cap to be saved, got %d", saved.GetMaxMessageMBs())
+	}
+
+	s.Stop()
+	if usage, err := s.GetStorageUsage(); err != nil || usage.Messages != 0 || usage.MaxStorageMBs != 1 || usage.DatabaseBytes == 0 {
+		t.Errorf("expected the database size of a stopped server, got %+v %v", usage, err)
+	}
+}
@@ -1,29 +1,82 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"cwtch.im/cwtch/protocol/groups"
+	"encoding/base64"
 	"encoding/json"
 	"git.openprivacy.ca/cwtch.im/server/storage"
 	"git.openprivacy.ca/cwtch.im/tapir"
 	"git.openprivacy.ca/cwtch.im/tapir/applications"
 	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
 	"git.openprivacy.ca/openprivacy/log"
+	"sync"
+	"time"
 )
 
 // NewTokenBoardServer generates new Server for Token Board
 func NewTokenBoardServer(store storage.MessageStoreInterface, tokenService *privacypass.TokenServer) tapir.Application {
+	return newTokenBoardServer(store, tokenService, tokenboardEnv{})
+}
+
+// tokenboardEnv connects a TokenboardServer to the server running it
+type tokenboardEnv struct {
+	// ctx is used for storage operations and is cancelled when the server stops
+	ctx    context.Context
+	drain  *drainGroup
+	limits *tokenboardLimits
+	emit   eventEmitter
+	fanout *fanout
+	// tokens spends the tokens of posts, by default the TokenService
+	tokens tokenSpender
+	// spentFn is called with the result of every attempt to spend a token
+	spentFn func(err error)
+}
+
+// newTokenBoardServer generates a new Server for Token Board in env, filling in defaults for any unset parts of env
+func newTokenBoardServer(store storage.MessageStoreInterface, tokenService *privacypass.TokenServer, env tokenboardEnv) tapir.Application {
+	if env.ctx == nil {
+		env.ctx = context.Background()
+	}
+	if env.drain == nil {
+		env.drain = newDrainGroup()
+	}
+	if env.limits == nil {
+		env.limits = newTokenboardLimits(RateLimits{}, MessageLimits{}, nil, nil)
+	}
+	if env.emit == nil {
+		env.emit = func(EventType, map[string]string) {}
+	}
+	if env.tokens == nil {
+		env.tokens = tokenService
+	}
+	if env.spentFn == nil {
+		env.spentFn = func(error) {}
+	}
+	if env.fanout == nil {
+		env.fanout = newFanout(env.ctx, store, nil)
+	}
 	tba := new(TokenboardServer)
 	tba.TokenService = tokenService
 	tba.LegacyMessageStore = store
+	tba.tokenboardEnv = env
 	return tba
 }
 
 // TokenboardServer defines the token board server
 type TokenboardServer struct {
 	applications.AuthApp
+	tokenboardEnv
 	connection         tapir.Connection
 	TokenService       *privacypass.TokenServer
 	LegacyMessageStore storage.MessageStoreInterface
+	connectionLimits   *connectionLimits
+
+	// syncLock guards synced and highWater, and is held while sending new messages so they are sent in order
+	syncLock  sync.Mutex
+	synced    bool
+	highWater int64
 }
 
 // NewInstance creates a new TokenBoardApp
@@ -31,12 +84,19 @@ func (ta *TokenboardServer) NewInstance() tapir.Application {
 	tba := new(TokenboardServer)
 	tba.TokenService = ta.TokenService
 	tba.LegacyMessageStore = ta.LegacyMessageStore
+	tba.tokenboardEnv = ta.tokenboardEnv
+	tba.connectionLimits = ta.limits.connectionLimits()
 	return tba
 }
 
 // Init initializes the cryptographic TokenBoardApp
 func (ta *TokenboardServer) Init(connection tapir.Connection) {
 	ta.AuthApp.Init(connection)
+	// the server is shutting down so refuse new connections
+	if ta.drain.isDraining() {
+		connection.Close()
+		return
+	}
 	if connection.HasCapability(applications.AuthCapability) {
 		ta.connection = connection
 		go ta.Listen()
@@ -47,6 +107,7 @@ func (ta *TokenboardServer) Init(connection tapir.Connection) {
 
 // Listen processes the messages for this application
 func (ta *TokenboardServer) Listen() {
+	defer ta.fanout.unsubscribe(ta)
 	for {
 		data := ta.connection.Expect()
 		if len(data) == 0 {
@@ -55,73 +116,257 @@ func (ta *TokenboardServer) Listen() {
 			return // connection is closed
 		}
 
-		var message groups.Message
+		var message Message
 		if err := json.Unmarshal(data, &message); err != nil {
 			log.Debugf("server Closing Connection Because of Malformed Client Packet %v", err)
 			ta.connection.Close()
 			return // connection is closed
 		}
 
-		switch message.MessageType {
-		case groups.PostRequestMessage:
-			if message.PostRequest != nil {
-				postrequest := *message.PostRequest
-				log.Debugf("Received a Post Message Request: %v", ta.connection.Hostname())
-				ta.postMessageRequest(postrequest)
-			} else {
-				log.Debugf("server Closing Connection Because of PostRequestMessage Client Packet")
-				ta.connection.Close()
-				return // connection is closed
+		if !ta.handle(message) {
+			ta.connection.Close()
+			return // connection is closed
+		}
+	}
+}
+
+// handle processes a single client message as an in-flight request that a shutting down server will wait for.
+// returns false if the connection should be closed
+func (ta *TokenboardServer) handle(message Message) bool {
+	if !ta.drain.begin() {
+		log.Debugf("server Closing Connection Because the Server is Shutting Down")
+		return false
+	}
+	defer ta.drain.end()
+
+	switch message.MessageType {
+	case groups.PostRequestMessage:
+		if message.PostRequest != nil {
+			postrequest := *message.PostRequest
+			log.Debugf("Received a Post Message Request: %v", ta.connection.Hostname())
+			ta.postMessageRequest(postrequest)
+		} else {
+			log.Debugf("server Closing Connection Because of PostRequestMessage Client Packet")
+			return false
+		}
+	case groups.ReplayRequestMessage:
+		if message.ReplayRequest != nil {
+			log.Debugf("Received Replay Request %v", message.ReplayRequest)
+			if !ta.connectionLimits.allowReplay() {
+				log.Debugf("server Closing Connection Because of Exceeding Replay Rate Limits")
+				return false
 			}
-		case groups.ReplayRequestMessage:
-			if message.ReplayRequest != nil {
-				log.Debugf("Received Replay Request %v", message.ReplayRequest)
-				messages := ta.LegacyMessageStore.FetchMessagesFrom(message.ReplayRequest.LastCommit)
-				response, _ := json.Marshal(groups.Message{MessageType: groups.ReplayResultMessage, ReplayResult: &groups.ReplayResult{NumMessages: len(messages)}})
-				log.Debugf("Sending Replay Response %v", groups.ReplayResult{NumMessages: len(messages)})
-				ta.connection.Send(response)
-				lastSignature := message.ReplayRequest.LastCommit
-				for _, message := range messages {
-					lastSignature = message.Signature
-					data, _ = json.Marshal(message)
-					ta.connection.Send(data)
-				}
-				log.Debugf("Finished Requested Sync")
-				// Set sync and then send any new messages that might have happened while we were syncing
-				ta.connection.SetCapability(groups.CwtchServerSyncedCapability)
-				// Because we have set the sync capability any new messages that arrive after this point will just
-				// need to do a basic lookup from the last seen message
-				newMessages := ta.LegacyMessageStore.FetchMessagesFrom(lastSignature)
-				for _, message := range newMessages {
-					data, _ = json.Marshal(groups.Message{MessageType: groups.NewMessageMessage, NewMessage: &groups.NewMessage{EGM: *message}})
-					ta.connection.Send(data)
-				}
-			} else {
-				log.Debugf("server Closing Connection Because of Malformed ReplayRequestMessage Packet")
-				ta.connection.Close()
-				return // connection is closed
+			if !ta.replay(*message.ReplayRequest) {
+				return false
 			}
+		} else {
+			log.Debugf("server Closing Connection Because of Malformed ReplayRequestMessage Packet")
+			return false
 		}
 	}
+	return true
 }
 
-func (ta *TokenboardServer) postMessageRequest(pr groups.PostRequest) {
-	if err := ta.TokenService.SpendToken(pr.Token, append(pr.EGM.ToBytes(), ta.connection.ID().Hostname()...)); err == nil {
+// replay sends the client every message since request.LastCommit (or within the request's bounds), compressed if the
+// request asks for compression, and then sends it new messages as they are stored. returns false if the
+// connection should be closed
+func (ta *TokenboardServer) replay(request ReplayRequest) bool {
+	// new messages are held back until the replay has been sent
+	ta.fanout.subscribe(ta)
+	ta.syncLock.Lock()
+	ta.synced = false
+	ta.syncLock.Unlock()
 
-		// ignore messages with no signatures
-		if len(pr.EGM.Signature) == 0 {
-			return
+	// every message stored after this is either in the replay or sent once the replay is done
+	highWater, err := ta.LegacyMessageStore.LastSequence(ta.ctx)
+	if err != nil {
+		log.Errorf("server Closing Connection Because Replay Failed: %v", err)
+		return false
+	}
+	lastCommit := request.LastCommit
+	var messages []*storage.StoredMessage
+	if request.bounded() {
+		var since time.Time
+		if request.Since > 0 {
+			since = time.Unix(request.Since, 0)
 		}
+		messages, err = ta.LegacyMessageStore.FetchMessagesBounded(ta.ctx, since, request.Limit)
+	} else {
+		messages, err = ta.LegacyMessageStore.FetchMessagesFrom(ta.ctx, lastCommit)
+	}
+	if err != nil {
+		log.Errorf("server Closing Connection Because Replay Failed: %v", err)
+		return false
+	}
+	// replays always run to the newest message
+	if len(messages) > 0 {
+		highWater = messages[len(messages)-1].Sequence
+	}
+	ta.connectionLimits.replayed(len(messages))
+	// the store replays from lastCommit if it has it, otherwise everything it has
+	truncated := len(lastCommit) > 0 && (len(messages) == 0 || !bytes.Equal(messages[0].Signature, lastCommit)) && ta.LegacyMessageStore.WasPruned(lastCommit)
+	replayResult := ReplayResult{ReplayResult: groups.ReplayResult{NumMessages: len(messages)}, Truncated: truncated}
 
+	if request.Compression == ReplayCompressionGzip {
+		egms := make([]*groups.EncryptedGroupMessage, len(messages))
+		for i, message := range messages {
+			egms[i] = &message.EncryptedGroupMessage
+		}
+		frames, err := EncodeReplayFrames(egms)
+		if err != nil {
+			log.Errorf("server Closing Connection Because Replay Failed: %v", err)
+			return false
+		}
+		replayResult.Compression = ReplayCompressionGzip
+		ta.sendReplayResult(replayResult)
+		for _, frame := range frames {
+			ta.connection.Send(frame)
+		}
+	} else {
+		ta.sendReplayResult(replayResult)
+		for _, message := range messages {
+			data, _ := json.Marshal(message.EncryptedGroupMessage)
+			ta.connection.Send(data)
+		}
+	}
+	log.Debugf("Finished Requested Sync")
+	ta.connection.SetCapability(groups.CwtchServerSyncedCapability)
+
+	// send any new messages that were stored during the replay, and start sending them as they are stored
+	ta.syncLock.Lock()
+	defer ta.syncLock.Unlock()
+	ta.highWater = highWater
+	if err := ta.sendNewMessages(); err != nil {
+		log.Errorf("server Closing Connection Because Replay Failed: %v", err)
+		return false
+	}
+	ta.synced = true
+	return true
+}
+
+// deliver sends a new message from the fanout to a synced client, unless it has already been sent
+func (ta *TokenboardServer) deliver(message *storage.StoredMessage) {
+	ta.syncLock.Lock()
+	defer ta.syncLock.Unlock()
+	// messages that arrive during a replay are sent by the replay
+	if !ta.synced || message.Sequence <= ta.highWater {
+		return
+	}
+	if err := ta.sendNewMessage(message); err != nil {
+		log.Debugf("could not send new message: %v", err)
+	}
+}
+
+// catchUp sends a synced client every message after the last one it was sent, after it fell behind the fanout
+func (ta *TokenboardServer) catchUp() {
+	ta.syncLock.Lock()
+	defer ta.syncLock.Unlock()
+	// a client that is replaying is sent everything once the replay is done
+	if !ta.synced {
+		return
+	}
+	log.Debugf("Catching up Slow Consumer %v", ta.connection.Hostname())
+	if err := ta.sendNewMessages(); err != nil {
+		log.Errorf("server Closing Connection Because Catching Up Failed: %v", err)
+		ta.connection.Close()
+	}
+}
+
+// disconnect closes the connection of a client that can't keep up with new messages, which ends any send it is
+// blocked in
+func (ta *TokenboardServer) disconnect() {
+	log.Infof("server Closing Connection to Slow Consumer %v", ta.connection.Hostname())
+	ta.connection.Close()
+}
+
+// sendNewMessages sends every message after the high-water mark to the client, fetching them a page at a time.
+// syncLock must be held
+func (ta *TokenboardServer) sendNewMessages() error {
+	for {
+		messages, err := ta.LegacyMessageStore.FetchMessagesAfter(ta.ctx, ta.highWater, newMessagesPageSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if err := ta.sendNewMessage(message); err != nil {
+				return err
+			}
+		}
+		if len(messages) < newMessagesPageSize {
+			return nil
+		}
+	}
+}
+
+// sendNewMessage sends message to the client and advances the high-water mark. syncLock must be held
+func (ta *TokenboardServer) sendNewMessage(message *storage.StoredMessage) error {
+	data, _ := json.Marshal(groups.Message{MessageType: groups.NewMessageMessage, NewMessage: &groups.NewMessage{EGM: message.EncryptedGroupMessage}})
+	if err := ta.connection.Send(data); err != nil {
+		return err
+	}
+	ta.highWater = message.Sequence
+	return nil
+}
+
+func (ta *TokenboardServer) sendReplayResult(replayResult ReplayResult) {
+	response, _ := json.Marshal(Message{Message: groups.Message{MessageType: groups.ReplayResultMessage}, ReplayResult: &replayResult})
+	log.Debugf("Sending Replay Response %v", replayResult)
+	ta.connection.Send(response)
+}
+
+func (ta *TokenboardServer) postMessageRequest(pr groups.PostRequest) {
+	// check rate limits and the message before spending the token so a rejected client can use it again
+	if !ta.connectionLimits.allowPost() {
+		log.Debugf("Post rejected because of exceeding post rate limits")
+		ta.sendPostResult(false, PostRejectedRateLimited)
+		return
+	}
+	if reason := ta.limits.checkMessage(pr.EGM); reason != "" {
+		log.Debugf("Post rejected: %v", reason)
+		ta.sendPostResult(false, reason)
+		return
+	}
+
+	// a repost of a stored message (e.g. a client retrying after a lost PostResult) succeeds without spending the
+	// token, and isn't broadcast again as synced clients already have it
+	exists, err := ta.LegacyMessageStore.MessageExists(ta.ctx, pr.EGM.Signature)
+	if err != nil {
+		ta.sendPostResult(false, PostRejectedStorageError)
+		return
+	}
+	if exists {
+		log.Debugf("Duplicate post, message is already stored")
+		ta.sendPostResult(true, "")
+		return
+	}
+
+	err = ta.tokens.SpendToken(pr.Token, append(pr.EGM.ToBytes(), ta.connection.ID().Hostname()...))
+	ta.spentFn(err)
+	if err == nil {
 		log.Debugf("Token is valid")
-		ta.LegacyMessageStore.AddMessage(pr.EGM)
-		data, _ := json.Marshal(groups.Message{MessageType: groups.PostResultMessage, PostResult: &groups.PostResult{Success: true}})
-		ta.connection.Send(data)
-		data, _ = json.Marshal(groups.Message{MessageType: groups.NewMessageMessage, NewMessage: &groups.NewMessage{EGM: pr.EGM}})
-		ta.connection.Broadcast(data, groups.CwtchServerSyncedCapability)
+		switch err := ta.LegacyMessageStore.AddMessage(ta.ctx, pr.EGM); err {
+		case nil:
+		case storage.ErrDuplicateMessage:
+			// posted concurrently by another connection since the check above
+			ta.sendPostResult(true, "")
+			return
+		default:
+			log.Errorf("could not store message: %v", err)
+			ta.sendPostResult(false, PostRejectedStorageError)
+			return
+		}
+		ta.emit(EventMessageStored, map[string]string{FieldSignature: base64.StdEncoding.EncodeToString(pr.EGM.Signature)})
+		ta.sendPostResult(true, "")
+		ta.fanout.notify()
 	} else {
 		log.Debugf("Attempt to spend an invalid token: %v", err)
-		data, _ := json.Marshal(groups.Message{MessageType: groups.PostResultMessage, PostResult: &groups.PostResult{Success: false}})
-		ta.connection.Send(data)
+		ta.emit(EventTokenSpendRejected, map[string]string{FieldError: err.Error()})
+		ta.sendPostResult(false, PostRejectedInvalidToken)
 	}
 }
+
+// sendPostResult sends a PostResult, with the reason for failure if unsuccessful
+func (ta *TokenboardServer) sendPostResult(success bool, reason string) {
+	data, _ := json.Marshal(Message{Message: groups.Message{MessageType: groups.PostResultMessage}, PostResult: &PostResult{PostResult: groups.PostResult{Success: success}, Reason: reason}})
+	ta.connection.Send(data)
+}
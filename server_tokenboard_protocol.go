@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The tokenboard protocol is defined by cwtch.im/cwtch/protocol/groups. The types here extend its messages with
+// optional fields, which clients that don't know about them ignore.
+
+// Reasons a PostResult can be unsuccessful
+const (
+	PostRejectedInvalidToken     = "invalid-token"
+	PostRejectedRateLimited      = "rate-limited"
+	PostRejectedMissingSignature = "missing-signature"
+	PostRejectedEmptyCiphertext  = "empty-ciphertext"
+	PostRejectedSignatureSize    = "signature-too-large"
+	PostRejectedCiphertextSize   = "ciphertext-too-large"
+	PostRejectedStorageError     = "storage-error"
+)
+
+// PostResult extends groups.PostResult with the reason a post was rejected
+type PostResult struct {
+	groups.PostResult
+	Reason string `json:",omitempty"`
+}
+
+// ReplayCompressionGzip is the only supported ReplayRequest.Compression. Each frame of a gzip replay is a gzip
+// compressed JSON array of groups.EncryptedGroupMessage
+const ReplayCompressionGzip = "gzip"
+
+// maxReplayFrameBytes is the largest compressed replay frame the server will build, keeping frames under tapir's
+// maximum message length. A single message that doesn't compress under it is sent in a frame of its own.
+const maxReplayFrameBytes = 7 * 1024
+
+// maxReplayFrameMessages is the most messages the server puts in one replay frame
+const maxReplayFrameMessages = 1000
+
+// maxReplayFrameDataBytes bounds the decompressed size of a replay frame: maxReplayFrameMessages messages, each no
+// larger than the tapir message (of at most tapirMaxMessageBytes) it would be sent in by an uncompressed replay
+const (
+	tapirMaxMessageBytes    = 8 * 1024
+	maxReplayFrameDataBytes = maxReplayFrameMessages * tapirMaxMessageBytes
+)
+
+// ReplayRequest extends groups.ReplayRequest to opt in to a compressed replay, in which many messages are sent in
+// each frame (only replays that ask for compression are compressed), and to bound a replay without a LastCommit (e.g. for a client joining a long lived group) to the last
+// Limit messages and/or the messages stored since Since (unix seconds). Bounds are ignored if LastCommit is set.
+type ReplayRequest struct {
+	groups.ReplayRequest
+	Compression string `json:",omitempty"`
+	Limit       int    `json:",omitempty"`
+	Since       int64  `json:",omitempty"`
+}
+
+// bounded returns true if the request is for a bounded replay
+func (rr ReplayRequest) bounded() bool {
+	return len(rr.LastCommit) == 0 && (rr.Limit > 0 || rr.Since > 0)
+}
+
+// ReplayResult extends groups.ReplayResult to say that the requested LastCommit has been pruned, so the replay starts
+// from the oldest message the server still has and any messages in between are lost
+// ReplayResult.Compression confirms that the NumMessages messages that follow are compressed
+type ReplayResult struct {
+	groups.ReplayResult
+	Truncated   bool   `json:",omitempty"`
+	Compression string `json:",omitempty"`
+}
+
+// Message extends groups.Message with the extended result types
+type Message struct {
+	groups.Message
+	ReplayRequest *ReplayRequest `json:",omitempty"`
+	PostResult    *PostResult    `json:",omitempty"`
+	ReplayResult  *ReplayResult  `json:",omitempty"`
+}
+
+// EncodeReplayFrames encodes messages as gzip replay frames of up to maxReplayFrameBytes and maxReplayFrameMessages
+// each
+func EncodeReplayFrames(messages []*groups.EncryptedGroupMessage) ([][]byte, error) {
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	if len(messages) <= maxReplayFrameMessages {
+		frame, err := encodeReplayFrame(messages)
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) <= maxReplayFrameBytes || len(messages) == 1 {
+			return [][]byte{frame}, nil
+		}
+	}
+	// too big, so split the messages between two (or more) frames
+	first, err := EncodeReplayFrames(messages[:len(messages)/2])
+	if err != nil {
+		return nil, err
+	}
+	rest, err := EncodeReplayFrames(messages[len(messages)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, rest...), nil
+}
+
+func encodeReplayFrame(messages []*groups.EncryptedGroupMessage) ([]byte, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	var frame bytes.Buffer
+	zw := gzip.NewWriter(&frame)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return frame.Bytes(), nil
+}
+
+// DecodeReplayFrame decodes the messages in a gzip replay frame. Frames that decompress to more than
+// maxReplayFrameDataBytes, hold no messages or more than maxReplayFrameMessages, or have a null message are rejected
+func DecodeReplayFrame(frame []byte) ([]*groups.EncryptedGroupMessage, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, maxReplayFrameDataBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReplayFrameDataBytes {
+		return nil, fmt.Errorf("replay frame decompresses to more than %d bytes", maxReplayFrameDataBytes)
+	}
+	var messages []*groups.EncryptedGroupMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("replay frame has no messages")
+	} else if len(messages) > maxReplayFrameMessages {
+		return nil, fmt.Errorf("replay frame has %d messages, more than %d", len(messages), maxReplayFrameMessages)
+	}
+	for _, message := range messages {
+		if message == nil {
+			return nil, errors.New("replay frame has a null message")
+		}
+	}
+	return messages, nil
+}
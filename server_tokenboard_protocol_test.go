@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/json"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReplayFrames(t *testing.T) {
+	var messages []*groups.EncryptedGroupMessage
+	for i := 0; i < 500; i++ {
+		// random ciphertexts don't compress, so the messages need several frames
+		ciphertext := make([]byte, 100)
+		rand.Read(ciphertext)
+		messages = append(messages, &groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: ciphertext})
+	}
+
+	frames, err := EncodeReplayFrames(messages)
+	if err != nil {
+		t.Fatalf("could not encode replay frames: %v", err)
+	}
+	if len(frames) < 2 {
+		t.Errorf("expected messages to be split between frames, got %d frames", len(frames))
+	}
+	var decoded []*groups.EncryptedGroupMessage
+	for _, frame := range frames {
+		if len(frame) > maxReplayFrameBytes {
+			t.Errorf("frame of %d bytes is over the maximum frame size", len(frame))
+		}
+		frameMessages, err := DecodeReplayFrame(frame)
+		if err != nil {
+			t.Fatalf("could not decode replay frame: %v", err)
+		}
+		decoded = append(decoded, frameMessages...)
+	}
+	if len(decoded) != len(messages) {
+		t.Fatalf("expected %d messages, decoded %d", len(messages), len(decoded))
+	}
+	for i := range messages {
+		if !bytes.Equal(decoded[i].Signature, messages[i].Signature) || !bytes.Equal(decoded[i].Ciphertext, messages[i].Ciphertext) {
+			t.Fatalf("message %d was not decoded in order", i)
+		}
+	}
+
+	if frames, err := EncodeReplayFrames(nil); len(frames) != 0 || err != nil {
+		t.Errorf("expected no frames for no messages: %v", err)
+	}
+	if _, err := DecodeReplayFrame([]byte("not gzip")); err == nil {
+		t.Errorf("expected an error decoding an invalid frame")
+	}
+
+	// small messages compress well, but are still split to bound the size of a decompressed frame
+	var small []*groups.EncryptedGroupMessage
+	for i := 0; i < maxReplayFrameMessages+1; i++ {
+		small = append(small, &groups.EncryptedGroupMessage{Signature: []byte{byte(i)}, Ciphertext: []byte("a")})
+	}
+	if frames, err := EncodeReplayFrames(small); err != nil || len(frames) != 2 {
+		t.Errorf("expected %d messages to be split between 2 frames, got %d %v", len(small), len(frames), err)
+	}
+	tooMany, _ := encodeReplayFrame(small)
+	if _, err := DecodeReplayFrame(tooMany); err == nil {
+		t.Errorf("expected a frame of more than %d messages to be rejected", maxReplayFrameMessages)
+	}
+	bomb, _ := encodeReplayFrame([]*groups.EncryptedGroupMessage{{Signature: []byte("signature"), Ciphertext: make([]byte, maxReplayFrameDataBytes)}})
+	if _, err := DecodeReplayFrame(bomb); err == nil {
+		t.Errorf("expected a frame that decompresses to more than %d bytes to be rejected", maxReplayFrameDataBytes)
+	}
+}
+
+func TestReplayCompressionOptIn(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	store, err := storage.InitializeSqliteMessageStore(path.Join(TestDir, messageStoreFile), -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open message store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		store.AddMessage(context.Background(), *peerMessage(i))
+	}
+	app := newTokenBoardServer(store, nil, tokenboardEnv{}).NewInstance().(*TokenboardServer)
+	defer app.fanout.close()
+
+	// only replays that ask for compression are compressed, even on a connection that has asked before
+	for _, compression := range []string{ReplayCompressionGzip, "", "zstd"} {
+		conn := &scriptedConnection{}
+		app.connection = conn
+		if !app.replay(ReplayRequest{Compression: compression}) {
+			t.Fatalf("could not replay")
+		}
+		var result Message
+		if len(conn.sent) == 0 || json.Unmarshal(conn.sent[0], &result) != nil || result.ReplayResult == nil {
+			t.Fatalf("expected a replay result to be sent")
+		}
+		expected, frames := "", 3
+		if compression == ReplayCompressionGzip {
+			expected, frames = ReplayCompressionGzip, 1
+		}
+		if result.ReplayResult.Compression != expected || len(conn.sent) != 1+frames {
+			t.Errorf("expected a replay asking for %q compression to be sent with %q compression in %d frames, got %q in %d", compression, expected, frames, result.ReplayResult.Compression, len(conn.sent)-1)
+		}
+	}
+}
+
+func TestReplayRequestCompatibility(t *testing.T) {
+	// legacy requests decode without compression, and legacy clients can decode extended results
+	var message Message
+	legacy, _ := json.Marshal(groups.Message{MessageType: groups.ReplayRequestMessage, ReplayRequest: &groups.ReplayRequest{LastCommit: []byte("commit")}})
+	if err := json.Unmarshal(legacy, &message); err != nil || message.ReplayRequest == nil {
+		t.Fatalf("could not decode legacy replay request: %v", err)
+	}
+	if message.ReplayRequest.Compression != "" || !bytes.Equal(message.ReplayRequest.LastCommit, []byte("commit")) {
+		t.Errorf("legacy replay request was not decoded correctly: %v", message.ReplayRequest)
+	}
+
+	result, _ := json.Marshal(Message{Message: groups.Message{MessageType: groups.ReplayResultMessage}, ReplayResult: &ReplayResult{ReplayResult: groups.ReplayResult{NumMessages: 5}, Compression: ReplayCompressionGzip}})
+	var legacyMessage groups.Message
+	if err := json.Unmarshal(result, &legacyMessage); err != nil || legacyMessage.ReplayResult == nil || legacyMessage.ReplayResult.NumMessages != 5 {
+		t.Errorf("legacy client could not decode replay result: %v", err)
+	}
+}
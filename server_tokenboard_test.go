@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/server/metrics"
+	"git.openprivacy.ca/cwtch.im/server/storage"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientConnection is an authenticated client connection to a TokenboardServer that records what it is sent
+type clientConnection struct {
+	tapir.Connection
+	id     primitives.Identity
+	lock   sync.Mutex
+	sent   [][]byte
+	closed bool
+	// blocked holds up sends until it is closed by unblock
+	blocked chan bool
+}
+
+func newClientConnection() *clientConnection {
+	id, _ := primitives.InitializeEphemeralIdentity()
+	return &clientConnection{id: id}
+}
+
+func (cc *clientConnection) Hostname() string {
+	return cc.id.Hostname()
+}
+
+func (cc *clientConnection) ID() *primitives.Identity {
+	return &cc.id
+}
+
+func (cc *clientConnection) SetCapability(capability tapir.Capability) {}
+
+func (cc *clientConnection) Send(message []byte) error {
+	cc.lock.Lock()
+	blocked := cc.blocked
+	cc.lock.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.closed {
+		return errors.New("connection is closed")
+	}
+	cc.sent = append(cc.sent, message)
+	return nil
+}
+
+func (cc *clientConnection) Close() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.closed = true
+}
+
+// block holds up sends on the connection, as if the client's circuit stalled
+func (cc *clientConnection) block() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.blocked = make(chan bool)
+}
+
+func (cc *clientConnection) unblock() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	close(cc.blocked)
+	cc.blocked = nil
+}
+
+func (cc *clientConnection) isClosed() bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.closed
+}
+
+// received returns the PostResults, and the signatures of the replayed and new messages, sent on the connection
+func (cc *clientConnection) received() (results []PostResult, replayed []string, newMessages []string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	for _, data := range cc.sent {
+		var message Message
+		json.Unmarshal(data, &message)
+		switch {
+		case message.PostResult != nil:
+			results = append(results, *message.PostResult)
+		case message.ReplayResult != nil:
+		case message.NewMessage != nil:
+			newMessages = append(newMessages, string(message.NewMessage.EGM.Signature))
+		default:
+			var egm groups.EncryptedGroupMessage
+			json.Unmarshal(data, &egm)
+			replayed = append(replayed, string(egm.Signature))
+		}
+	}
+	return
+}
+
+// lastPostResult returns the last PostResult sent on the connection
+func (cc *clientConnection) lastPostResult(t *testing.T) PostResult {
+	t.Helper()
+	results, _, _ := cc.received()
+	if len(results) == 0 {
+		t.Fatalf("expected a post result to be sent")
+	}
+	return results[len(results)-1]
+}
+
+// testSpender accepts every token once, and records the tokens spent
+type testSpender struct {
+	lock  sync.Mutex
+	spent map[*privacypass.SpentToken]bool
+}
+
+func (ts *testSpender) SpendToken(token *privacypass.SpentToken, data []byte) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.spent == nil {
+		ts.spent = make(map[*privacypass.SpentToken]bool)
+	}
+	if ts.spent[token] {
+		return errTokenSpent
+	}
+	ts.spent[token] = true
+	return nil
+}
+
+func (ts *testSpender) spends() int {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return len(ts.spent)
+}
+
+// newTestTokenboard opens a message store in TestDir and returns a TokenboardServer using it in env, with tokens
+// spent by a testSpender unless env has a spender
+func newTestTokenboard(t *testing.T, env tokenboardEnv) (*TokenboardServer, storage.MessageStoreInterface) {
+	t.Helper()
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	t.Cleanup(func() { os.RemoveAll(TestDir) })
+	store, err := storage.InitializeSqliteMessageStore(path.Join(TestDir, messageStoreFile), -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open message store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if env.tokens == nil {
+		env.tokens = new(testSpender)
+	}
+	tokenboard := newTokenBoardServer(store, nil, env).(*TokenboardServer)
+	t.Cleanup(tokenboard.fanout.close)
+	return tokenboard, store
+}
+
+// connectClient returns a new instance of tokenboard for a client connection
+func connectClient(ta *TokenboardServer) (*TokenboardServer, *clientConnection) {
+	instance := ta.NewInstance().(*TokenboardServer)
+	connection := newClientConnection()
+	instance.connection = connection
+	return instance, connection
+}
+
+func postMessage(ta *TokenboardServer, token *privacypass.SpentToken, egm groups.EncryptedGroupMessage) bool {
+	return ta.handle(Message{Message: groups.Message{MessageType: groups.PostRequestMessage, PostRequest: &groups.PostRequest{Token: token, EGM: egm}}})
+}
+
+func testMessage(i int) groups.EncryptedGroupMessage {
+	return groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")}
+}
+
+func TestRejectedPost(t *testing.T) {
+	s := new(server)
+	s.metricsPack.RejectedPostCounter = metrics.NewCounter()
+	spender := new(testSpender)
+	tokenboard, store := newTestTokenboard(t, tokenboardEnv{
+		limits: newTokenboardLimits(RateLimits{}, MessageLimits{MaxSignatureBytes: 64, MaxCiphertextBytes: 16}, nil, s.incRejectedPostCount),
+		tokens: spender,
+	})
+	client, connection := connectClient(tokenboard)
+
+	tests := []struct {
+		egm    groups.EncryptedGroupMessage
+		reason string
+	}{
+		{groups.EncryptedGroupMessage{Signature: []byte("oversized"), Ciphertext: make([]byte, 17)}, PostRejectedCiphertextSize},
+		{groups.EncryptedGroupMessage{Signature: []byte("empty")}, PostRejectedEmptyCiphertext},
+	}
+	for _, test := range tests {
+		if !postMessage(client, new(privacypass.SpentToken), test.egm) {
+			t.Fatalf("expected a rejected post to keep the connection open")
+		}
+		if result := connection.lastPostResult(t); result.Success || result.Reason != test.reason {
+			t.Errorf("expected the post to be rejected with %q, got %+v", test.reason, result)
+		}
+	}
+	if spender.spends() != 0 {
+		t.Errorf("expected rejected posts not to spend their tokens, %d were spent", spender.spends())
+	}
+	if count := s.metricsPack.RejectedPostCounter.Count(); count != 2 {
+		t.Errorf("expected 2 rejected posts to be counted, got %d", count)
+	}
+	if sequence, _ := store.LastSequence(context.Background()); sequence != 0 {
+		t.Errorf("expected rejected posts not to be stored")
+	}
+}
+
+// racingStore is a message store that never finds an existing message, as if it was posted concurrently by another
+// connection after the check
+type racingStore struct {
+	storage.MessageStoreInterface
+}
+
+func (rs racingStore) MessageExists(ctx context.Context, signature []byte) (bool, error) {
+	return false, nil
+}
+
+func TestDuplicatePost(t *testing.T) {
+	spender := new(testSpender)
+	// the fanout isn't running, so each notify is left in its wake channel
+	idle := &fanout{subscribers: make(map[fanoutSubscriber]*subscriber), wake: make(chan bool, 1), stop: make(chan bool)}
+	var stored int
+	tokenboard, store := newTestTokenboard(t, tokenboardEnv{tokens: spender, fanout: idle, emit: func(eventType EventType, fields map[string]string) {
+		if eventType == EventMessageStored {
+			stored++
+		}
+	}})
+	client, connection := connectClient(tokenboard)
+	notified := func() bool {
+		select {
+		case <-idle.wake:
+			return true
+		default:
+			return false
+		}
+	}
+
+	first, repost, retried := new(privacypass.SpentToken), new(privacypass.SpentToken), new(privacypass.SpentToken)
+	postMessage(client, first, testMessage(1))
+	if result := connection.lastPostResult(t); !result.Success || spender.spends() != 1 || !notified() {
+		t.Fatalf("expected the first post to be stored, spending its token, got %+v", result)
+	}
+
+	// a repost succeeds without spending its token or notifying synced clients
+	postMessage(client, repost, testMessage(1))
+	if result := connection.lastPostResult(t); !result.Success {
+		t.Errorf("expected a repost to succeed, got %+v", result)
+	}
+	if spender.spends() != 1 {
+		t.Errorf("expected a repost not to spend its token")
+	}
+	if notified() || stored != 1 {
+		t.Errorf("expected a repost not to be sent to synced clients")
+	}
+	// so the token can be used again
+	postMessage(client, repost, testMessage(2))
+	if result := connection.lastPostResult(t); !result.Success || spender.spends() != 2 || !notified() {
+		t.Errorf("expected the token of a repost to be usable again, got %+v", result)
+	}
+
+	// a message stored concurrently, after the check but before it is added, also succeeds without notifying
+	client.LegacyMessageStore = racingStore{store}
+	postMessage(client, retried, testMessage(1))
+	if result := connection.lastPostResult(t); !result.Success {
+		t.Errorf("expected a concurrent repost to succeed, got %+v", result)
+	}
+	if notified() || stored != 2 {
+		t.Errorf("expected a concurrent repost not to be sent to synced clients")
+	}
+	if sequence, _ := store.LastSequence(context.Background()); sequence != 2 {
+		t.Errorf("expected 2 messages to be stored, got %d", sequence)
+	}
+}
+
+// waitForMessages waits for connection to be sent every message in store, and checks that they were sent exactly
+// once and in the order they were stored
+func waitForMessages(t *testing.T, connection *clientConnection, store storage.MessageStoreInterface) {
+	t.Helper()
+	stored, err := store.FetchMessagesAfter(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatalf("could not fetch messages: %v", err)
+	}
+	var received []string
+	deadline := time.Now().Add(10 * time.Second)
+	for len(received) < len(stored) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, replayed, newMessages := connection.received()
+		received = append(replayed, newMessages...)
+	}
+	if len(received) != len(stored) {
+		t.Fatalf("expected %d messages to be sent, got %d", len(stored), len(received))
+	}
+	for i, message := range stored {
+		if received[i] != string(message.Signature) {
+			t.Fatalf("expected message %d to be %q, got %q", i, message.Signature, received[i])
+		}
+	}
+}
+
+// lagging returns true if fs has fallen behind f and not started catching up
+func lagging(f *fanout, fs fanoutSubscriber) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sub, exists := f.subscribers[fs]
+	return exists && sub.lagging
+}
+
+func TestSyncDuringReplay(t *testing.T) {
+	tokenboard, store := newTestTokenboard(t, tokenboardEnv{})
+	for i := 0; i < 50; i++ {
+		store.AddMessage(context.Background(), testMessage(i))
+	}
+	peer, peerConnection := connectClient(tokenboard)
+	post := func(from int, count int) {
+		poster, _ := connectClient(tokenboard)
+		for i := from; i < from+count; i++ {
+			postMessage(poster, new(privacypass.SpentToken), testMessage(i))
+		}
+	}
+
+	// messages are posted while the replay is held up, and while it is sent
+	peerConnection.block()
+	replayed := make(chan bool)
+	go func() {
+		replayed <- peer.handle(Message{Message: groups.Message{MessageType: groups.ReplayRequestMessage}, ReplayRequest: &ReplayRequest{}})
+	}()
+	var posters sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		posters.Add(1)
+		go func(from int) {
+			defer posters.Done()
+			post(from, 25)
+		}(100 + p*25)
+	}
+	post(1000, 10)
+	peerConnection.unblock()
+	posters.Wait()
+	if !<-replayed {
+		t.Fatalf("expected the replay to succeed")
+	}
+	waitForMessages(t, peerConnection, store)
+
+	// messages are posted while the synced client is stalled until it falls behind the fanout, and while it catches up
+	peerConnection.block()
+	post(2000, subscriberQueueSize)
+	next := 3000
+	deadline := time.Now().Add(10 * time.Second)
+	for !lagging(tokenboard.fanout, peer) && time.Now().Before(deadline) {
+		post(next, 1)
+		next++
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !lagging(tokenboard.fanout, peer) {
+		t.Fatalf("expected the stalled client to fall behind the fanout")
+	}
+	peerConnection.unblock()
+	post(4000, 20)
+	waitForMessages(t, peerConnection, store)
+}
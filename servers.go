@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"git.openprivacy.ca/cwtch.im/server/storage"
 	"git.openprivacy.ca/openprivacy/connectivity"
+	"git.openprivacy.ca/openprivacy/connectivity/tor"
 	"git.openprivacy.ca/openprivacy/log"
+	"golang.org/x/crypto/ed25519"
 	"os"
 	"path"
 	"sync"
+	"time"
 )
 
 // Servers is an interface to manage multiple Cwtch servers
@@ -18,6 +21,7 @@ import (
 type Servers interface {
 	LoadServers(password string) ([]string, error)
 	CreateServer(password string) (Server, error)
+	CreateServerWithKeys(password string, keys ImportedKeys) (Server, error)
 
 	GetServer(onion string) Server
 	ListServers() []string
@@ -27,19 +31,37 @@ type Servers interface {
 	StopServer(string)
 	Stop()
 	Destroy()
+
+	Subscribe(eventTypes ...EventType) *Subscription
+
+	RotateServerIdentity(onion string, transition time.Duration) (string, error)
 }
 
 type servers struct {
-	lock      sync.Mutex
-	servers   map[string]Server
-	directory string
-	acn       connectivity.ACN
+	lock         sync.Mutex
+	servers      map[string]Server
+	directory    string
+	acn          connectivity.ACN
+	events       *eventBus
+	acnWatchStop chan bool
 }
 
 // NewServers returns a Servers interface to manage a collection of servers
 // expecting directory: $CWTCH_HOME/servers
 func NewServers(acn connectivity.ACN, directory string) Servers {
-	return &servers{acn: acn, directory: directory, servers: make(map[string]Server)}
+	return &servers{acn: acn, directory: directory, servers: make(map[string]Server), events: newEventBus(nil)}
+}
+
+// Subscribe returns a subscription to events of the given types (or all events if none are given) from every server
+// managed by this Servers, and to ACN status changes
+func (s *servers) Subscribe(eventTypes ...EventType) *Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.acnWatchStop == nil {
+		s.acnWatchStop = make(chan bool)
+		go watchACN(s.acn, s.events, nil, s.acnWatchStop)
+	}
+	return s.events.subscribe(eventTypes...)
 }
 
 // LoadServers will attempt to load any servers in the servers directory that are encrypted with the supplied password
@@ -57,7 +79,7 @@ func (s *servers) LoadServers(password string) ([]string, error) {
 		if err == nil {
 			if _, exists := s.servers[newConfig.Onion()]; !exists {
 				log.Debugf("Loaded config, building server for %s\n", newConfig.Onion())
-				server := NewServer(newConfig)
+				server := newServer(newConfig, s.events)
 				s.servers[server.Onion()] = server
 				loadedServers = append(loadedServers, server.Onion())
 			}
@@ -68,15 +90,26 @@ func (s *servers) LoadServers(password string) ([]string, error) {
 
 // CreateServer creates a new server and stores it, also returns an interface to it
 func (s *servers) CreateServer(password string) (Server, error) {
+	return s.CreateServerWithKeys(password, ImportedKeys{})
+}
+
+// CreateServerWithKeys creates a new server like CreateServer, using the keys set in keys instead of generating them
+func (s *servers) CreateServerWithKeys(password string, keys ImportedKeys) (Server, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if keys.PrivateKey != nil {
+		onion := tor.GetTorV3Hostname(keys.PrivateKey.Public().(ed25519.PublicKey)) + ".onion"
+		if _, exists := s.servers[onion]; exists {
+			return nil, fmt.Errorf("server %v already exists", onion)
+		}
+	}
 	newLocalID := storage.GenerateRandomID()
 	directory := path.Join(s.directory, newLocalID)
-	config, err := CreateConfig(directory, ServerConfigFile, true, password, false)
+	config, err := CreateConfigWithKeys(directory, ServerConfigFile, true, password, false, keys)
 	if err != nil {
 		return nil, err
 	}
-	server := NewServer(config)
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	server := newServer(config, s.events)
 	s.servers[server.Onion()] = server
 	return server, nil
 }
@@ -114,6 +147,23 @@ func (s *servers) DeleteServer(onion string, password string) error {
 	return errors.New("server not found")
 }
 
+// RotateServerIdentity moves the specified server to a new onion identity (see Server.RotateIdentity), after which it
+// is managed under the returned new onion
+func (s *servers) RotateServerIdentity(onion string, transition time.Duration) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	server, exists := s.servers[onion]
+	if !exists {
+		return "", errors.New("server not found")
+	}
+	newOnion, err := server.RotateIdentity(transition)
+	if newOnion != "" && newOnion != onion {
+		delete(s.servers, onion)
+		s.servers[newOnion] = server
+	}
+	return newOnion, err
+}
+
 // LaunchServer Run() the specified server
 func (s *servers) LaunchServer(onion string) {
 	s.lock.Lock()
@@ -148,4 +198,8 @@ func (s *servers) Destroy() {
 	for _, server := range s.servers {
 		server.Destroy()
 	}
+	if s.acnWatchStop != nil {
+		close(s.acnWatchStop)
+		s.acnWatchStop = nil
+	}
 }
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"cwtch.im/cwtch/model"
+	"git.openprivacy.ca/cwtch.im/server/bundle"
 	"git.openprivacy.ca/openprivacy/connectivity"
 	"git.openprivacy.ca/openprivacy/log"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const TestDir = "./serversTest"
@@ -57,3 +61,68 @@ func TestServers(t *testing.T) {
 	servers2.Destroy()
 	os.RemoveAll(TestDir)
 }
+
+func TestRotateServerIdentity(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+
+	acn := connectivity.NewLocalACN()
+	servers := NewServers(acn, TestDir)
+	s, err := servers.CreateServer(DefaultPassword)
+	if err != nil {
+		t.Fatalf("could not create server: %s", err)
+	}
+	previousOnion := s.Onion()
+	if s.EndorsementBundle() != nil {
+		t.Errorf("expected no endorsement from a server that hasn't rotated its identity")
+	}
+
+	onion, err := servers.RotateServerIdentity(previousOnion, time.Hour)
+	if err != nil {
+		t.Fatalf("could not rotate server identity: %v", err)
+	}
+	if onion == previousOnion || onion != s.Onion() {
+		t.Fatalf("expected server to move to a new onion, got %v", onion)
+	}
+	if servers.GetServer(onion) != s || servers.GetServer(previousOnion) != nil {
+		t.Errorf("expected server to be managed under its new onion")
+	}
+	endorsement := s.EndorsementBundle()
+	if endorsement == nil {
+		t.Fatalf("expected an endorsement of the new onion")
+	}
+	if string(endorsement.Keys[model.KeyTypeServerOnion])+".onion" != previousOnion || string(endorsement.Keys[KeyTypeSuccessorOnion])+".onion" != onion {
+		t.Errorf("expected endorsement of %v by %v, got %v", onion, previousOnion, endorsement.Keys)
+	}
+	if err := bundle.Verify(endorsement); err != nil {
+		t.Errorf("expected the endorsement to be signed by the previous onion: %v", err)
+	}
+	tofuBundle, err := s.TofuBundle()
+	if err != nil {
+		t.Fatalf("could not create tofu bundle: %v", err)
+	}
+	decoded, err := bundle.Decode(tofuBundle)
+	if err != nil || decoded.Onion()+".onion" != onion || !decoded.IsTofu() {
+		t.Fatalf("expected a tofu bundle of %v, got %+v %v", onion, decoded, err)
+	}
+	if invite, err := model.ValidateInvite(decoded.Invite); err != nil || invite.ServerHost != decoded.Onion() {
+		t.Errorf("expected an invite to a group on %v, got %+v %v", decoded.Onion(), invite, err)
+	}
+	servers.Destroy()
+
+	// the transition continues after a restart
+	servers2 := NewServers(acn, TestDir)
+	defer servers2.Destroy()
+	if list, _ := servers2.LoadServers(DefaultPassword); len(list) != 1 || list[0] != onion {
+		t.Fatalf("expected to load the server with its new onion, got %v", list)
+	}
+	s2 := servers2.GetServer(onion)
+	if s2.EndorsementBundle() == nil {
+		t.Fatalf("expected the previous identity to be kept")
+	}
+	s2.(*server).checkPreviousIdentity(time.Now().Add(2 * time.Hour))
+	if s2.EndorsementBundle() != nil || strings.Contains(s2.ServerBundle(), previousOnion) {
+		t.Errorf("expected the previous identity to be forgotten once the transition is over")
+	}
+}
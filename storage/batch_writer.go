@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"errors"
+	"sync"
+)
+
+// maxWriteBatch is the most messages a SqliteMessageStore will insert in a single transaction
+const maxWriteBatch = 256
+
+var errStoreClosed = errors.New("message store is closed")
+
+// writeRequest is a message waiting to be written by a batchWriter
+type writeRequest struct {
+	ctx     context.Context
+	message groups.EncryptedGroupMessage
+	result  chan error
+}
+
+// batchWriter serialises writes through a single goroutine. Requests that arrive while a batch is being written are
+// written together in the next batch, so under load many messages share each transaction commit (and fsync).
+type batchWriter struct {
+	requests  chan *writeRequest
+	closed    chan bool
+	done      chan bool
+	closeOnce sync.Once
+	maxBatch  int
+	writeFn   func(batch []*writeRequest) []error
+}
+
+// newBatchWriter starts a batchWriter that writes batches of up to maxBatch requests with writeFn, which returns an
+// error (or nil) for each request in the batch
+func newBatchWriter(maxBatch int, writeFn func(batch []*writeRequest) []error) *batchWriter {
+	bw := &batchWriter{
+		requests: make(chan *writeRequest, maxBatch),
+		closed:   make(chan bool),
+		done:     make(chan bool),
+		maxBatch: maxBatch,
+		writeFn:  writeFn,
+	}
+	go bw.run()
+	return bw
+}
+
+// write queues message to be written and waits for the result
+func (bw *batchWriter) write(ctx context.Context, message groups.EncryptedGroupMessage) error {
+	req := &writeRequest{ctx: ctx, message: message, result: make(chan error, 1)}
+	select {
+	case bw.requests <- req:
+	case <-bw.closed:
+		return errStoreClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-bw.done:
+		// the writer may have stopped before reading the request
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return errStoreClosed
+		}
+	}
+}
+
+func (bw *batchWriter) run() {
+	defer close(bw.done)
+	for {
+		select {
+		case req := <-bw.requests:
+			batch := []*writeRequest{req}
+		collect:
+			for len(batch) < bw.maxBatch {
+				select {
+				case req := <-bw.requests:
+					batch = append(batch, req)
+				default:
+					break collect
+				}
+			}
+			for i, err := range bw.writeFn(batch) {
+				batch[i].result <- err
+			}
+		case <-bw.closed:
+			// fail anything that was queued before close
+			for {
+				select {
+				case req := <-bw.requests:
+					req.result <- errStoreClosed
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close stops the writer once the batch in progress has been written. Later writes return an error
+func (bw *batchWriter) close() {
+	bw.closeOnce.Do(func() {
+		close(bw.closed)
+	})
+	<-bw.done
+}
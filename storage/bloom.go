@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// prunedFilterBits is the size of each generation of the pruned signature filter (128KiB). With
+	// prunedFilterHashes hashes it has a false positive rate of under 1% for prunedGenerationSignatures signatures.
+	prunedFilterBits   = 1 << 20
+	prunedFilterHashes = 7
+	// prunedGenerationSignatures is how many signatures are added to a generation before it is aged
+	prunedGenerationSignatures = 100000
+)
+
+// bloomFilter is a fixed size bloom filter of message signatures. It can report that a signature was added when it
+// wasn't (a false positive) but never the reverse.
+type bloomFilter struct {
+	bits []byte
+}
+
+func newBloomFilter() *bloomFilter {
+	return &bloomFilter{bits: make([]byte, prunedFilterBits/8)}
+}
+
+func (bf *bloomFilter) clone() *bloomFilter {
+	filter := newBloomFilter()
+	copy(filter.bits, bf.bits)
+	return filter
+}
+
+// positions returns the bits representing signature, derived from its sha256 hash using double hashing
+func (bf *bloomFilter) positions(signature []byte) []uint32 {
+	hash := sha256.Sum256(signature)
+	h1 := binary.LittleEndian.Uint32(hash[0:4])
+	h2 := binary.LittleEndian.Uint32(hash[4:8])
+	positions := make([]uint32, prunedFilterHashes)
+	for i := range positions {
+		positions[i] = (h1 + uint32(i)*h2) % prunedFilterBits
+	}
+	return positions
+}
+
+func (bf *bloomFilter) add(signature []byte) {
+	for _, pos := range bf.positions(signature) {
+		bf.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func (bf *bloomFilter) contains(signature []byte) bool {
+	for _, pos := range bf.positions(signature) {
+		if bf.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// agingFilter is a bloom filter of pruned signatures kept in two generations so that it never saturates. Signatures
+// are added to the current generation until it holds prunedGenerationSignatures, when it replaces the previous
+// generation and a new one is started. The filter remembers at least the last prunedGenerationSignatures signatures
+// added, and its false positive rate stays under 2% however many are added.
+type agingFilter struct {
+	current  *bloomFilter
+	previous *bloomFilter
+	// added is the number of signatures in the current generation
+	added int
+}
+
+func newAgingFilter() *agingFilter {
+	return &agingFilter{current: newBloomFilter(), previous: newBloomFilter()}
+}
+
+// loadAgingFilter restores a filter saved by marshal. The single generation filter of older stores is loaded as the
+// previous generation.
+func loadAgingFilter(data []byte) (*agingFilter, error) {
+	filter := newAgingFilter()
+	switch len(data) {
+	case prunedFilterBits / 8:
+		copy(filter.previous.bits, data)
+	case 4 + 2*prunedFilterBits/8:
+		filter.added = int(binary.BigEndian.Uint32(data))
+		copy(filter.current.bits, data[4:])
+		copy(filter.previous.bits, data[4+prunedFilterBits/8:])
+	default:
+		return nil, errors.New("pruned signature filter is the wrong size")
+	}
+	return filter, nil
+}
+
+// marshal returns the filter as the number of signatures in the current generation (a 4 byte big endian integer),
+// followed by the bits of the current and previous generations
+func (af *agingFilter) marshal() []byte {
+	data := make([]byte, 4, 4+2*prunedFilterBits/8)
+	binary.BigEndian.PutUint32(data, uint32(af.added))
+	data = append(data, af.current.bits...)
+	return append(data, af.previous.bits...)
+}
+
+func (af *agingFilter) clone() *agingFilter {
+	return &agingFilter{current: af.current.clone(), previous: af.previous.clone(), added: af.added}
+}
+
+func (af *agingFilter) add(signature []byte) {
+	if af.added >= prunedGenerationSignatures {
+		af.previous, af.current, af.added = af.current, newBloomFilter(), 0
+	}
+	af.current.add(signature)
+	af.added++
+}
+
+func (af *agingFilter) contains(signature []byte) bool {
+	return af.current.contains(signature) || af.previous.contains(signature)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestAgingFilterFalsePositives(t *testing.T) {
+	filter := newAgingFilter()
+	// the signatures of 10 full generations of prunes
+	const added = 10 * prunedGenerationSignatures
+	for i := 0; i < added; i++ {
+		filter.add([]byte(fmt.Sprintf("pruned %d", i)))
+	}
+	for i := added - prunedGenerationSignatures; i < added; i++ {
+		if !filter.contains([]byte(fmt.Sprintf("pruned %d", i))) {
+			t.Fatalf("expected recently pruned signature %d to be remembered", i)
+		}
+	}
+	falsePositives := 0
+	const checked = 100000
+	for i := 0; i < checked; i++ {
+		if filter.contains([]byte(fmt.Sprintf("stored %d", i))) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / checked; rate > 0.02 {
+		t.Errorf("expected a false positive rate under 2%% after %d prunes, got %.2f%%", added, rate*100)
+	}
+}
+
+func TestLoadAgingFilter(t *testing.T) {
+	filter := newAgingFilter()
+	filter.add([]byte("pruned"))
+	loaded, err := loadAgingFilter(filter.marshal())
+	if err != nil || !loaded.contains([]byte("pruned")) || loaded.added != 1 {
+		t.Fatalf("expected the filter to be restored, got %v", err)
+	}
+
+	// the single filter of an older store
+	legacy := newBloomFilter()
+	legacy.add([]byte("pruned"))
+	loaded, err = loadAgingFilter(legacy.bits)
+	if err != nil || !loaded.contains([]byte("pruned")) || !bytes.Equal(loaded.previous.bits, legacy.bits) {
+		t.Fatalf("expected an older filter to be restored as the previous generation, got %v", err)
+	}
+	if _, err := loadAgingFilter(legacy.bits[1:]); err == nil {
+		t.Errorf("expected a filter of the wrong size to be rejected")
+	}
+}
@@ -17,7 +17,9 @@ import (
 const SaltFile = "SALT"
 
 const version = "1"
-const versionFile = "VERSION"
+
+// VersionFile is the standard filename to store the version of an encrypted directory under
+const VersionFile = "VERSION"
 
 // GenerateRandomID generates a random 16 byte hex id code
 func GenerateRandomID() string {
@@ -36,7 +38,7 @@ func InitV1Directory(directory, password string) ([32]byte, [128]byte, error) {
 		return [32]byte{}, [128]byte{}, err
 	}
 
-	if err = os.WriteFile(path.Join(directory, versionFile), []byte(version), 0600); err != nil {
+	if err = os.WriteFile(path.Join(directory, VersionFile), []byte(version), 0600); err != nil {
 		log.Errorf("Could not write version file: %v", err)
 		return [32]byte{}, [128]byte{}, err
 	}
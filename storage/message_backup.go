@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Backup implements the MessageStoreInterface Backup for sqlite message store, writing a snapshot of the database
+// as of a single transaction so messages can keep being added while it is copied
+func (s *SqliteMessageStore) Backup(ctx context.Context, file string) error {
+	if _, err := s.database.ExecContext(ctx, "VACUUM INTO ?", file); err != nil {
+		return fmt.Errorf("could not back up message database: %v", err)
+	}
+	return nil
+}
+
+// BackupSqliteMessageStore writes a snapshot of the message database in dbfile to file, which must not exist. The
+// database doesn't need to be open in this process
+func BackupSqliteMessageStore(ctx context.Context, dbfile string, file string) error {
+	if _, err := os.Stat(dbfile); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", dbfile+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", file); err != nil {
+		return fmt.Errorf("could not back up message database: %v", err)
+	}
+	return nil
+}
+
+// CheckSqliteMessageStore checks the message database in dbfile is intact and has a messages table
+func CheckSqliteMessageStore(dbfile string) error {
+	if _, err := os.Stat(dbfile); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("could not check message database: %v", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("message database is corrupt: %v", result)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+		return errors.New("message database has no messages table")
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"cwtch.im/cwtch/protocol/groups"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/openprivacy/log"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"time"
+)
+
+// A message export is a stream of:
+//   - the header "cwtch-messages" followed by a version byte (1)
+//   - a record for each message, oldest first: a uvarint length followed by the record, which is a varint timestamp
+//     of when the message was stored (unix seconds, 0 if unknown), a uvarint signature length, the signature and the
+//     ciphertext (the rest of the record)
+//   - a zero length record followed by a uvarint count of the message records, so a truncated export is detected
+const (
+	exportHeader  = "cwtch-messages"
+	exportVersion = 1
+	// maxExportRecordBytes is the largest record read from an export, far larger than any message a server accepts
+	maxExportRecordBytes = 1024 * 1024
+)
+
+// ErrInvalidExport is returned when reading a message export that is malformed or truncated
+var ErrInvalidExport = errors.New("invalid message export")
+
+// ExportedMessage is a message in an export with the time it was stored
+type ExportedMessage struct {
+	groups.EncryptedGroupMessage
+	Timestamp time.Time
+}
+
+// MessageImport summarises an import of exported messages into a store
+type MessageImport struct {
+	Imported int
+	// Duplicates are messages with the signature of a message that was already stored
+	Duplicates int
+	// Pruned are messages with the signature of a message pruned from the store (see WasPruned), which are skipped
+	// rather than stored again
+	Pruned int
+}
+
+// MessageExportWriter writes messages to a message export
+type MessageExportWriter struct {
+	w     *bufio.Writer
+	count uint64
+}
+
+// NewMessageExportWriter writes the header of a message export to w and returns a writer for its messages. Close
+// must be called once every message has been written
+func NewMessageExportWriter(w io.Writer) (*MessageExportWriter, error) {
+	ew := &MessageExportWriter{w: bufio.NewWriter(w)}
+	if _, err := ew.w.WriteString(exportHeader); err != nil {
+		return nil, err
+	}
+	return ew, ew.w.WriteByte(exportVersion)
+}
+
+// Write writes a message record to the export
+func (ew *MessageExportWriter) Write(message ExportedMessage) error {
+	if len(message.Signature) == 0 {
+		return ErrInvalidMessage
+	}
+	var timestamp int64
+	if !message.Timestamp.IsZero() {
+		timestamp = message.Timestamp.Unix()
+	}
+	record := binary.AppendVarint(nil, timestamp)
+	record = binary.AppendUvarint(record, uint64(len(message.Signature)))
+	record = append(record, message.Signature...)
+	record = append(record, message.Ciphertext...)
+	if _, err := ew.w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(record); err != nil {
+		return err
+	}
+	ew.count++
+	return nil
+}
+
+// Close ends the export and flushes it to the underlying writer
+func (ew *MessageExportWriter) Close() error {
+	if _, err := ew.w.Write(binary.AppendUvarint([]byte{0}, ew.count)); err != nil {
+		return err
+	}
+	return ew.w.Flush()
+}
+
+// MessageExportReader reads the messages of a message export
+type MessageExportReader struct {
+	r     *bufio.Reader
+	count uint64
+	done  bool
+}
+
+// NewMessageExportReader reads the header of a message export from r and returns a reader for its messages
+func NewMessageExportReader(r io.Reader) (*MessageExportReader, error) {
+	er := &MessageExportReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(exportHeader)+1)
+	if _, err := io.ReadFull(er.r, header); err != nil || !bytes.Equal(header[:len(exportHeader)], []byte(exportHeader)) {
+		return nil, fmt.Errorf("%w: not a message export", ErrInvalidExport)
+	}
+	if version := header[len(exportHeader)]; version != exportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidExport, version)
+	}
+	return er, nil
+}
+
+// Next returns the next message of the export, or io.EOF once every message has been read. An ErrInvalidExport
+// is returned for malformed records and for exports that end early
+func (er *MessageExportReader) Next() (ExportedMessage, error) {
+	if er.done {
+		return ExportedMessage{}, io.EOF
+	}
+	length, err := binary.ReadUvarint(er.r)
+	if err != nil {
+		return ExportedMessage{}, fmt.Errorf("%w: export ended after %d messages", ErrInvalidExport, er.count)
+	}
+	if length == 0 {
+		count, err := binary.ReadUvarint(er.r)
+		if err != nil || count != er.count {
+			return ExportedMessage{}, fmt.Errorf("%w: expected %d messages, read %d", ErrInvalidExport, count, er.count)
+		}
+		er.done = true
+		return ExportedMessage{}, io.EOF
+	}
+	if length > maxExportRecordBytes {
+		return ExportedMessage{}, fmt.Errorf("%w: record of %d bytes is too large", ErrInvalidExport, length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(er.r, record); err != nil {
+		return ExportedMessage{}, fmt.Errorf("%w: export ended after %d messages", ErrInvalidExport, er.count)
+	}
+	timestamp, n := binary.Varint(record)
+	if n <= 0 {
+		return ExportedMessage{}, fmt.Errorf("%w: malformed timestamp", ErrInvalidExport)
+	}
+	record = record[n:]
+	signatureLength, n := binary.Uvarint(record)
+	if n <= 0 || signatureLength == 0 || signatureLength > uint64(len(record)-n) {
+		return ExportedMessage{}, fmt.Errorf("%w: malformed signature", ErrInvalidExport)
+	}
+	record = record[n:]
+	message := ExportedMessage{EncryptedGroupMessage: groups.EncryptedGroupMessage{Signature: record[:signatureLength], Ciphertext: record[signatureLength:]}}
+	if timestamp != 0 {
+		message.Timestamp = time.Unix(timestamp, 0)
+	}
+	er.count++
+	return message, nil
+}
+
+// Export implements the MessageStoreInterface Export for sqlite message store, writing every stored message to w
+// oldest first as of a single read transaction. Returns the number of messages exported
+func (s *SqliteMessageStore) Export(ctx context.Context, w io.Writer) (int, error) {
+	ew, err := NewMessageExportWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.database.QueryContext(ctx, "SELECT signature, ciphertext, timestamp FROM messages ORDER BY id ASC")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var signature, ciphertext string
+		var timestamp int64
+		if err := rows.Scan(&signature, &ciphertext, &timestamp); err != nil {
+			return count, err
+		}
+		message := ExportedMessage{}
+		message.Signature, _ = base64.StdEncoding.DecodeString(signature)
+		message.Ciphertext, _ = base64.StdEncoding.DecodeString(ciphertext)
+		if timestamp != 0 {
+			message.Timestamp = time.Unix(timestamp, 0)
+		}
+		if err := ew.Write(message); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, ew.Close()
+}
+
+// Import implements the MessageStoreInterface Import for sqlite message store, adding the messages of the export in
+// r after those already stored, in their exported order and with their exported timestamps. Messages with the
+// signature of a stored or pruned message are skipped. The store is pruned to its cap as messages are imported, and messages
+// read before an error in the export are kept
+func (s *SqliteMessageStore) Import(ctx context.Context, r io.Reader) (MessageImport, error) {
+	var result MessageImport
+	er, err := NewMessageExportReader(r)
+	if err != nil {
+		return result, err
+	}
+	batch := make([]ExportedMessage, 0, maxWriteBatch)
+	for {
+		message, readErr := er.Next()
+		if readErr == nil {
+			if s.WasPruned(message.Signature) {
+				result.Pruned++
+			} else {
+				batch = append(batch, message)
+			}
+		}
+		// messages read before the end of the export (or an error in it) are imported
+		if len(batch) == maxWriteBatch || (readErr != nil && len(batch) > 0) {
+			stored, err := s.importBatch(ctx, batch)
+			if err != nil {
+				return result, err
+			}
+			result.Imported += stored
+			result.Duplicates += len(batch) - stored
+			batch = batch[:0]
+		}
+		if readErr == io.EOF {
+			return result, nil
+		} else if readErr != nil {
+			return result, readErr
+		}
+	}
+}
+
+// importBatch inserts a batch of exported messages in a single transaction and returns how many were not duplicates
+func (s *SqliteMessageStore) importBatch(ctx context.Context, batch []ExportedMessage) (int, error) {
+	tx, err := s.database.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	insert := tx.StmtContext(ctx, s.preparedInsertStatement)
+	stored := 0
+	for _, message := range batch {
+		var timestamp int64
+		if !message.Timestamp.IsZero() {
+			timestamp = message.Timestamp.Unix()
+		}
+		_, err := insert.ExecContext(ctx, base64.StdEncoding.EncodeToString(message.Signature), base64.StdEncoding.EncodeToString(message.Ciphertext), timestamp)
+		if err != nil {
+			var sqliteErr sqlite3.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+				continue
+			}
+			return 0, err
+		}
+		stored++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	s.messageCount += stored
+	if err := s.checkPruneMessages(ctx); err != nil {
+		log.Errorf("could not prune messages: %v", err)
+	}
+	return stored, nil
+}
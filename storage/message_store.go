@@ -1,180 +1,447 @@
 package storage
 
 import (
+	"context"
 	"cwtch.im/cwtch/protocol/groups"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"git.openprivacy.ca/openprivacy/log"
+	"github.com/mattn/go-sqlite3"
+	"io"
 	"sync"
+	"time"
 )
 
+// ErrDuplicateMessage is returned by AddMessage when a message with the same signature is already stored
+var ErrDuplicateMessage = errors.New("message already stored")
+
+// ErrInvalidMessage is returned by AddMessage for messages that can't be stored (e.g. with no signature)
+var ErrInvalidMessage = errors.New("invalid message")
+
+// StoredMessage is a message with its sequence number in the store. Sequence numbers increase with every message
+// stored and are never reused, even once messages have been pruned.
+type StoredMessage struct {
+	groups.EncryptedGroupMessage
+	Sequence int64
+}
+
 // MessageStoreInterface defines an interface to interact with a store of cwtch messages.
+// All operations return an error if the underlying store fails or the context is done
 type MessageStoreInterface interface {
-	AddMessage(groups.EncryptedGroupMessage)
-	FetchMessages() []*groups.EncryptedGroupMessage
-	MessagesCount() int
-	FetchMessagesFrom(signature []byte) []*groups.EncryptedGroupMessage
-	SetMessageCap(newcap int)
-	Close()
+	AddMessage(ctx context.Context, message groups.EncryptedGroupMessage) error
+	MessageExists(ctx context.Context, signature []byte) (bool, error)
+	FetchMessages(ctx context.Context) ([]*StoredMessage, error)
+	MessagesCount(ctx context.Context) (int, error)
+	FetchMessagesFrom(ctx context.Context, signature []byte) ([]*StoredMessage, error)
+	// FetchMessagesBounded returns the last limit messages stored since the given time, oldest first. A zero since
+	// or limit leaves that bound off.
+	FetchMessagesBounded(ctx context.Context, since time.Time, limit int) ([]*StoredMessage, error)
+	// FetchMessagesAfter returns the first limit messages with a sequence number greater than sequence, oldest first.
+	// A zero limit returns all of them.
+	FetchMessagesAfter(ctx context.Context, sequence int64, limit int) ([]*StoredMessage, error)
+	// LastSequence returns the sequence number of the newest stored message, or 0 if there are none
+	LastSequence(ctx context.Context) (int64, error)
+	SetMessageCap(ctx context.Context, newcap int) error
+	// Backup writes a consistent snapshot of the store to file, which must not exist
+	Backup(ctx context.Context, file string) error
+	// Export writes every stored message, oldest first, to w in the message export format (see MessageExportWriter)
+	Export(ctx context.Context, w io.Writer) (int, error)
+	// Import adds the messages of a message export to the store, skipping those already stored
+	Import(ctx context.Context, r io.Reader) (MessageImport, error)
+	// WasPruned returns true if a message with signature has been pruned from the store. It can return true for a
+	// few signatures that were never stored, but never returns false for one of the last 100,000 pruned signatures
+	// (older pruned signatures are eventually forgotten).
+	WasPruned(signature []byte) bool
+	Close() error
 }
 
 // SqliteMessageStore is an sqlite3 backed message store
 type SqliteMessageStore struct {
 	incMessageCounterFn func()
+	prunedFn            func(count int)
 	messageCap          int
 
 	messageCount int
-	countLock    sync.Mutex
+	prunedFilter *agingFilter
+	countLock    sync.Mutex // also guards prunedFilter
 
 	database *sql.DB
+	writer   *batchWriter
 
 	// Some prepared queries...
 	preparedInsertStatement *sql.Stmt // A Stmt is safe for concurrent use by multiple goroutines.
+	preparedExistsQuery     *sql.Stmt
 	preparedFetchFromQuery  *sql.Stmt
 	preparedFetchQuery      *sql.Stmt
+	preparedBoundedQuery    *sql.Stmt
+	preparedFetchAfterQuery *sql.Stmt
+	preparedLastSeqQuery    *sql.Stmt
 	preparedCountQuery      *sql.Stmt
 	preparedPruneStatement  *sql.Stmt
+	preparedPruneQuery      *sql.Stmt
+	preparedSaveFilter      *sql.Stmt
 }
 
 // Close closes the underlying sqlite3 database to further changes
-func (s *SqliteMessageStore) Close() {
+func (s *SqliteMessageStore) Close() error {
+	if s.writer != nil {
+		s.writer.close()
+	}
 	s.preparedInsertStatement.Close()
+	s.preparedExistsQuery.Close()
 	s.preparedFetchFromQuery.Close()
-	s.database.Close()
+	s.preparedFetchQuery.Close()
+	s.preparedBoundedQuery.Close()
+	s.preparedFetchAfterQuery.Close()
+	s.preparedLastSeqQuery.Close()
+	s.preparedCountQuery.Close()
+	s.preparedPruneStatement.Close()
+	s.preparedPruneQuery.Close()
+	s.preparedSaveFilter.Close()
+	return s.database.Close()
 }
 
-func (s *SqliteMessageStore) SetMessageCap(newcap int) {
+// SetMessageCap implements the MessageStoreInterface SetMessageCap for sqlite message store, pruning messages if the
+// store is over the new cap
+func (s *SqliteMessageStore) SetMessageCap(ctx context.Context, newcap int) error {
 	s.countLock.Lock()
 	defer s.countLock.Unlock()
 	s.messageCap = newcap
-	s.checkPruneMessages()
+	return s.checkPruneMessages(ctx)
 }
 
-// AddMessage implements the MessageStoreInterface AddMessage for sqlite message store
-func (s *SqliteMessageStore) AddMessage(message groups.EncryptedGroupMessage) {
+// AddMessage implements the MessageStoreInterface AddMessage for sqlite message store. Concurrent calls are
+// written together in a single transaction, and AddMessage only returns once its message has been committed.
+// Returns ErrDuplicateMessage if a message with the same signature is already stored
+func (s *SqliteMessageStore) AddMessage(ctx context.Context, message groups.EncryptedGroupMessage) error {
 	if s.incMessageCounterFn != nil {
 		s.incMessageCounterFn()
 	}
 	// ignore this clearly invalid message...
 	if len(message.Signature) == 0 {
-		return
+		return ErrInvalidMessage
 	}
+	return s.writer.write(ctx, message)
+}
 
-	stmt, err := s.preparedInsertStatement.Exec(base64.StdEncoding.EncodeToString(message.Signature), base64.StdEncoding.EncodeToString(message.Ciphertext))
+// MessageExists implements the MessageStoreInterface MessageExists for sqlite message store
+func (s *SqliteMessageStore) MessageExists(ctx context.Context, signature []byte) (bool, error) {
+	var exists int
+	err := s.preparedExistsQuery.QueryRowContext(ctx, base64.StdEncoding.EncodeToString(signature)).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		log.Errorf("%v %q", stmt, err)
-		return
+		log.Errorf("%v", err)
+		return false, err
 	}
-
-	s.countLock.Lock()
-	defer s.countLock.Unlock()
-	s.messageCount++
-	s.checkPruneMessages()
+	return true, nil
 }
 
-func (s *SqliteMessageStore) checkPruneMessages() {
-	if s.messageCap != -1 && s.messageCount > s.messageCap {
-		log.Debugf("Message Count: %d / Message Cap: %d, message cap exceeded, pruning oldest 10%...", s.messageCount, s.messageCap)
+// PruneCount returns how many of the oldest messages a store of messageCount messages will prune to get under
+// messageCap (or -1 for no cap)
+func PruneCount(messageCount int, messageCap int) int {
+	if messageCap != -1 && messageCount > messageCap {
 		// Delete 10% of messages (and any overage if the cap was adjusted lower)
-		delCount := (s.messageCount - s.messageCap) + s.messageCap/10
-		stmt, err := s.preparedPruneStatement.Exec(delCount)
-		if err != nil {
-			log.Errorf("%v %q", stmt, err)
-		}
-		s.messageCount -= delCount
+		return (messageCount - messageCap) + messageCap/10
 	}
+	return 0
 }
 
-func (s *SqliteMessageStore) MessagesCount() int {
-	rows, err := s.preparedCountQuery.Query()
+// checkPruneMessages prunes the store in its own transaction if it is over the message cap. countLock must be held
+func (s *SqliteMessageStore) checkPruneMessages(ctx context.Context) error {
+	delCount := PruneCount(s.messageCount, s.messageCap)
+	if delCount == 0 {
+		return nil
+	}
+	log.Debugf("Message Count: %d / Message Cap: %d, message cap exceeded, pruning oldest 10%%...", s.messageCount, s.messageCap)
+	if err := s.pruneMessages(ctx, delCount); err != nil {
+		log.Errorf("%q", err)
+		return err
+	}
+	s.messageCount -= delCount
+	if s.prunedFn != nil {
+		s.prunedFn(delCount)
+	}
+	return nil
+}
 
+// pruneMessages deletes the oldest delCount messages and records their signatures in the pruned filter
+func (s *SqliteMessageStore) pruneMessages(ctx context.Context, delCount int) error {
+	tx, err := s.database.BeginTx(ctx, nil)
 	if err != nil {
-		log.Errorf("%v", err)
-		return -1
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	result := rows.Next()
-	if !result {
-		return -1
+	rows, err := tx.StmtContext(ctx, s.preparedPruneQuery).QueryContext(ctx, delCount)
+	if err != nil {
+		return err
+	}
+	// the filter is only updated once the prune is committed
+	filter := s.prunedFilter.clone()
+	for rows.Next() {
+		var signature string
+		if err := rows.Scan(&signature); err != nil {
+			rows.Close()
+			return err
+		}
+		rawSignature, _ := base64.StdEncoding.DecodeString(signature)
+		filter.add(rawSignature)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	var rownum int
-	err = rows.Scan(&rownum)
+	if _, err := tx.StmtContext(ctx, s.preparedPruneStatement).ExecContext(ctx, delCount); err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, s.preparedSaveFilter).ExecContext(ctx, filter.marshal()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.prunedFilter = filter
+	return nil
+}
+
+// writeBatch inserts a batch of messages in a single transaction, returning an error for each message. An error
+// storing one message (other than it being a duplicate) fails the whole batch.
+func (s *SqliteMessageStore) writeBatch(batch []*writeRequest) []error {
+	errs := make([]error, len(batch))
+	stored, err := s.insertMessages(batch, errs)
 	if err != nil {
-		log.Errorf("error fetching rows: %v", err)
-		return -1
+		log.Errorf("could not store messages: %v", err)
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
 	}
 
-	return rownum
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	s.messageCount += stored
+	// the messages are stored, a failed prune will be retried on the next write
+	if err := s.checkPruneMessages(context.Background()); err != nil {
+		log.Errorf("could not prune messages: %v", err)
+	}
+	return errs
+}
+
+// insertMessages inserts and commits batch, setting errs for any messages that were not stored, and returns the
+// number of messages stored
+func (s *SqliteMessageStore) insertMessages(batch []*writeRequest, errs []error) (int, error) {
+	// the transaction is shared by all the requests in the batch, so individual contexts are only checked before
+	// their message is inserted
+	tx, err := s.database.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	insert := tx.Stmt(s.preparedInsertStatement)
+	timestamp := time.Now().Unix()
+	stored := 0
+	for i, req := range batch {
+		if errs[i] = req.ctx.Err(); errs[i] != nil {
+			continue
+		}
+		_, err := insert.Exec(base64.StdEncoding.EncodeToString(req.message.Signature), base64.StdEncoding.EncodeToString(req.message.Ciphertext), timestamp)
+		if err != nil {
+			var sqliteErr sqlite3.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+				errs[i] = ErrDuplicateMessage
+				continue
+			}
+			return 0, err
+		}
+		stored++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return stored, nil
+}
+
+// WasPruned implements the MessageStoreInterface WasPruned for sqlite message store
+func (s *SqliteMessageStore) WasPruned(signature []byte) bool {
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	return s.prunedFilter.contains(signature)
+}
+
+// MessagesCount implements the MessageStoreInterface MessagesCount for sqlite message store
+func (s *SqliteMessageStore) MessagesCount(ctx context.Context) (int, error) {
+	var rownum int
+	err := s.preparedCountQuery.QueryRowContext(ctx).Scan(&rownum)
+	if err != nil {
+		log.Errorf("error counting messages: %v", err)
+		return 0, err
+	}
+	return rownum, nil
 }
 
 // FetchMessages implements the MessageStoreInterface FetchMessages for sqlite message store
-func (s *SqliteMessageStore) FetchMessages() []*groups.EncryptedGroupMessage {
-	rows, err := s.preparedFetchQuery.Query()
+func (s *SqliteMessageStore) FetchMessages(ctx context.Context) ([]*StoredMessage, error) {
+	rows, err := s.preparedFetchQuery.QueryContext(ctx)
 	if err != nil {
 		log.Errorf("%v", err)
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 	return s.compileRows(rows)
 }
 
 // FetchMessagesFrom implements the MessageStoreInterface FetchMessagesFrom for sqlite message store
-func (s *SqliteMessageStore) FetchMessagesFrom(signature []byte) []*groups.EncryptedGroupMessage {
+func (s *SqliteMessageStore) FetchMessagesFrom(ctx context.Context, signature []byte) ([]*StoredMessage, error) {
 
 	// If signature is empty then treat this as a complete sync request
 	if len(signature) == 0 {
-		return s.FetchMessages()
+		return s.FetchMessages(ctx)
 	}
 
-	rows, err := s.preparedFetchFromQuery.Query(base64.StdEncoding.EncodeToString(signature))
+	rows, err := s.preparedFetchFromQuery.QueryContext(ctx, base64.StdEncoding.EncodeToString(signature))
 	if err != nil {
 		log.Errorf("%v", err)
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
-	messages := s.compileRows(rows)
+	messages, err := s.compileRows(rows)
+	if err != nil {
+		return nil, err
+	}
 
 	// if we don't have *any* messages then either the signature next existed
 	// or the server purged it...either way treat this as a full sync...
 	if len(messages) < 1 {
-		return s.FetchMessages()
+		return s.FetchMessages(ctx)
 	}
 
-	return messages
+	return messages, nil
 }
 
-func (s *SqliteMessageStore) compileRows(rows *sql.Rows) []*groups.EncryptedGroupMessage {
-	var messages []*groups.EncryptedGroupMessage
+// FetchMessagesBounded implements the MessageStoreInterface FetchMessagesBounded for sqlite message store.
+// Messages stored before insertion times were recorded are treated as older than any since.
+func (s *SqliteMessageStore) FetchMessagesBounded(ctx context.Context, since time.Time, limit int) ([]*StoredMessage, error) {
+	var sinceUnix int64
+	if !since.IsZero() {
+		sinceUnix = since.Unix()
+	}
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := s.preparedBoundedQuery.QueryContext(ctx, sinceUnix, limit)
+	if err != nil {
+		log.Errorf("%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return s.compileRows(rows)
+}
+
+// FetchMessagesAfter implements the MessageStoreInterface FetchMessagesAfter for sqlite message store
+func (s *SqliteMessageStore) FetchMessagesAfter(ctx context.Context, sequence int64, limit int) ([]*StoredMessage, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := s.preparedFetchAfterQuery.QueryContext(ctx, sequence, limit)
+	if err != nil {
+		log.Errorf("%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	return s.compileRows(rows)
+}
+
+// LastSequence implements the MessageStoreInterface LastSequence for sqlite message store
+func (s *SqliteMessageStore) LastSequence(ctx context.Context) (int64, error) {
+	var sequence int64
+	if err := s.preparedLastSeqQuery.QueryRowContext(ctx).Scan(&sequence); err != nil {
+		log.Errorf("error reading last sequence: %v", err)
+		return 0, err
+	}
+	return sequence, nil
+}
+
+func (s *SqliteMessageStore) compileRows(rows *sql.Rows) ([]*StoredMessage, error) {
+	var messages []*StoredMessage
 	for rows.Next() {
-		var id int
+		var id int64
 		var signature string
 		var ciphertext string
 		err := rows.Scan(&id, &signature, &ciphertext)
 		if err != nil {
 			log.Errorf("Error fetching row %v", err)
+			return nil, err
 		}
 		rawSignature, _ := base64.StdEncoding.DecodeString(signature)
 		rawCiphertext, _ := base64.StdEncoding.DecodeString(ciphertext)
-		messages = append(messages, &groups.EncryptedGroupMessage{
-			Signature:  rawSignature,
-			Ciphertext: rawCiphertext,
+		messages = append(messages, &StoredMessage{
+			EncryptedGroupMessage: groups.EncryptedGroupMessage{
+				Signature:  rawSignature,
+				Ciphertext: rawCiphertext,
+			},
+			Sequence: id,
 		})
 	}
-	return messages
+	if err := rows.Err(); err != nil {
+		log.Errorf("Error fetching rows %v", err)
+		return nil, err
+	}
+	return messages, nil
+}
+
+// sqliteOptions are applied to every connection to the database:
+//   - WAL journaling, so replays can read while messages are written
+//   - synchronous=FULL, so a committed message is durable (in WAL mode NORMAL can lose recent commits on power loss)
+//   - a busy timeout, so readers and the writer wait for locks instead of failing
+//   - immediate transactions, so write transactions take the write lock up front
+const sqliteOptions = "?_journal_mode=WAL&_synchronous=FULL&_busy_timeout=5000&_txlock=immediate"
+
+// migrateTimestamps adds the insertion timestamp column to message stores created before it existed. Existing
+// messages get a timestamp of 0.
+func migrateTimestamps(db *sql.DB) error {
+	var hasTimestamp int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name='timestamp'").Scan(&hasTimestamp); err != nil {
+		return err
+	}
+	if hasTimestamp == 0 {
+		log.Infof("Adding timestamps to message database")
+		if _, err := db.Exec("ALTER TABLE messages ADD COLUMN timestamp INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS messages_timestamp ON messages(timestamp)")
+	return err
 }
 
 // InitializeSqliteMessageStore creates a database `dbfile` with the necessary tables (if it doesn't already exist)
-// and returns an open database
-func InitializeSqliteMessageStore(dbfile string, messageCap int, incMessageCounterFn func()) (*SqliteMessageStore, error) {
-	db, err := sql.Open("sqlite3", dbfile)
+// and returns an open database. prunedFn (optional) is called with the number of messages removed after each prune
+func InitializeSqliteMessageStore(dbfile string, messageCap int, incMessageCounterFn func(), prunedFn func(count int)) (*SqliteMessageStore, error) {
+	db, err := sql.Open("sqlite3", dbfile+sqliteOptions)
 	if err != nil {
 		log.Errorf("database %v cannot be created or opened %v", dbfile, err)
 		return nil, fmt.Errorf("database %v cannot be created or opened: %v", dbfile, err)
 	}
-	sqlStmt := `CREATE TABLE IF NOT EXISTS  messages (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, signature TEXT UNIQUE NOT NULL, ciphertext TEXT NOT NULL);`
+	sqlStmt := `CREATE TABLE IF NOT EXISTS  messages (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, signature TEXT UNIQUE NOT NULL, ciphertext TEXT NOT NULL, timestamp INTEGER NOT NULL DEFAULT 0);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		db.Close()
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	if err = migrateTimestamps(db); err != nil {
+		db.Close()
+		log.Errorf("could not add message timestamps: %v", err)
+		return nil, fmt.Errorf("could not add message timestamps: %v", err)
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS pruned_signatures (id INTEGER NOT NULL PRIMARY KEY CHECK (id = 0), filter BLOB NOT NULL);`
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
 		db.Close()
@@ -185,9 +452,10 @@ func InitializeSqliteMessageStore(dbfile string, messageCap int, incMessageCount
 	slms := new(SqliteMessageStore)
 	slms.database = db
 	slms.incMessageCounterFn = incMessageCounterFn
+	slms.prunedFn = prunedFn
 	slms.messageCap = messageCap
 
-	sqlStmt = `INSERT INTO messages(signature, ciphertext) values (?,?);`
+	sqlStmt = `INSERT INTO messages(signature, ciphertext, timestamp) values (?,?,?);`
 	stmt, err := slms.database.Prepare(sqlStmt)
 	if err != nil {
 		log.Errorf("%q: %s", err, sqlStmt)
@@ -195,14 +463,46 @@ func InitializeSqliteMessageStore(dbfile string, messageCap int, incMessageCount
 	}
 	slms.preparedInsertStatement = stmt
 
-	sqlStmt = "SELECT id, signature,ciphertext from messages"
+	sqlStmt = "SELECT 1 FROM messages WHERE signature=(?) LIMIT 1"
 	query, err := slms.database.Prepare(sqlStmt)
 	if err != nil {
 		log.Errorf("%q: %s", err, sqlStmt)
 		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
 	}
+	slms.preparedExistsQuery = query
+
+	sqlStmt = "SELECT id, signature,ciphertext from messages"
+	query, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
 	slms.preparedFetchQuery = query
 
+	sqlStmt = "SELECT id, signature, ciphertext FROM (SELECT id, signature, ciphertext FROM messages WHERE timestamp>=(?) ORDER BY id DESC LIMIT (?)) ORDER BY id ASC"
+	query, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	slms.preparedBoundedQuery = query
+
+	sqlStmt = "SELECT id, signature, ciphertext FROM messages WHERE id>(?) ORDER BY id ASC LIMIT (?)"
+	query, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	slms.preparedFetchAfterQuery = query
+
+	sqlStmt = "SELECT COALESCE(MAX(id), 0) FROM messages"
+	query, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	slms.preparedLastSeqQuery = query
+
 	sqlStmt = "SELECT id, signature,ciphertext FROM messages WHERE id>=(SELECT id FROM messages WHERE signature=(?));"
 	query, err = slms.database.Prepare(sqlStmt)
 	if err != nil {
@@ -227,9 +527,49 @@ func InitializeSqliteMessageStore(dbfile string, messageCap int, incMessageCount
 	}
 	slms.preparedPruneStatement = stmt
 
-	slms.messageCount = slms.MessagesCount()
+	sqlStmt = "SELECT signature FROM messages ORDER BY id ASC LIMIT (?)"
+	query, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	slms.preparedPruneQuery = query
+
+	sqlStmt = "INSERT OR REPLACE INTO pruned_signatures(id, filter) VALUES (0, ?)"
+	stmt, err = slms.database.Prepare(sqlStmt)
+	if err != nil {
+		log.Errorf("%q: %s", err, sqlStmt)
+		return nil, fmt.Errorf("%s: %q", sqlStmt, err)
+	}
+	slms.preparedSaveFilter = stmt
+
+	var filter []byte
+	err = slms.database.QueryRow("SELECT filter FROM pruned_signatures WHERE id=0").Scan(&filter)
+	switch err {
+	case nil:
+		if slms.prunedFilter, err = loadAgingFilter(filter); err != nil {
+			slms.Close()
+			return nil, err
+		}
+	case sql.ErrNoRows:
+		slms.prunedFilter = newAgingFilter()
+	default:
+		slms.Close()
+		return nil, fmt.Errorf("could not load pruned signatures: %v", err)
+	}
+
+	slms.messageCount, err = slms.MessagesCount(context.Background())
+	if err != nil {
+		slms.Close()
+		return nil, fmt.Errorf("could not count messages: %v", err)
+	}
+
+	if err = slms.checkPruneMessages(context.Background()); err != nil {
+		slms.Close()
+		return nil, fmt.Errorf("could not prune messages: %v", err)
+	}
 
-	slms.checkPruneMessages()
+	slms.writer = newBatchWriter(maxWriteBatch, slms.writeBatch)
 
 	return slms, nil
 }
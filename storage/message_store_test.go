@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"cwtch.im/cwtch/protocol/groups"
+	"database/sql"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"git.openprivacy.ca/cwtch.im/server/metrics"
 	"git.openprivacy.ca/openprivacy/log"
 	_ "github.com/mattn/go-sqlite3" // sqlite3 driver
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -16,7 +25,7 @@ func TestMessageStore(t *testing.T) {
 	os.Remove(filename)
 	log.SetLevel(log.LevelDebug)
 	counter := metrics.NewCounter()
-	db, err := InitializeSqliteMessageStore(filename, -1, func() { counter.Add(1) })
+	db, err := InitializeSqliteMessageStore(filename, -1, func() { counter.Add(1) }, nil)
 	if err != nil {
 		t.Fatalf("Error: %v", err)
 	}
@@ -36,8 +45,11 @@ func TestMessageStore(t *testing.T) {
 
 	t.Logf("Populating Database")
 	start := time.Now()
+	ctx := context.Background()
 	for _, message := range messages {
-		db.AddMessage(message)
+		if err := db.AddMessage(ctx, message); err != nil {
+			t.Fatalf("could not add message: %v", err)
+		}
 	}
 	t.Logf("Time to Insert: %v", time.Since(start))
 	if counter.Count() != numMessages {
@@ -45,7 +57,10 @@ func TestMessageStore(t *testing.T) {
 	}
 
 	// Wait for inserts to complete..
-	fetchedMessages := db.FetchMessages()
+	fetchedMessages, err := db.FetchMessages(ctx)
+	if err != nil {
+		t.Fatalf("could not fetch messages: %v", err)
+	}
 	//for _, message := range fetchedMessages {
 	//t.Logf("Message: %v", message)
 	//}
@@ -60,7 +75,10 @@ func TestMessageStore(t *testing.T) {
 	buf := make([]byte, 4)
 	binary.PutUvarint(buf, uint64(numToFetch))
 	sig := append([]byte("Hello world"), buf...)
-	fetchedMessages = db.FetchMessagesFrom(sig)
+	fetchedMessages, err = db.FetchMessagesFrom(ctx, sig)
+	if err != nil {
+		t.Fatalf("could not fetch messages: %v", err)
+	}
 	//for _, message := range fetchedMessages {
 	//	t.Logf("Message: %v", message)
 	//}
@@ -68,5 +86,436 @@ func TestMessageStore(t *testing.T) {
 		t.Fatalf("Incorrect number of messages returned : %v", len(messages))
 	}
 
+	t.Logf("Testing Duplicates...")
+	if exists, err := db.MessageExists(ctx, messages[0].Signature); !exists || err != nil {
+		t.Errorf("expected message to exist: %v", err)
+	}
+	if exists, err := db.MessageExists(ctx, []byte("unknown")); exists || err != nil {
+		t.Errorf("expected unknown message to not exist: %v", err)
+	}
+	if err := db.AddMessage(ctx, messages[0]); err != ErrDuplicateMessage {
+		t.Errorf("expected duplicate message error, got %v", err)
+	}
+	if count, err := db.MessagesCount(ctx); count != numMessages || err != nil {
+		t.Errorf("expected duplicate message not to be stored: %v", err)
+	}
+
 	db.Close()
+
+	t.Logf("Testing Errors on a Closed Store...")
+	if _, err := db.FetchMessages(ctx); err == nil {
+		t.Errorf("expected an error fetching from a closed store")
+	}
+	if _, err := db.MessagesCount(ctx); err == nil {
+		t.Errorf("expected an error counting a closed store")
+	}
+}
+
+func TestPruneCount(t *testing.T) {
+	if PruneCount(100, -1) != 0 {
+		t.Errorf("expected no prune with no message cap")
+	}
+	if PruneCount(100, 100) != 0 {
+		t.Errorf("expected no prune at the message cap")
+	}
+	// 1 message over and 10% of the cap
+	if count := PruneCount(101, 100); count != 11 {
+		t.Errorf("expected 11 messages to be pruned, got %v", count)
+	}
+	// 50 messages over a lowered cap and 10% of the cap
+	if count := PruneCount(100, 50); count != 55 {
+		t.Errorf("expected 55 messages to be pruned, got %v", count)
+	}
+}
+
+func TestPrunedSignatures(t *testing.T) {
+	filename := "../testcwtchpruned.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := InitializeSqliteMessageStore(filename, 10, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ctx := context.Background()
+	signature := func(i int) []byte {
+		buf := make([]byte, 4)
+		binary.PutUvarint(buf, uint64(i))
+		return append([]byte("Hello world"), buf...)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: signature(i), Ciphertext: []byte("Hello world")}); err != nil {
+			t.Fatalf("could not add message: %v", err)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < 20; i++ {
+			exists, _ := db.MessageExists(ctx, signature(i))
+			if !exists && !db.WasPruned(signature(i)) {
+				t.Errorf("expected message %d to be stored or pruned", i)
+			}
+			if exists && db.WasPruned(signature(i)) {
+				t.Errorf("expected stored message %d not to be reported as pruned", i)
+			}
+		}
+		if !db.WasPruned(signature(0)) {
+			t.Errorf("expected the oldest message to have been pruned")
+		}
+		if db.WasPruned([]byte("unknown")) {
+			t.Errorf("expected unknown signature not to be reported as pruned")
+		}
+	}
+	check()
+
+	t.Logf("Testing Pruned Signatures are Kept on Reopen...")
+	db.Close()
+	db, err = InitializeSqliteMessageStore(filename, 10, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check()
+	db.Close()
+}
+
+func TestConcurrentAddMessage(t *testing.T) {
+	filename := "../testcwtchconcurrent.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// every message is posted twice, so exactly one of each pair should be stored
+	numMessages := 200
+	ctx := context.Background()
+	results := make(chan error, numMessages*2)
+	for i := 0; i < numMessages*2; i++ {
+		go func(i int) {
+			buf := make([]byte, 4)
+			binary.PutUvarint(buf, uint64(i/2))
+			results <- db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: append([]byte("Hello world"), buf...), Ciphertext: []byte("Hello world")})
+		}(i)
+	}
+	duplicates := 0
+	for i := 0; i < numMessages*2; i++ {
+		switch err := <-results; err {
+		case nil:
+		case ErrDuplicateMessage:
+			duplicates++
+		default:
+			t.Errorf("could not add message: %v", err)
+		}
+	}
+	if duplicates != numMessages {
+		t.Errorf("expected %d duplicates, got %d", numMessages, duplicates)
+	}
+	if count, err := db.MessagesCount(ctx); count != numMessages || err != nil {
+		t.Errorf("expected %d messages to be stored, got %d (%v)", numMessages, count, err)
+	}
+
+	db.Close()
+	if err := db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte("closed"), Ciphertext: []byte("Hello world")}); err == nil {
+		t.Errorf("expected an error adding to a closed store")
+	}
+}
+
+// benchmarkAddMessage adds b.N messages from parallel goroutines with at most maxBatch messages per transaction
+func benchmarkAddMessage(b *testing.B, maxBatch int) {
+	filename := "../testcwtchbenchmark.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	log.SetLevel(log.LevelWarn)
+	db, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+	defer db.Close()
+	db.writer.close()
+	db.writer = newBatchWriter(maxBatch, db.writeBatch)
+
+	var counter int64
+	var lock sync.Mutex
+	ctx := context.Background()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			counter++
+			signature := []byte(fmt.Sprintf("signature %d", counter))
+			lock.Unlock()
+			if err := db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: signature, Ciphertext: []byte("Hello world")}); err != nil {
+				b.Errorf("could not add message: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkAddMessage(b *testing.B) {
+	b.Run("Unbatched", func(b *testing.B) { benchmarkAddMessage(b, 1) })
+	b.Run("Batched", func(b *testing.B) { benchmarkAddMessage(b, maxWriteBatch) })
+}
+
+func TestFetchMessagesBounded(t *testing.T) {
+	filename := "../testcwtchbounded.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")}); err != nil {
+			t.Fatalf("could not add message: %v", err)
+		}
+	}
+	// backdate the first half of the messages
+	if _, err := db.database.Exec("UPDATE messages SET timestamp=? WHERE id<=5", time.Now().Add(-time.Hour).Unix()); err != nil {
+		t.Fatalf("could not backdate messages: %v", err)
+	}
+
+	messages, err := db.FetchMessagesBounded(ctx, time.Time{}, 3)
+	if err != nil || len(messages) != 3 || string(messages[0].Signature) != "signature 7" || string(messages[2].Signature) != "signature 9" {
+		t.Errorf("expected the last 3 messages oldest first, got %v (%v)", messages, err)
+	}
+	messages, err = db.FetchMessagesBounded(ctx, time.Now().Add(-time.Minute), 0)
+	if err != nil || len(messages) != 5 || string(messages[0].Signature) != "signature 5" {
+		t.Errorf("expected the 5 messages stored in the last minute, got %v (%v)", messages, err)
+	}
+	messages, err = db.FetchMessagesBounded(ctx, time.Now().Add(-time.Minute), 2)
+	if err != nil || len(messages) != 2 || string(messages[0].Signature) != "signature 8" {
+		t.Errorf("expected the last 2 messages stored in the last minute, got %v (%v)", messages, err)
+	}
+	messages, err = db.FetchMessagesBounded(ctx, time.Time{}, 0)
+	if err != nil || len(messages) != 10 {
+		t.Errorf("expected all messages with no bounds, got %v (%v)", len(messages), err)
+	}
+}
+
+func TestTimestampMigration(t *testing.T) {
+	filename := "../testcwtchmigration.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// a message store from before timestamps were stored
+	if _, err := db.Exec(`CREATE TABLE messages (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, signature TEXT UNIQUE NOT NULL, ciphertext TEXT NOT NULL);
+		INSERT INTO messages(signature, ciphertext) VALUES ('b2xk', 'b2xk');`); err != nil {
+		t.Fatalf("could not create legacy message store: %v", err)
+	}
+	db.Close()
+
+	store, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open legacy message store: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	if err := store.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte("new"), Ciphertext: []byte("new")}); err != nil {
+		t.Fatalf("could not add message: %v", err)
+	}
+	if messages, err := store.FetchMessagesBounded(ctx, time.Now().Add(-time.Minute), 0); err != nil || len(messages) != 1 || string(messages[0].Signature) != "new" {
+		t.Errorf("expected only the new message to have a recent timestamp, got %v (%v)", messages, err)
+	}
+	if count, _ := store.MessagesCount(ctx); count != 2 {
+		t.Errorf("expected legacy messages to be kept, got %d messages", count)
+	}
+}
+
+func TestSequences(t *testing.T) {
+	filename := "../testcwtchsequences.db"
+	os.Remove(filename)
+	defer os.Remove(filename)
+	db, err := InitializeSqliteMessageStore(filename, 10, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if sequence, err := db.LastSequence(ctx); sequence != 0 || err != nil {
+		t.Errorf("expected an empty store to have a last sequence of 0, got %v (%v)", sequence, err)
+	}
+	for i := 0; i < 5; i++ {
+		db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")})
+	}
+	last, err := db.LastSequence(ctx)
+	if err != nil {
+		t.Fatalf("could not read last sequence: %v", err)
+	}
+	messages, err := db.FetchMessagesAfter(ctx, last-2, 0)
+	if err != nil || len(messages) != 2 || messages[1].Sequence != last || string(messages[1].Signature) != "signature 4" {
+		t.Errorf("expected the 2 messages after %d, got %v (%v)", last-2, messages, err)
+	}
+	if messages, err := db.FetchMessagesAfter(ctx, last-4, 2); err != nil || len(messages) != 2 || messages[0].Sequence != last-3 {
+		t.Errorf("expected the first 2 messages after %d, got %v (%v)", last-4, messages, err)
+	}
+
+	// sequences keep increasing after the oldest messages are pruned
+	for i := 5; i < 20; i++ {
+		db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")})
+	}
+	messages, err = db.FetchMessagesAfter(ctx, last, 0)
+	if err != nil || len(messages) == 0 {
+		t.Fatalf("expected messages after %d, got %v (%v)", last, messages, err)
+	}
+	for i, message := range messages {
+		if message.Sequence <= last || (i > 0 && message.Sequence <= messages[i-1].Sequence) {
+			t.Errorf("expected sequences to increase, got %d after %d", message.Sequence, last)
+		}
+	}
+	if messages, _ := db.FetchMessagesAfter(ctx, messages[len(messages)-1].Sequence, 0); len(messages) != 0 {
+		t.Errorf("expected no messages after the last sequence, got %v", messages)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	filename := "../testcwtchbackup.db"
+	backup := "../testcwtchbackup.db.backup"
+	for _, file := range []string{filename, backup, filename + ".copy"} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	db, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte("Hello world")})
+	}
+	if err := db.Backup(ctx, backup); err != nil {
+		t.Fatalf("could not back up an open store: %v", err)
+	}
+	db.Close()
+	if err := CheckSqliteMessageStore(backup); err != nil {
+		t.Errorf("expected the backup to be intact: %v", err)
+	}
+	restored, err := InitializeSqliteMessageStore(backup, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("could not open backup: %v", err)
+	}
+	if count, _ := restored.MessagesCount(ctx); count != 5 {
+		t.Errorf("expected 5 backed up messages, got %d", count)
+	}
+	restored.Close()
+
+	if err := BackupSqliteMessageStore(ctx, filename, filename+".copy"); err != nil {
+		t.Errorf("could not back up a closed store: %v", err)
+	}
+	if err := BackupSqliteMessageStore(ctx, filename, backup); err == nil {
+		t.Errorf("expected backing up over an existing file to fail")
+	}
+	os.WriteFile(filename+".copy", []byte("not a database"), 0600)
+	if err := CheckSqliteMessageStore(filename + ".copy"); err == nil {
+		t.Errorf("expected a corrupt store to fail its check")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	filename := "../testcwtchexport.db"
+	importFilename := "../testcwtchimport.db"
+	cappedFilename := "../testcwtchcapped.db"
+	for _, file := range []string{filename, importFilename, cappedFilename} {
+		os.Remove(file)
+		defer os.Remove(file)
+	}
+	ctx := context.Background()
+	db, err := InitializeSqliteMessageStore(filename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		db.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte(fmt.Sprintf("signature %d", i)), Ciphertext: []byte(fmt.Sprintf("ciphertext %d", i))})
+	}
+	// a message stored before timestamps were recorded
+	db.database.Exec("UPDATE messages SET timestamp=0 WHERE signature=?", base64.StdEncoding.EncodeToString([]byte("signature 0")))
+
+	var export bytes.Buffer
+	if count, err := db.Export(ctx, &export); err != nil || count != 5 {
+		t.Fatalf("expected 5 messages to be exported, got %d: %v", count, err)
+	}
+	er, err := NewMessageExportReader(bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatalf("could not read export: %v", err)
+	}
+	for i := 0; ; i++ {
+		message, err := er.Next()
+		if err == io.EOF {
+			if i != 5 {
+				t.Errorf("expected 5 exported messages, got %d", i)
+			}
+			break
+		}
+		if err != nil || string(message.Signature) != fmt.Sprintf("signature %d", i) || string(message.Ciphertext) != fmt.Sprintf("ciphertext %d", i) {
+			t.Fatalf("expected message %d in order, got %v: %v", i, message, err)
+		}
+		if (i == 0) != message.Timestamp.IsZero() || (i > 0 && time.Since(message.Timestamp) > time.Minute) {
+			t.Errorf("expected message %d to keep its timestamp, got %v", i, message.Timestamp)
+		}
+	}
+
+	imported, err := InitializeSqliteMessageStore(importFilename, -1, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer imported.Close()
+	imported.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte("signature 3"), Ciphertext: []byte("ciphertext 3")})
+	imported.AddMessage(ctx, groups.EncryptedGroupMessage{Signature: []byte("other signature"), Ciphertext: []byte("other ciphertext")})
+	result, err := imported.Import(ctx, bytes.NewReader(export.Bytes()))
+	if err != nil || result.Imported != 4 || result.Duplicates != 1 {
+		t.Fatalf("expected 4 messages to be imported and 1 duplicate skipped, got %+v: %v", result, err)
+	}
+	messages, _ := imported.FetchMessages(ctx)
+	var signatures []string
+	for _, message := range messages {
+		signatures = append(signatures, string(message.Signature))
+	}
+	if strings.Join(signatures, ",") != "signature 3,other signature,signature 0,signature 1,signature 2,signature 4" {
+		t.Errorf("expected imported messages after those stored in their exported order, got %v", signatures)
+	}
+	var reexport bytes.Buffer
+	imported.Export(ctx, &reexport)
+	er, _ = NewMessageExportReader(&reexport)
+	for i := 0; i < 3; i++ {
+		message, _ := er.Next()
+		if i == 2 && (string(message.Signature) != "signature 0" || !message.Timestamp.IsZero()) {
+			t.Errorf("expected the imported message without a timestamp to keep it, got %v", message.Timestamp)
+		}
+	}
+
+	// a truncated export fails after importing the messages before the truncation
+	truncated := export.Bytes()[:export.Len()-2]
+	again, err := imported.Import(ctx, bytes.NewReader(truncated))
+	if !errors.Is(err, ErrInvalidExport) || again.Duplicates != 5 {
+		t.Errorf("expected a truncated export to fail after its messages, got %+v: %v", again, err)
+	}
+
+	// messages pruned from a capped store are not imported again
+	capped, err := InitializeSqliteMessageStore(cappedFilename, 3, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer capped.Close()
+	if result, err := capped.Import(ctx, bytes.NewReader(export.Bytes())); err != nil || result.Imported != 5 {
+		t.Fatalf("expected 5 messages to be imported, got %+v: %v", result, err)
+	}
+	again, err = capped.Import(ctx, bytes.NewReader(export.Bytes()))
+	if err != nil || again.Imported != 0 || again.Duplicates+again.Pruned != 5 || again.Pruned == 0 {
+		t.Errorf("expected pruned messages to be skipped, got %+v: %v", again, err)
+	}
+	if count, _ := capped.MessagesCount(ctx); count > 3 {
+		t.Errorf("expected the store to stay within its cap, got %d messages", count)
+	}
+	if _, err := imported.Import(ctx, strings.NewReader("not an export")); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected an invalid export to fail, got %v", err)
+	}
 }
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/openprivacy/log"
+	"go.etcd.io/bbolt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compactTxMaxBytes is how much data is copied per transaction when compacting a spent token database
+const compactTxMaxBytes = 64 * 1024 * 1024
+
+// SpentTokenCompaction summarises a compaction of a server's spent token databases
+type SpentTokenCompaction struct {
+	BytesBefore int64
+	BytesAfter  int64
+	// RemovedEpochs are the token key epochs whose spent tokens were deleted
+	RemovedEpochs []int
+}
+
+// spentTokenFiles returns the spent token databases in configDir by token key epoch
+func spentTokenFiles(configDir string) (map[int]string, error) {
+	entries, err := os.ReadDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int]string)
+	for _, entry := range entries {
+		if epoch, ok := tokenDBEpoch(entry.Name()); ok {
+			files[epoch] = path.Join(configDir, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// tokenDBEpoch returns the token key epoch of a spent token database file name, and false if name isn't one
+func tokenDBEpoch(name string) (int, bool) {
+	if name == tokenDBFile(0) {
+		return 0, true
+	}
+	if !strings.HasPrefix(name, "tokens-") || !strings.HasSuffix(name, ".db") {
+		return 0, false
+	}
+	epoch, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "tokens-"), ".db"))
+	if err != nil || tokenDBFile(epoch) != name {
+		return 0, false
+	}
+	return epoch, true
+}
+
+// fileSize returns the size of file, or 0 if it doesn't exist
+func fileSize(file string) int64 {
+	if info, err := os.Stat(file); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+// spentTokenBytes returns the total size of the spent token databases in configDir
+func spentTokenBytes(configDir string) int64 {
+	files, err := spentTokenFiles(configDir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, file := range files {
+		size += fileSize(file)
+	}
+	return size
+}
+
+// CompactSpentTokens deletes the spent tokens of token key epochs that are no longer accepted (including a previous
+// epoch whose grace window is over) and rewrites the remaining spent token databases without their free pages. The
+// databases must not be open, so the server using config must be stopped (see Server.CompactSpentTokens).
+func CompactSpentTokens(config *Config) (SpentTokenCompaction, error) {
+	compaction := SpentTokenCompaction{BytesBefore: spentTokenBytes(config.ConfigDir)}
+	epoch, _, _, previousK, previousExpires := config.tokenKeyEpochs()
+	if previousK != nil && !time.Now().Before(previousExpires) {
+		config.expirePreviousTokenKey()
+		previousK = nil
+		if err := config.Save(); err != nil {
+			return compaction, fmt.Errorf("could not save config: %v", err)
+		}
+	}
+	files, err := spentTokenFiles(config.ConfigDir)
+	if err != nil {
+		return compaction, err
+	}
+	for fileEpoch, file := range files {
+		if fileEpoch == epoch || (previousK != nil && fileEpoch == epoch-1) {
+			if err := compactBoltFile(file); err != nil {
+				return compaction, fmt.Errorf("could not compact spent tokens of token key epoch %d: %v", fileEpoch, err)
+			}
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return compaction, fmt.Errorf("could not delete spent tokens of token key epoch %d: %v", fileEpoch, err)
+		}
+		compaction.RemovedEpochs = append(compaction.RemovedEpochs, fileEpoch)
+	}
+	compaction.BytesAfter = spentTokenBytes(config.ConfigDir)
+	log.Infof("Compacted spent tokens from %d to %d bytes", compaction.BytesBefore, compaction.BytesAfter)
+	return compaction, nil
+}
+
+// compactBoltFile rewrites the bolt database in file into a new file without free pages and replaces file with it
+func compactBoltFile(file string) error {
+	src, err := bbolt.Open(file, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return errors.New("database is in use by a running server")
+		}
+		return err
+	}
+	compacted := file + ".compact"
+	os.Remove(compacted)
+	dst, err := bbolt.Open(compacted, 0600, nil)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	err = bbolt.Compact(dst, src, compactTxMaxBytes)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	src.Close()
+	if err != nil {
+		os.Remove(compacted)
+		return err
+	}
+	return os.Rename(compacted, file)
+}
+
+// removeStale deletes spent token databases of epochs that are neither the current nor the previous epoch, e.g.
+// those left behind when an epoch expired while the server was stopped. Returns the removed epochs
+func (te *tokenEpochs) removeStale() []int {
+	files, err := spentTokenFiles(te.configDir)
+	if err != nil {
+		log.Errorf("could not list spent token databases: %v", err)
+		return nil
+	}
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	var removed []int
+	for epoch := range files {
+		if epoch == te.current.epoch || (te.previous != nil && epoch == te.previous.epoch) {
+			continue
+		}
+		te.deleteSpentTokens(epoch)
+		removed = append(removed, epoch)
+	}
+	return removed
+}
+
+// currentBytes returns the size of the current epoch's spent token database
+func (te *tokenEpochs) currentBytes() int64 {
+	te.lock.RLock()
+	defer te.lock.RUnlock()
+	return fileSize(path.Join(te.configDir, tokenDBFile(te.current.epoch)))
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"go.etcd.io/bbolt"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeSpentTokens creates a bolt database of count spent tokens, of which all but keep are then deleted
+func writeSpentTokens(t *testing.T, file string, count int, keep int) {
+	db, err := bbolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatalf("could not create spent token database: %v", err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("tokens"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			if err := bucket.Put([]byte(fmt.Sprintf("token-%d", i)), make([]byte, 64)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = db.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket([]byte("tokens"))
+			for i := keep; i < count; i++ {
+				if err := bucket.Delete([]byte(fmt.Sprintf("token-%d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		t.Fatalf("could not write spent tokens: %v", err)
+	}
+}
+
+func TestCompactSpentTokens(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config := initDefaultConfig(TestDir, ServerConfigFile, false)
+	config.rotateTokenKey(time.Now())
+	config.rotateTokenKey(time.Now())
+
+	// epoch 0 has expired, epoch 1 is in its grace window and epoch 2 is current
+	for epoch := 0; epoch < 3; epoch++ {
+		writeSpentTokens(t, path.Join(TestDir, tokenDBFile(epoch)), 5000, 10)
+	}
+	os.WriteFile(path.Join(TestDir, "tokens-backup.db"), []byte{}, 0600)
+	files, _ := spentTokenFiles(TestDir)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 spent token databases, got %v", files)
+	}
+
+	compaction, err := CompactSpentTokens(config)
+	if err != nil {
+		t.Fatalf("could not compact spent tokens: %v", err)
+	}
+	if len(compaction.RemovedEpochs) != 1 || compaction.RemovedEpochs[0] != 0 {
+		t.Errorf("expected the spent tokens of epoch 0 to be removed, got %v", compaction.RemovedEpochs)
+	}
+	if compaction.BytesAfter >= compaction.BytesBefore/3 {
+		t.Errorf("expected compaction to reclaim the deleted tokens, got %d bytes from %d", compaction.BytesAfter, compaction.BytesBefore)
+	}
+	if _, err := os.Stat(path.Join(TestDir, "tokens-backup.db")); err != nil {
+		t.Errorf("expected files that aren't spent token databases to be kept")
+	}
+
+	db, err := bbolt.Open(path.Join(TestDir, tokenDBFile(2)), 0600, nil)
+	if err != nil {
+		t.Fatalf("could not open compacted spent tokens: %v", err)
+	}
+	db.View(func(tx *bbolt.Tx) error {
+		if count := tx.Bucket([]byte("tokens")).Stats().KeyN; count != 10 {
+			t.Errorf("expected 10 spent tokens to be kept, got %d", count)
+		}
+		return nil
+	})
+
+	// a database in use can't be compacted
+	if _, err := CompactSpentTokens(config); err == nil {
+		t.Errorf("expected compacting spent tokens in use to fail")
+	}
+	db.Close()
+
+	// the previous epoch is removed once its grace window is over
+	config.PreviousTokenKeyExpires = time.Now().Add(-time.Minute)
+	if compaction, err = CompactSpentTokens(config); err != nil || len(compaction.RemovedEpochs) != 1 || compaction.RemovedEpochs[0] != 1 {
+		t.Errorf("expected the spent tokens of epoch 1 to be removed, got %v: %v", compaction.RemovedEpochs, err)
+	}
+	if config.PreviousTokenServiceK != nil {
+		t.Errorf("expected the previous token key to be expired")
+	}
+}
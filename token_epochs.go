@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"git.openprivacy.ca/cwtch.im/tapir/applications"
+	"git.openprivacy.ca/cwtch.im/tapir/persistence"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
+	"git.openprivacy.ca/openprivacy/log"
+	"github.com/gtank/ristretto255"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// tokenEpochCheckInterval is how often a running server checks whether its token key is due to be rotated
+const tokenEpochCheckInterval = time.Minute
+
+// spentTokenBucket is the bucket of a token server's spent token database that holds its spent tokens
+const spentTokenBucket = "tokens"
+
+// errTokenSpent is returned by tokenEpochs when spending a token that has already been spent
+var errTokenSpent = errors.New("token has already been spent")
+
+// tokenSpender spends privacy pass tokens, returning an error if a token is invalid or has already been spent
+type tokenSpender interface {
+	SpendToken(token *privacypass.SpentToken, data []byte) error
+}
+
+// tokenDBFile returns the name of the spent token database of a token key epoch. The first epoch keeps the name used
+// before keys were rotated.
+func tokenDBFile(epoch int) string {
+	if epoch == 0 {
+		return "tokens.db"
+	}
+	return fmt.Sprintf("tokens-%d.db", epoch)
+}
+
+// tokenEpoch is the token server for one token key
+type tokenEpoch struct {
+	epoch  int
+	server *privacypass.TokenServer
+	spent  persistence.Service
+}
+
+// isSpent returns true if token has been spent in the epoch
+func (e *tokenEpoch) isSpent(token *privacypass.SpentToken) bool {
+	spent, err := e.spent.Check(spentTokenBucket, hex.EncodeToString(token.T))
+	return err == nil && spent
+}
+
+// tokenEpochs holds the token server of the current token key epoch, which issues and accepts tokens, and during
+// its grace window the token server of the previous epoch, which only accepts them. Each epoch records its spent
+// tokens in its own database, which is deleted when the epoch expires.
+type tokenEpochs struct {
+	configDir string
+	lock      sync.RWMutex
+	current   tokenEpoch
+	previous  *tokenEpoch
+	// spendLock stops a token being spent between checking whether it was spent and spending it
+	spendLock sync.Mutex
+}
+
+// openTokenEpoch opens the spent token database of epoch and returns its token server using key k
+func openTokenEpoch(configDir string, epoch int, k ristretto255.Scalar) tokenEpoch {
+	bs := new(persistence.BoltPersistence)
+	bs.Open(path.Join(configDir, tokenDBFile(epoch)))
+	return tokenEpoch{epoch: epoch, server: privacypass.NewTokenServerFromStore(&k, bs), spent: bs}
+}
+
+// newTokenEpochs opens the current and previous (if still in its grace window) token key epochs of config
+func newTokenEpochs(config *Config) *tokenEpochs {
+	te := &tokenEpochs{configDir: config.ConfigDir}
+	te.reopen(config)
+	return te
+}
+
+// reopen opens the token key epochs of config, after they have been closed
+func (te *tokenEpochs) reopen(config *Config) {
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	epoch, k, _, previousK, previousExpires := config.tokenKeyEpochs()
+	te.current = openTokenEpoch(config.ConfigDir, epoch, k)
+	te.previous = nil
+	if previousK != nil && time.Now().Before(previousExpires) {
+		previous := openTokenEpoch(config.ConfigDir, epoch-1, *previousK)
+		te.previous = &previous
+	}
+}
+
+// currentServer returns the token server issuing tokens
+func (te *tokenEpochs) currentServer() *privacypass.TokenServer {
+	te.lock.RLock()
+	defer te.lock.RUnlock()
+	return te.current.server
+}
+
+// isDoubleSpend returns true if err is tokenEpochs rejecting a token because it has already been spent
+func isDoubleSpend(err error) bool {
+	return errors.Is(err, errTokenSpent)
+}
+
+// SpendToken spends a token issued in the current epoch or, during its grace window, the previous epoch. It returns
+// errTokenSpent if the token has already been spent in either epoch
+func (te *tokenEpochs) SpendToken(token *privacypass.SpentToken, data []byte) error {
+	te.spendLock.Lock()
+	defer te.spendLock.Unlock()
+	te.lock.RLock()
+	defer te.lock.RUnlock()
+	if te.current.isSpent(token) || (te.previous != nil && te.previous.isSpent(token)) {
+		return errTokenSpent
+	}
+	err := te.current.server.SpendToken(token, data)
+	if err != nil && te.previous != nil {
+		// a token is only valid for the key it was issued with, so it can't be spent in both epochs
+		if previousErr := te.previous.server.SpendToken(token, data); previousErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// rotate makes a new epoch with key k the current epoch. The current epoch becomes the previous epoch, and any
+// older epoch is expired
+func (te *tokenEpochs) rotate(epoch int, k ristretto255.Scalar) {
+	next := openTokenEpoch(te.configDir, epoch, k)
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	if te.previous != nil {
+		te.previous.server.Close()
+		te.deleteSpentTokens(te.previous.epoch)
+	}
+	previous := te.current
+	te.previous = &previous
+	te.current = next
+}
+
+// expirePrevious stops accepting tokens from the previous epoch (if they are still accepted) and deletes the spent
+// tokens of epoch
+func (te *tokenEpochs) expirePrevious(epoch int) {
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	if te.previous != nil {
+		te.previous.server.Close()
+		te.previous = nil
+	}
+	te.deleteSpentTokens(epoch)
+}
+
+// deleteSpentTokens deletes the spent token database of an epoch
+func (te *tokenEpochs) deleteSpentTokens(epoch int) {
+	log.Infof("Deleting spent tokens of token key epoch %d", epoch)
+	if err := os.Remove(path.Join(te.configDir, tokenDBFile(epoch))); err != nil && !os.IsNotExist(err) {
+		log.Errorf("could not delete spent tokens of token key epoch %d: %v", epoch, err)
+	}
+}
+
+// close closes the token servers of every epoch
+func (te *tokenEpochs) close() {
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	te.current.server.Close()
+	if te.previous != nil {
+		te.previous.server.Close()
+	}
+}
+
+// epochTokenApplication is a TokenApplication that issues tokens from the current token key epoch, so new
+// connections use a new key as soon as it is rotated
+type epochTokenApplication struct {
+	applications.TokenApplication
+	epochs   *tokenEpochs
+	issuance *tokenIssuance
+}
+
+// NewInstance creates a TokenApplication for the current token key epoch
+func (app *epochTokenApplication) NewInstance() tapir.Application {
+	tokenApplication := &issuingTokenApplication{issuance: app.issuance}
+	tokenApplication.TokenService = app.epochs.currentServer()
+	return tokenApplication
+}
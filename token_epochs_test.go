@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"git.openprivacy.ca/cwtch.im/server/metrics"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenEpochs(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config := initDefaultConfig(TestDir, ServerConfigFile, false)
+	config.TokenKeyRotation = TokenKeyRotation{IntervalHours: 24, GraceHours: 2}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("config should be valid: %v", err)
+	}
+
+	epochs := newTokenEpochs(config)
+	defer epochs.close()
+	firstY := epochs.currentServer().Y.String()
+
+	now := time.Now()
+	epoch, k := config.rotateTokenKey(now)
+	if epoch != 1 || config.PreviousTokenServiceK == nil || !config.PreviousTokenKeyExpires.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("expected epoch 1 with the previous key kept for 2 hours, got epoch %d expiring %v", epoch, config.PreviousTokenKeyExpires)
+	}
+	epochs.rotate(epoch, k)
+	if epochs.currentServer().Y.String() == firstY {
+		t.Errorf("expected a new Y after rotating the token key")
+	}
+	if epochs.previous == nil || epochs.previous.server.Y.String() != firstY {
+		t.Errorf("expected the previous epoch to accept tokens during its grace window")
+	}
+
+	// a restarted server still accepts the previous epoch's tokens during the grace window
+	reopened := newTokenEpochs(config)
+	if reopened.previous == nil || reopened.current.epoch != 1 {
+		t.Errorf("expected the previous epoch to be reopened")
+	}
+	reopened.close()
+
+	spent := path.Join(TestDir, tokenDBFile(0))
+	os.WriteFile(spent, []byte{}, 0600)
+	config.expirePreviousTokenKey()
+	epochs.expirePrevious(0)
+	if epochs.previous != nil {
+		t.Errorf("expected the previous epoch to stop accepting tokens once expired")
+	}
+	if _, err := os.Stat(spent); !os.IsNotExist(err) {
+		t.Errorf("expected the previous epoch's spent tokens to be deleted")
+	}
+
+	config.TokenKeyRotation = TokenKeyRotation{IntervalHours: 1, GraceHours: 2}
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected a grace window longer than the rotation interval to fail validation")
+	}
+}
+
+// memoryPersistence is an in-memory persistence.Service
+type memoryPersistence struct {
+	lock    sync.Mutex
+	buckets map[string]map[string]bool
+}
+
+func (mp *memoryPersistence) Open(handle string) error {
+	return nil
+}
+
+func (mp *memoryPersistence) Setup(buckets []string) error {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	if mp.buckets == nil {
+		mp.buckets = make(map[string]map[string]bool)
+	}
+	for _, bucket := range buckets {
+		if mp.buckets[bucket] == nil {
+			mp.buckets[bucket] = make(map[string]bool)
+		}
+	}
+	return nil
+}
+
+func (mp *memoryPersistence) Persist(bucket string, name string, data interface{}) error {
+	mp.Setup([]string{bucket})
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	mp.buckets[bucket][name] = true
+	return nil
+}
+
+func (mp *memoryPersistence) Check(bucket string, name string) (bool, error) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+	return mp.buckets[bucket][name], nil
+}
+
+func (mp *memoryPersistence) Load(bucket string, name string, v interface{}) (bool, error) {
+	return false, nil
+}
+
+func (mp *memoryPersistence) Close() {}
+
+// newMemoryTokenEpoch returns a token epoch keeping its spent tokens in memory
+func newMemoryTokenEpoch(epoch int) (tokenEpoch, *memoryPersistence) {
+	spent := new(memoryPersistence)
+	spent.Setup([]string{spentTokenBucket})
+	k := newTokenServiceK()
+	return tokenEpoch{epoch: epoch, server: privacypass.NewTokenServerFromStore(&k, spent), spent: spent}, spent
+}
+
+func TestSpendTokenTwice(t *testing.T) {
+	current, currentSpent := newMemoryTokenEpoch(1)
+	previous, previousSpent := newMemoryTokenEpoch(0)
+	epochs := &tokenEpochs{current: current, previous: &previous}
+
+	spentNow := &privacypass.SpentToken{T: []byte("spent in the current epoch")}
+	currentSpent.Persist(spentTokenBucket, hex.EncodeToString(spentNow.T), true)
+	spentBefore := &privacypass.SpentToken{T: []byte("spent in the previous epoch")}
+	previousSpent.Persist(spentTokenBucket, hex.EncodeToString(spentBefore.T), true)
+	for _, token := range []*privacypass.SpentToken{spentNow, spentBefore} {
+		if err := epochs.SpendToken(token, nil); !isDoubleSpend(err) {
+			t.Errorf("expected a token spent in either epoch to be a double spend, got %v", err)
+		}
+	}
+	if isDoubleSpend(nil) || isDoubleSpend(errors.New("token: {} has already been spent")) {
+		t.Errorf("expected only tokens found spent before spending them to be double spends")
+	}
+}
+
+func TestCountTokenSpend(t *testing.T) {
+	s := new(server)
+	s.countTokenSpend(nil) // before metrics are started
+	s.metricsPack.TokenSpendCounter = metrics.NewCounter()
+	s.metricsPack.DoubleSpendCounter = metrics.NewCounter()
+	s.metricsPack.InvalidTokenCounter = metrics.NewCounter()
+
+	s.countTokenSpend(nil)
+	s.countTokenSpend(errTokenSpent)
+	s.countTokenSpend(errors.New("token: {} is invalid and/or has not been signed by this service"))
+	s.countTokenSpend(errors.New("token: {} is invalid and/or has not been signed by this service"))
+	if spent, double, invalid := s.metricsPack.TokenSpendCounter.Count(), s.metricsPack.DoubleSpendCounter.Count(), s.metricsPack.InvalidTokenCounter.Count(); spent != 1 || double != 1 || invalid != 2 {
+		t.Errorf("expected 1 spend, 1 double spend and 2 invalid tokens, got %d, %d and %d", spent, double, invalid)
+	}
+}
+
+func TestServerTokenKeyRotation(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	config.TokenKeyRotation = TokenKeyRotation{IntervalHours: 24, GraceHours: 2}
+	s := newServer(config, nil)
+	defer s.Destroy()
+	rotated := s.Subscribe(EventTokenKeyRotated)
+	defer rotated.Unsubscribe()
+	start := config.TokenKeyRotatedAt
+	firstY := s.tokenEpochs.currentServer().Y.String()
+
+	s.checkTokenEpochs(start.Add(23 * time.Hour))
+	if s.tokenEpochs.current.epoch != 0 {
+		t.Fatalf("expected no rotation before the rotation interval")
+	}
+
+	s.checkTokenEpochs(start.Add(24 * time.Hour))
+	if s.tokenEpochs.current.epoch != 1 || s.tokenEpochs.previous == nil || s.tokenEpochs.currentServer().Y.String() == firstY {
+		t.Fatalf("expected a rotation to epoch 1 once the rotation interval was over")
+	}
+	select {
+	case event := <-rotated.Events():
+		if event.Data[FieldEpoch] != "1" {
+			t.Errorf("expected a rotation to epoch 1, got %v", event.Data)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected a token key rotated event")
+	}
+	saved, _ := LoadConfig(TestDir, ServerConfigFile, false, "")
+	if saved.TokenKeyEpoch != 1 || saved.PreviousTokenServiceK == nil || !saved.PreviousTokenKeyExpires.Equal(start.Add(26*time.Hour)) {
+		t.Errorf("expected the rotation to be saved, got epoch %d expiring %v", saved.TokenKeyEpoch, saved.PreviousTokenKeyExpires)
+	}
+
+	s.checkTokenEpochs(start.Add(25 * time.Hour))
+	if s.tokenEpochs.previous == nil {
+		t.Errorf("expected the previous epoch to be kept during its grace window")
+	}
+	s.checkTokenEpochs(start.Add(26 * time.Hour))
+	if s.tokenEpochs.previous != nil {
+		t.Errorf("expected the previous epoch to expire once its grace window was over")
+	}
+	if _, err := os.Stat(path.Join(TestDir, tokenDBFile(0))); !os.IsNotExist(err) {
+		t.Errorf("expected the spent tokens of the expired epoch to be deleted")
+	}
+	if saved, _ := LoadConfig(TestDir, ServerConfigFile, false, ""); saved.PreviousTokenServiceK != nil {
+		t.Errorf("expected the expiry to be saved")
+	}
+
+	// concurrent checks rotate a due key once
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.checkTokenEpochs(start.Add(48 * time.Hour))
+		}()
+	}
+	wg.Wait()
+	if epoch := s.tokenEpochs.current.epoch; epoch != 2 || config.TokenKeyEpoch != 2 {
+		t.Errorf("expected concurrent checks to rotate once to epoch 2, got %d", epoch)
+	}
+}
+
+func TestDeferredTokenKeyRotation(t *testing.T) {
+	os.RemoveAll(TestDir)
+	os.Mkdir(TestDir, 0700)
+	defer os.RemoveAll(TestDir)
+	config, err := CreateConfig(TestDir, ServerConfigFile, false, "", false)
+	if err != nil {
+		t.Fatalf("could not create config: %v", err)
+	}
+	config.TokenKeyRotation = TokenKeyRotation{IntervalHours: 24, GraceHours: 2, MaxSpentTokenMBs: 1}
+	s := newServer(config, nil)
+	defer s.Destroy()
+
+	if err := s.RotateTokenKey(); err != nil {
+		t.Fatalf("could not rotate token key: %v", err)
+	}
+	rotatedAt := config.TokenKeyRotatedAt
+	if err := s.RotateTokenKey(); err == nil || config.TokenKeyEpoch != 1 {
+		t.Errorf("expected a rotation during the grace window of the previous key to be rejected")
+	}
+
+	// the spent tokens of epoch 1 reach maxSpentTokenMBs during the grace window of epoch 0
+	spent, err := os.OpenFile(path.Join(TestDir, tokenDBFile(1)), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("could not open spent tokens: %v", err)
+	}
+	spent.Truncate(1024 * 1024)
+	spent.Close()
+	s.checkTokenEpochs(rotatedAt.Add(time.Hour))
+	if s.tokenEpochs.current.epoch != 1 || s.tokenEpochs.previous == nil || !s.tokenKeyRotationDeferred {
+		t.Fatalf("expected the rotation to be deferred while epoch 0 is in its grace window")
+	}
+
+	// once the grace window is over, epoch 0 expires and the deferred rotation happens
+	s.checkTokenEpochs(rotatedAt.Add(2 * time.Hour))
+	if s.tokenEpochs.current.epoch != 2 || s.tokenEpochs.previous == nil || s.tokenEpochs.previous.epoch != 1 || s.tokenKeyRotationDeferred {
+		t.Errorf("expected the deferred rotation to epoch 2 once epoch 0 had expired, got epoch %d", s.tokenEpochs.current.epoch)
+	}
+	if !config.PreviousTokenKeyExpires.Equal(rotatedAt.Add(4 * time.Hour)) {
+		t.Errorf("expected epoch 1 to get a full grace window, expiring %v", config.PreviousTokenKeyExpires)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"git.openprivacy.ca/cwtch.im/server/metrics"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"git.openprivacy.ca/cwtch.im/tapir/applications"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
+	"git.openprivacy.ca/openprivacy/log"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenIssuanceWindow is how far back issued tokens are counted when adapting the tokens issued per request
+	tokenIssuanceWindow = time.Hour
+	// tokenIssuanceAdjustInterval is how often an adapting server reconsiders the tokens it issues per request
+	tokenIssuanceAdjustInterval = 10 * time.Minute
+)
+
+// tokenIssuance applies a server's TokenIssuance settings to the token service and tracks how many tokens it has
+// recently issued
+type tokenIssuance struct {
+	lock     sync.Mutex
+	settings TokenIssuance
+	// perRequest is the most tokens currently issued for one proof of work, TokensPerRequest unless throttled
+	perRequest int
+	issued     metrics.RateCounter
+	// issuedFn (optional) is called with the number of tokens issued to each request, and powFailedFn (optional)
+	// every time a proof of work fails
+	issuedFn    func(count int)
+	powFailedFn func()
+}
+
+func newTokenIssuance(settings TokenIssuance, issuedFn func(count int), powFailedFn func()) *tokenIssuance {
+	return &tokenIssuance{settings: settings, perRequest: settings.TokensPerRequest, issued: metrics.NewRateCounter(tokenIssuanceWindow), issuedFn: issuedFn, powFailedFn: powFailedFn}
+}
+
+// recordIssued counts tokens issued to a request
+func (ti *tokenIssuance) recordIssued(count int) {
+	ti.issued.Add(count)
+	if ti.issuedFn != nil {
+		ti.issuedFn(count)
+	}
+}
+
+// recordPowFailed counts a failed proof of work
+func (ti *tokenIssuance) recordPowFailed() {
+	if ti.powFailedFn != nil {
+		ti.powFailedFn()
+	}
+}
+
+// update applies new settings, keeping a throttled tokens per request if it is still within them
+func (ti *tokenIssuance) update(settings TokenIssuance) {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	ti.settings = settings
+	if settings.TargetTokensPerHour == 0 || ti.perRequest > settings.TokensPerRequest {
+		ti.perRequest = settings.TokensPerRequest
+	} else if ti.perRequest < settings.MinTokensPerRequest {
+		ti.perRequest = settings.MinTokensPerRequest
+	}
+}
+
+// tokensPerRequest returns the most tokens currently issued for one proof of work
+func (ti *tokenIssuance) tokensPerRequest() int {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	return ti.perRequest
+}
+
+// issuedLastHour returns how many tokens were issued within tokenIssuanceWindow
+func (ti *tokenIssuance) issuedLastHour() int {
+	return ti.issued.Count()
+}
+
+// adapt lowers the tokens per request by one while more than TargetTokensPerHour tokens were issued within the
+// window and raises it by one while less than half that were. Returns the tokens per request and whether it changed
+func (ti *tokenIssuance) adapt() (int, bool) {
+	issued := ti.issued.Count()
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+	target := ti.settings.TargetTokensPerHour
+	switch {
+	case target == 0:
+		return ti.perRequest, false
+	case issued > target && ti.perRequest > ti.settings.MinTokensPerRequest:
+		ti.perRequest--
+	case issued < target/2 && ti.perRequest < ti.settings.TokensPerRequest:
+		ti.perRequest++
+	default:
+		return ti.perRequest, false
+	}
+	return ti.perRequest, true
+}
+
+// proofOfWorkApplication is tapir's ProofOfWorkApplication, counting and closing connections that fail it
+type proofOfWorkApplication struct {
+	applications.ProofOfWorkApplication
+	issuance *tokenIssuance
+}
+
+// NewInstance creates a proofOfWorkApplication for a new connection
+func (powapp *proofOfWorkApplication) NewInstance() tapir.Application {
+	return &proofOfWorkApplication{issuance: powapp.issuance}
+}
+
+// Init challenges an inbound connection to a proof of work, closing it if the proof of work fails
+func (powapp *proofOfWorkApplication) Init(connection tapir.Connection) {
+	powapp.ProofOfWorkApplication.Init(connection)
+	if connection.IsOutbound() || connection.HasCapability(applications.SuccessfulProofOfWorkCapability) {
+		return
+	}
+	log.Debugf("proof of work failed")
+	powapp.issuance.recordPowFailed()
+	connection.Close()
+}
+
+// tokenRequestConnection is an inbound token service connection that refuses requests for more tokens than are
+// issued for one proof of work and counts the tokens it issues
+type tokenRequestConnection struct {
+	tapir.Connection
+	issuance *tokenIssuance
+}
+
+// Expect reads a request for blinded tokens to be signed, closing the connection if it asks for too many
+func (conn *tokenRequestConnection) Expect() []byte {
+	request := conn.Connection.Expect()
+	var blinded []privacypass.BlindedToken
+	if err := json.Unmarshal(request, &blinded); err != nil {
+		// the TokenApplication ignores malformed requests
+		return request
+	}
+	if max := conn.issuance.tokensPerRequest(); len(blinded) > max {
+		log.Debugf("refusing to issue %d tokens for one proof of work, the limit is %d", len(blinded), max)
+		conn.Close()
+		return nil
+	}
+	conn.issuance.recordIssued(len(blinded))
+	return request
+}
+
+// issuingTokenApplication is a TokenApplication that limits and counts the tokens it issues
+type issuingTokenApplication struct {
+	applications.TokenApplication
+	issuance *tokenIssuance
+}
+
+// Init issues tokens to an inbound connection, as long as it doesn't ask for too many
+func (app *issuingTokenApplication) Init(connection tapir.Connection) {
+	if !connection.IsOutbound() {
+		connection = &tokenRequestConnection{Connection: connection, issuance: app.issuance}
+	}
+	app.TokenApplication.Init(connection)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"git.openprivacy.ca/cwtch.im/tapir"
+	"git.openprivacy.ca/cwtch.im/tapir/applications"
+	"git.openprivacy.ca/cwtch.im/tapir/primitives/privacypass"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// requestConnection is an inbound connection that sends a single request
+type requestConnection struct {
+	tapir.Connection
+	request []byte
+	closed  bool
+}
+
+func (rc *requestConnection) Expect() []byte {
+	return rc.request
+}
+
+func (rc *requestConnection) Close() {
+	rc.closed = true
+}
+
+// pipeConnection is one end of an in-memory connection between a tapir client and server
+type pipeConnection struct {
+	tapir.Connection
+	outbound     bool
+	in           chan []byte
+	out          chan []byte
+	lock         sync.Mutex
+	capabilities map[tapir.Capability]bool
+	closed       chan bool
+	closeOnce    sync.Once
+}
+
+// newPipeConnections returns the client and server ends of a new in-memory connection
+func newPipeConnections() (*pipeConnection, *pipeConnection) {
+	toServer, toClient := make(chan []byte, 1), make(chan []byte, 1)
+	client := &pipeConnection{outbound: true, in: toClient, out: toServer, capabilities: make(map[tapir.Capability]bool), closed: make(chan bool)}
+	server := &pipeConnection{outbound: false, in: toServer, out: toClient, capabilities: make(map[tapir.Capability]bool), closed: make(chan bool)}
+	return client, server
+}
+
+func (pc *pipeConnection) IsOutbound() bool {
+	return pc.outbound
+}
+
+func (pc *pipeConnection) Send(message []byte) error {
+	pc.out <- message
+	return nil
+}
+
+func (pc *pipeConnection) Expect() []byte {
+	select {
+	case message := <-pc.in:
+		return message
+	case <-pc.closed:
+		return nil
+	}
+}
+
+func (pc *pipeConnection) HasCapability(name tapir.Capability) bool {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.capabilities[name]
+}
+
+func (pc *pipeConnection) SetCapability(name tapir.Capability) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.capabilities[name] = true
+}
+
+func (pc *pipeConnection) Close() {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+}
+
+func (pc *pipeConnection) IsClosed() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// proveWork runs tapir's client proof of work against the server's proofOfWorkApplication, returning the client and
+// server ends of the connection
+func proveWork(issuance *tokenIssuance) (*pipeConnection, *pipeConnection) {
+	clientChain := new(applications.ApplicationChain).ChainApplication(new(applications.ProofOfWorkApplication), applications.SuccessfulProofOfWorkCapability)
+	serverChain := new(applications.ApplicationChain).ChainApplication(&proofOfWorkApplication{issuance: issuance}, applications.SuccessfulProofOfWorkCapability)
+	client, server := newPipeConnections()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		clientChain.NewInstance().Init(client)
+	}()
+	go func() {
+		defer wg.Done()
+		serverChain.NewInstance().Init(server)
+	}()
+	wg.Wait()
+	return client, server
+}
+
+func TestProofOfWorkApplication(t *testing.T) {
+	var failed int32
+	issuance := newTokenIssuance(TokenIssuance{TokensPerRequest: 10}, nil, func() { atomic.AddInt32(&failed, 1) })
+	client, server := proveWork(issuance)
+	if !client.HasCapability(applications.SuccessfulProofOfWorkCapability) || !server.HasCapability(applications.SuccessfulProofOfWorkCapability) {
+		t.Fatalf("expected a client's proof of work to be accepted")
+	}
+	if server.IsClosed() || atomic.LoadInt32(&failed) != 0 {
+		t.Fatalf("expected a successful proof of work to keep the connection open")
+	}
+
+	// a client answering the seed with a made up solution is rejected
+	client, server = newPipeConnections()
+	done := make(chan bool)
+	go func() {
+		new(applications.ApplicationChain).ChainApplication(&proofOfWorkApplication{issuance: issuance}, applications.SuccessfulProofOfWorkCapability).NewInstance().Init(server)
+		close(done)
+	}()
+	client.Expect()
+	client.Send(bytes.Repeat([]byte{0xff}, 32))
+	<-done
+	if server.HasCapability(applications.SuccessfulProofOfWorkCapability) {
+		t.Errorf("expected a made up proof of work to be rejected")
+	}
+	if !server.IsClosed() {
+		t.Errorf("expected a failed proof of work to close the connection")
+	}
+	if failed := atomic.LoadInt32(&failed); failed != 1 {
+		t.Errorf("expected 1 failed proof of work to be counted, got %d", failed)
+	}
+}
+
+// requestTokens sends a request for count tokens, returning whether it was accepted
+func requestTokens(issuance *tokenIssuance, count int) bool {
+	request, _ := json.Marshal(make([]privacypass.BlindedToken, count))
+	conn := &requestConnection{request: request}
+	return (&tokenRequestConnection{Connection: conn, issuance: issuance}).Expect() != nil && !conn.closed
+}
+
+func TestTokenIssuance(t *testing.T) {
+	settings := TokenIssuance{TokensPerRequest: 10, TargetTokensPerHour: 100, MinTokensPerRequest: 8}
+	if err := validateTokenIssuance(settings); err != nil {
+		t.Fatalf("settings should be valid: %v", err)
+	}
+	issuedCount := 0
+	issuance := newTokenIssuance(settings, func(count int) { issuedCount += count }, nil)
+
+	for i := 0; i < 11; i++ {
+		if !requestTokens(issuance, 10) {
+			t.Fatalf("expected a request for 10 tokens to be accepted")
+		}
+	}
+	if requestTokens(issuance, 11) {
+		t.Errorf("expected a request for 11 tokens to be refused")
+	}
+	if issued := issuance.issuedLastHour(); issued != 110 || issuedCount != 110 {
+		t.Errorf("expected 110 tokens to be counted, got %d and %d", issued, issuedCount)
+	}
+
+	// the tokens per request fall while issuance is over target, down to the minimum
+	for i, expected := range []int{9, 8, 8} {
+		if perRequest, _ := issuance.adapt(); perRequest != expected {
+			t.Errorf("expected %d tokens per request after adapting %d times, got %d", expected, i+1, perRequest)
+		}
+	}
+	if requestTokens(issuance, 9) {
+		t.Errorf("expected a request for more tokens than are currently issued to be refused")
+	}
+	if !requestTokens(issuance, 8) {
+		t.Errorf("expected a request for the throttled tokens per request to be accepted")
+	}
+	// and rise back when the target is raised
+	settings.TargetTokensPerHour = 1000
+	issuance.update(settings)
+	if perRequest, changed := issuance.adapt(); perRequest != 9 || !changed {
+		t.Errorf("expected tokens per request to rise to 9, got %d", perRequest)
+	}
+	settings.TargetTokensPerHour = 0
+	issuance.update(settings)
+	if perRequest := issuance.tokensPerRequest(); perRequest != 10 {
+		t.Errorf("expected tokens per request to reset to 10 when not adapting, got %d", perRequest)
+	}
+
+	settings.MinTokensPerRequest = 12
+	settings.TargetTokensPerHour = 100
+	if err := validateTokenIssuance(settings); err == nil {
+		t.Errorf("expected a minimum above the tokens per request to fail validation")
+	}
+}